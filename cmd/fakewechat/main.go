@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src/wechattest"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	listen    string
+	appID     string
+	appSecret string
+	tokenTTL  time.Duration
+)
+
+func main() {
+	flag.StringVar(&listen, "listen", ":8097", "listen address of the fake wechat api")
+	flag.StringVar(&appID, "app-id", "wx_fake_app", "app id accepted by cgi-bin/token")
+	flag.StringVar(&appSecret, "app-secret", "fake_secret", "app secret accepted by cgi-bin/token")
+	flag.DurationVar(&tokenTTL, "token-ttl", 7200*time.Second, "lifetime of issued access tokens")
+	flag.Parse()
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	s := wechattest.NewServer(appID, appSecret)
+	s.SetTokenTTL(tokenTTL)
+
+	logrus.Infof("fake wechat api listening on %s", listen)
+	if err := http.ListenAndServe(listen, s); err != nil {
+		logrus.Errorf("fail to run fake wechat api, err=%s", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/wechat"
+)
+
+const usage = `wechat-replay pushes archived portal messages through the current service and
+compares the outcomes with the archived ones.
+
+The messages are read from the database of -config, and the service runs against the one
+of -target-config. In dry run, the default, nothing is written to the target: each record
+is created as live in a transaction rolled back right after, and a later message of the
+same hash in the run is a duplicate. The quotas count only the records in the target. Replaying
+against the database the messages were archived in finds most of them duplicated, use a
+snapshot from before -from to check a change of deduplication.
+
+usage:
+  wechat-replay [flags]
+
+flags:
+`
+
+const batchSize = 100
+
+func main() {
+	fs := flag.NewFlagSet("wechat-replay", flag.ExitOnError)
+	configPath := fs.String("config", "./config.json", "config of the database the messages are archived in")
+	targetPath := fs.String("target-config", "", "config of the database the service runs against, -config by default, required by -live")
+	live := fs.Bool("live", false, "write the records to the target rather than dry run")
+	from := fs.String("from", "", "replay the messages archived since, RFC3339, 24h ago by default")
+	to := fs.String("to", "", "replay the messages archived before, RFC3339, now by default")
+	id := fs.Int("id", 0, "only replay the archived message of the id")
+	user := fs.String("user", "", "only replay the messages of the openid")
+	outcome := fs.String("outcome", "", "only replay the messages archived with the outcome, e.g. deduplicated")
+	limit := fs.Int("limit", 0, "replay at most n messages, 0 is no limit")
+	asJson := fs.Bool("json", false, "print one json result per line")
+	failOnChange := fs.Bool("fail-on-change", false, "exit 1 if any outcome changed, for regression checks")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(os.Args[1:])
+	// the archive is normally production, a live replay must not write into it by default
+	if *live && *targetPath == "" {
+		fail("-live requires -target-config")
+	}
+
+	cfg, err := src.NewConfigFromFile(*configPath)
+	if err != nil {
+		fail("fail to read config, %s", err.Error())
+	}
+	targetCfg := cfg
+	if *targetPath != "" {
+		if targetCfg, err = src.NewConfigFromFile(*targetPath); err != nil {
+			fail("fail to read target config, %s", err.Error())
+		}
+	}
+
+	now := time.Now()
+	since, err := src.ParseTime(*from, now.Add(-24*time.Hour))
+	if err != nil {
+		fail("invalid -from, %s", err.Error())
+	}
+	until, err := src.ParseTime(*to, now)
+	if err != nil {
+		fail("invalid -to, %s", err.Error())
+	}
+
+	archive, err := datastore.NewMysqlDataStore(cfg, false)
+	if err != nil {
+		fail("fail to connect to the archive, %s", err.Error())
+	}
+	target := archive
+	if *targetPath != "" {
+		if target, err = datastore.NewMysqlDataStore(targetCfg, false); err != nil {
+			fail("fail to connect to the target, %s", err.Error())
+		}
+	}
+	var store datastore.DataStore = target
+	if !*live {
+		store = datastore.NewDryRunDataStore(target)
+	}
+
+	replayer, err := wechat.NewReplayer(targetCfg, store)
+	if err != nil {
+		fail("fail to create replayer, %s", err.Error())
+	}
+	defer replayer.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var summary struct{ replayed, skipped, changed, failed int }
+	report := func(result wechat.ReplayResult) {
+		switch {
+		case result.Skipped:
+			summary.skipped++
+		case result.Error != "":
+			summary.failed++
+			summary.replayed++
+		default:
+			summary.replayed++
+		}
+		if result.Changed() {
+			summary.changed++
+		}
+		printResult(result, *asJson)
+	}
+
+	if *id > 0 {
+		msg, ok, err := archive.GetInboundMessage(ctx, *id)
+		if err != nil {
+			fail("fail to get archived message, %s", err.Error())
+		}
+		if !ok {
+			fail("archived message %d not found", *id)
+		}
+		report(replayer.Replay(ctx, msg))
+	} else {
+		option := datastore.NewInboundQueryOption(since, until).WithUser(*user).WithOutcome(*outcome)
+		for total, after := 0, 0; ctx.Err() == nil && (*limit == 0 || total < *limit); {
+			n := batchSize
+			if *limit > 0 && *limit-total < n {
+				n = *limit - total
+			}
+			msgs, err := archive.GetInboundMessages(ctx, option.After(after).WithLimit(n))
+			if err != nil {
+				fail("fail to get archived messages, %s", err.Error())
+			}
+			for _, msg := range msgs {
+				report(replayer.Replay(ctx, msg))
+				after = msg.ID
+			}
+			total += len(msgs)
+			if len(msgs) < n {
+				break
+			}
+		}
+	}
+
+	mode := "dry run"
+	if *live {
+		mode = "live"
+	}
+	fmt.Fprintf(os.Stderr, "%s: replayed=%d skipped=%d changed=%d failed=%d\n",
+		mode, summary.replayed, summary.skipped, summary.changed, summary.failed)
+	if *failOnChange && summary.changed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printResult(result wechat.ReplayResult, asJson bool) {
+	if asJson {
+		raw, _ := json.Marshal(result)
+		fmt.Println(string(raw))
+		return
+	}
+
+	switch {
+	case result.Skipped:
+		fmt.Printf("%d\t%s\tskipped, %s\n", result.ID, result.WechatID, result.Archived)
+	case result.Error != "":
+		fmt.Printf("%d\t%s\terror, %s\n", result.ID, result.WechatID, result.Error)
+	default:
+		mark := ""
+		if result.Changed() {
+			mark = "\tCHANGED"
+		}
+		fmt.Printf("%d\t%s\t%s -> %s\t%q -> %q%s\n", result.ID, result.WechatID,
+			result.Archived, result.Replayed, result.ArchivedReply, result.Reply, mark)
+	}
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/wechat"
+	"github.com/hanzezhenalex/wechat/src/wechattest"
+)
+
+const usage = `wechat-sim sends signed wechat messages to a running portal.
+
+usage:
+  wechat-sim [global flags] text   -from <openid> -content <text>
+  wechat-sim [global flags] image  -from <openid> -pic-url <url>
+  wechat-sim [global flags] event  -from <openid> -event <subscribe|SCAN|...> [-key <event key>]
+  wechat-sim [global flags] replay -file <messages.jsonl> [-rate <msg/s>] [-concurrency <n>]
+
+global flags:
+`
+
+var (
+	target     string
+	token      string
+	configPath string
+	to         string
+)
+
+func main() {
+	global := flag.NewFlagSet("wechat-sim", flag.ExitOnError)
+	global.StringVar(&target, "target", "http://localhost:8096/wechat/portal", "portal url")
+	global.StringVar(&token, "token", "", "portal token, overrides the one in config")
+	global.StringVar(&configPath, "config", "", "config file to read the portal token from")
+	global.StringVar(&to, "to", "gh_simulator", "ToUserName of the official account")
+	global.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		global.PrintDefaults()
+	}
+	_ = global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	if token == "" && configPath != "" {
+		cfg, err := src.NewConfigFromFile(configPath)
+		if err != nil {
+			fail("fail to read config, %s", err.Error())
+		}
+		token = cfg.Token
+	}
+	if token == "" {
+		fail("portal token is required, set -token or -config")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	portal := wechattest.NewPortal(target, token)
+	cmd, args := global.Arg(0), global.Args()[1:]
+
+	switch cmd {
+	case "text", "image", "event":
+		msg := buildMessage(cmd, args)
+		reply, raw, err := portal.Push(ctx, msg)
+		if err != nil {
+			fail("fail to push message, %s", err.Error())
+		}
+		printReply(reply, raw)
+	case "replay":
+		replay(ctx, portal, args)
+	default:
+		global.Usage()
+		os.Exit(2)
+	}
+}
+
+func buildMessage(cmd string, args []string) wechat.Message {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	from := fs.String("from", "", "FromUserName (openid) of the sender")
+	content := fs.String("content", "", "text content")
+	picUrl := fs.String("pic-url", "", "PicUrl of the image")
+	event := fs.String("event", "subscribe", "event type")
+	key := fs.String("key", "", "EventKey of the event")
+	_ = fs.Parse(args)
+
+	if *from == "" {
+		fail("-from is required")
+	}
+
+	switch cmd {
+	case "text":
+		return wechattest.NewTextMessage(*from, to, *content)
+	case "image":
+		if *picUrl == "" {
+			fail("-pic-url is required")
+		}
+		return wechattest.NewImageMessage(*from, to, *picUrl)
+	default:
+		return wechattest.NewEventMessage(*from, to, *event, *key)
+	}
+}
+
+func replay(ctx context.Context, portal *wechattest.Portal, args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "file with one json encoded message per line")
+	rate := fs.Float64("rate", 1, "messages per second, 0 means as fast as possible")
+	concurrency := fs.Int("concurrency", 1, "max requests in flight")
+	_ = fs.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fail("fail to open message file, %s", err.Error())
+	}
+	defer func() { _ = f.Close() }()
+
+	msgs, err := wechattest.ReadMessages(f)
+	if err != nil {
+		fail("%s", err.Error())
+	}
+
+	fmt.Printf("replaying %d messages to %s, rate=%.2f/s, concurrency=%d\n", len(msgs), target, *rate, *concurrency)
+	result := portal.Replay(ctx, msgs, *rate, *concurrency)
+	fmt.Printf("sent=%d failed=%d duration=%s p50=%s p99=%s max=%s\n",
+		result.Sent, result.Failed, result.Duration, result.P50, result.P99, result.Max)
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printReply(reply wechat.Message, raw string) {
+	if raw == "" {
+		fmt.Println("empty reply")
+		return
+	}
+
+	fmt.Println("raw reply:")
+	var indented strings.Builder
+	decoder := xml.NewDecoder(strings.NewReader(raw))
+	encoder := xml.NewEncoder(&indented)
+	encoder.Indent("  ", "  ")
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		_ = encoder.EncodeToken(token)
+	}
+	_ = encoder.Flush()
+	fmt.Println(indented.String())
+
+	fmt.Println("parsed reply:")
+	fmt.Printf("  ToUserName:   %s\n", reply.ToUserName)
+	fmt.Printf("  FromUserName: %s\n", reply.FromUserName)
+	fmt.Printf("  CreateTime:   %s\n", reply.CreateTime)
+	fmt.Printf("  MsgType:      %s\n", reply.MsgType)
+	fmt.Printf("  Content:      %s\n", reply.Content)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
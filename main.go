@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/hanzezhenalex/wechat/src"
 	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/metrics"
 	"github.com/hanzezhenalex/wechat/src/wechat"
 
 	"github.com/gin-gonic/gin"
@@ -18,27 +24,37 @@ const (
 	internalV1Group = "/internal/api/v1"
 	wechatGroup     = "/wechat"
 	portal          = "/portal"
+	oauthGroup      = "/oauth"
+	h5Group         = "/h5"
 )
 
 var (
 	configFilePath string
+	configFlags    src.ConfigFlags
 	debug          bool
 )
 
 func init() {
-	flag.StringVar(&configFilePath, "config", defaultConfigFilePath, "config file path")
+	flag.StringVar(&configFilePath, "config", defaultConfigFilePath, "config file path, json, yaml or toml, empty to only read env and flags")
+	configFlags = src.RegisterConfigFlags(flag.CommandLine)
 	flag.BoolVar(&debug, "debug", false, "debug mode")
-
-	flag.Parse()
 }
 
 func main() {
-	cfg, err := src.NewConfigFromFile(configFilePath)
+	flag.Parse()
+
+	cfg, err := src.LoadConfig(configFilePath, os.LookupEnv, configFlags)
 	if err != nil {
 		logrus.Errorf("fail to read config, err=%s", err.Error())
 		os.Exit(1)
 	}
 
+	stopTracing, err := src.InitTracing(cfg.Tracing)
+	if err != nil {
+		logrus.Errorf("fail to init tracing, err=%s", err.Error())
+		os.Exit(1)
+	}
+
 	store, err := datastore.NewMysqlDataStore(cfg, false)
 	if err != nil {
 		logrus.Errorf("fail to create mysql datastore, err=%s", err.Error())
@@ -51,39 +67,86 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := startGin(cfg, c); err != nil {
-		logrus.Errorf("fail to run gin server, err=%s", err.Error())
+	ln, err := net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		logrus.Errorf("fail to listen on %s, err=%s", cfg.Server.Addr, err.Error())
 		os.Exit(1)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	watcher := src.NewConfigWatcher(configFilePath, os.LookupEnv, configFlags, cfg)
+	watcher.OnReload(c.CheckRuntime, c.ApplyRuntime)
+	watcher.OnReload(nil, func(rt src.RuntimeConfig) { setLogLevel(rt.LogLevel) })
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	watcher.Start(time.Duration(cfg.ReloadPollSeconds)*time.Second, hup)
+
+	srv := newHttpServer(cfg.Server, newGin(cfg, c, watcher))
+	// the coordinator stops the token daemon, the store goes last as everything writes to it
+	if err := serve(ctx, srv, ln, cfg.Server, watcher.Stop, c.Close, func() {
+		if err := store.Close(); err != nil {
+			logrus.Errorf("fail to close mysql datastore, err=%s", err.Error())
+		}
+	}, stopTracing); err != nil {
+		logrus.Errorf("fail to run http server, err=%s", err.Error())
+		os.Exit(1)
+	}
 }
 
-func startGin(cfg src.Config, c *wechat.Coordinator) error {
+func newGin(cfg src.Config, c *wechat.Coordinator, watcher *src.ConfigWatcher) *gin.Engine {
 	eng := gin.New()
-	eng.Use(gin.Recovery(), src.TracerMiddleware())
+	eng.Use(gin.Recovery(), src.TracerMiddleware(), metrics.Middleware())
 
 	if debug == false {
 		gin.SetMode(gin.ReleaseMode)
-		logrus.SetLevel(logrus.InfoLevel)
 	} else {
 		gin.SetMode(gin.DebugMode)
-		logrus.SetLevel(logrus.DebugLevel)
 	}
+	setLogLevel(cfg.Runtime.LogLevel)
 
 	logrus.SetFormatter(&logrus.TextFormatter{
 		TimestampFormat: "2006-01-02 15:04:05",
 	})
 
 	registerRoutes(eng, c, cfg)
+	watcher.RegisterEndpoints(eng.Group(internalV1Group+"/config", wechat.InternalAuth()))
+	return eng
+}
 
-	return eng.Run(":8096")
+// setLogLevel takes the level validated by the config, -debug always wins.
+func setLogLevel(level string) {
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+		return
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		lvl = logrus.InfoLevel
+	}
+	logrus.SetLevel(lvl)
 }
 
 func registerRoutes(r *gin.Engine, c *wechat.Coordinator, cfg src.Config) {
+	// gin trusts every proxy by default, anyone could forge X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logrus.Errorf("fail to set trusted proxies, err=%s", err.Error())
+	}
+	// the series tell the traffic and the health of the service, not for the public
+	if cfg.MetricsToken != "" {
+		r.GET("/metrics", wechat.BearerAuth(cfg.MetricsToken), metrics.Handler())
+	} else {
+		logrus.Warning("metrics not served, metrics_token is not set")
+	}
+	c.RegisterHealthEndpoints(r)
+
 	wechatG := r.Group(wechatGroup)
-	wechatG.Use(wechat.IsWechat(cfg))
+	wechatG.Use(c.CallbackIPFilter(), wechat.IsWechat(cfg))
 	wechatG.GET(portal, wechat.HealthCheck())
 	wechatG.POST(portal, c.Handler())
 
 	c.RegisterEndpoints(r.Group(internalV1Group))
+	c.RegisterOAuthEndpoints(r.Group(oauthGroup))
+	c.RegisterH5Endpoints(r.Group(h5Group))
 }
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/wechat"
+	"github.com/hanzezhenalex/wechat/src/wechattest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	mock "github.com/hanzezhenalex/wechat/src/datastore/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortalEndToEnd(t *testing.T) {
+	rq := require.New(t)
+	gin.SetMode(gin.TestMode)
+
+	fake := wechattest.NewServer("app_id", "app_secret")
+	api := httptest.NewServer(fake)
+	defer api.Close()
+
+	// started first, the oauth flow needs to know where to come back
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cfg := src.Config{
+		Token:          "portal_token",
+		AppID:          "app_id",
+		AppSecret:      "app_secret",
+		TokenFilePath:  filepath.Join(t.TempDir(), "token.json"),
+		TicketFilePath: filepath.Join(t.TempDir(), "jsapi_ticket.json"),
+		ApiBaseUrl:     api.URL,
+
+		PublicBaseUrl:     server.URL,
+		OAuthAuthorizeUrl: api.URL + "/connect/oauth2/authorize",
+
+		Notify: src.NotifyConfig{
+			Review: src.NotifyTemplate{
+				TemplateID: "review_tmpl",
+				Data:       map[string]string{"keyword1": "{{.Owner.Name}}", "keyword2": "{{.Record.ID}}"},
+			},
+			Result: src.NotifyTemplate{
+				TemplateID: "result_tmpl",
+				Url:        server.URL + h5Group + "/records",
+				Data:       map[string]string{"keyword1": "{{.Status}}", "keyword2": "{{.Record.DenyReason}}"},
+			},
+			MaxAttempts: 3,
+		},
+		Portal: src.PortalConfig{
+			MaxSkewSeconds: 300,
+			NonceCacheSize: 100,
+			IPAllowlist:    true,
+			// the cache lets the push in before the first fetch
+			CallbackIPFile:         filepath.Join(t.TempDir(), "callback_ip.json"),
+			CallbackIPRefreshHours: 24,
+		},
+		Server:       src.ServerConfig{TrustedProxies: []string{"127.0.0.1"}},
+		MetricsToken: "metrics_token",
+		Pipeline:     src.PipelineConfig{Workers: 4, QueueSize: 8, DeadlineMillis: 4500},
+		// retried by hand in the test only
+		DeadLetter: src.DeadLetterConfig{MaxAttempts: 3, PollSeconds: 3600, BackoffSeconds: 60},
+		Archive:    src.ArchiveConfig{Enabled: true, RetentionDays: 7},
+	}
+	fake.SetCallbackIPs("127.0.0.1", "101.226.103.0/25")
+	rq.NoError(os.WriteFile(cfg.Portal.CallbackIPFile, []byte(`{"ip_list":["127.0.0.1"]}`), 0644))
+
+	ctrl := gomock.NewController(t)
+	store := mock.NewMockDataStore(ctrl)
+	store.EXPECT().GetAllUsers(gomock.Any()).Return([]datastore.UserInfo{
+		{WechatID: "user_1", Name: "张三", LeaderID: "leader_1"},
+		{WechatID: "leader_1", Name: "李四"},
+	}, nil)
+
+	// every message is archived, see the archive subtest
+	var (
+		archiveMutex sync.Mutex
+		archived     []datastore.InboundMessage
+	)
+	store.EXPECT().PurgeInboundMessages(gomock.Any(), gomock.Any()).Return(int64(0), nil).AnyTimes()
+	store.EXPECT().CreateInboundMessage(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, msg datastore.InboundMessage) (datastore.InboundMessage, error) {
+			archiveMutex.Lock()
+			defer archiveMutex.Unlock()
+			msg.ID = len(archived) + 1
+			archived = append(archived, msg)
+			return msg, nil
+		}).AnyTimes()
+
+	c, err := wechat.NewCoordinator(cfg, store)
+	rq.NoError(err)
+	defer c.Close()
+
+	eng := gin.New()
+	registerRoutes(eng, c, cfg)
+	server.Config.Handler = eng
+
+	portalUrl := server.URL + wechatGroup + portal
+	pusher := wechattest.NewPortal(portalUrl, cfg.Token)
+	ctx := context.Background()
+
+	t.Run("echostr", func(t *testing.T) {
+		echo, err := pusher.Verify(ctx, "hello")
+		rq.NoError(err)
+		rq.Equal("hello", echo)
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		_, _, err := wechattest.NewPortal(portalUrl, "wrong").
+			Push(ctx, wechat.Message{FromUserName: "user_1", MsgType: "text"})
+		rq.Error(err)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		target, err := pusher.SignedUrl(url.Values{"echostr": []string{"hello"}})
+		rq.NoError(err)
+
+		resp, err := http.Get(target)
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		resp, err = http.Get(target)
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusBadRequest, resp.StatusCode)
+
+		stale := wechattest.NewPortal(portalUrl, cfg.Token)
+		stale.SetClockSkew(-10 * time.Minute)
+		_, err = stale.Verify(ctx, "hello")
+		rq.Error(err)
+	})
+
+	t.Run("image", func(t *testing.T) {
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_1", gomock.Any()).DoAndReturn(
+			func(_ context.Context, record *datastore.RecordInfo, _ string, _ datastore.CreateRecordOption) (bool, error) {
+				record.ID = 42
+				return false, nil
+			})
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_1", gomock.Any()).Return(true, nil)
+
+		msg := wechat.Message{
+			ToUserName:   "official",
+			FromUserName: "user_1",
+			MsgType:      "image",
+			PicUrl:       "https://mmbiz.qpic.cn/sz_mmbiz_jpg/md5_1/0",
+		}
+		reply, _, err := pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("user_1", reply.ToUserName)
+		rq.Equal("成功", reply.Content)
+
+		reply, _, err = pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("请勿重复上传", reply.Content)
+
+		// only the new record is sent to the leader for review
+		rq.Eventually(func() bool { return len(fake.TemplateMessages()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		sent := fake.TemplateMessages()[0]
+		rq.Equal("leader_1", sent.ToUser)
+		rq.Equal("review_tmpl", sent.TemplateID)
+		rq.Equal("张三", sent.Data["keyword1"].Value)
+		rq.Equal("42", sent.Data["keyword2"].Value, "the record inserted is notified")
+	})
+
+	t.Run("review", func(t *testing.T) {
+		review := func(body string) int {
+			req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/records/1/review", strings.NewReader(body))
+			rq.NoError(err)
+			req.Header.Set("x-alex-auth", src.DefaultApiToken)
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		rq.Equal(http.StatusBadRequest, review(`{"status":"denied","reviewer":"leader_1"}`))
+
+		denied, err := datastore.RecordStatusFromString(datastore.Denied)
+		rq.NoError(err)
+		store.EXPECT().ReviewRecord(gomock.Any(), 1, datastore.Denied, "leader_1", "图片模糊").
+			Return(datastore.RecordInfo{ID: 1, OwnerID: "user_1", Status: denied, DenyReason: "图片模糊"}, true, nil)
+		// the first send fails, it is retried
+		fake.FailNext("/cgi-bin/message/template/send", 1, -1)
+		rq.Equal(http.StatusOK, review(`{"status":"denied","reviewer":"leader_1","reason":"图片模糊"}`))
+
+		rq.Eventually(func() bool { return len(fake.TemplateMessages()) == 2 }, 5*time.Second, 10*time.Millisecond)
+		sent := fake.TemplateMessages()[1]
+		rq.Equal("user_1", sent.ToUser)
+		rq.Equal("已驳回", sent.Data["keyword1"].Value)
+		rq.Equal("图片模糊", sent.Data["keyword2"].Value)
+
+		store.EXPECT().ReviewRecord(gomock.Any(), 1, datastore.Confirmed, "leader_1", "").
+			Return(datastore.RecordInfo{}, false, nil)
+		rq.Equal(http.StatusConflict, review(`{"status":"confirmed","reviewer":"leader_1"}`))
+
+		// user_1 opts out
+		store.EXPECT().UpdateUserNotify(gomock.Any(), "user_1", true).Return(nil)
+		req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/ums/notify",
+			strings.NewReader(`{"wechat_id":"user_1","mute":true}`))
+		rq.NoError(err)
+		req.Header.Set("x-alex-auth", src.DefaultApiToken)
+		resp, err := http.DefaultClient.Do(req)
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		store.EXPECT().ReviewRecord(gomock.Any(), 1, datastore.Confirmed, "leader_1", "").
+			Return(datastore.RecordInfo{ID: 1, OwnerID: "user_1"}, true, nil)
+		rq.Equal(http.StatusOK, review(`{"status":"confirmed","reviewer":"leader_1"}`))
+		rq.Never(func() bool { return len(fake.TemplateMessages()) > 2 }, 200*time.Millisecond, 10*time.Millisecond)
+	})
+
+	t.Run("jssdk signature", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+internalV1Group+"/jssdk/signature?url="+
+			url.QueryEscape("https://h5.example.com/records?a=1"), nil)
+		rq.NoError(err)
+
+		resp, err := http.DefaultClient.Do(req)
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+		req.Header.Set("x-alex-auth", src.DefaultApiToken)
+		resp, err = http.DefaultClient.Do(req)
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		var cfg wechat.JsConfig
+		rq.NoError(json.NewDecoder(resp.Body).Decode(&cfg))
+		rq.Equal("app_id", cfg.AppID)
+		rq.Equal(wechat.JsSignature("fake_ticket_1", cfg.NonceStr, cfg.Timestamp, "https://h5.example.com/records?a=1"), cfg.Signature)
+	})
+
+	t.Run("menu", func(t *testing.T) {
+		definition, err := os.ReadFile("deploy/menu.yaml")
+		rq.NoError(err)
+
+		apply := func(dryRun bool) map[string]interface{} {
+			req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/menu?dry_run="+
+				strconv.FormatBool(dryRun), bytes.NewReader(definition))
+			rq.NoError(err)
+			req.Header.Set("x-alex-auth", src.DefaultApiToken)
+
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			defer func() { _ = resp.Body.Close() }()
+			rq.Equal(http.StatusOK, resp.StatusCode)
+
+			var result map[string]interface{}
+			rq.NoError(json.NewDecoder(resp.Body).Decode(&result))
+			return result
+		}
+
+		result := apply(true)
+		rq.Equal(false, result["applied"])
+		rq.NotEmpty(result["changes"])
+
+		result = apply(false)
+		rq.Equal(true, result["applied"])
+
+		// applied, nothing left to change
+		result = apply(false)
+		rq.Equal(false, result["applied"])
+		rq.Empty(result["changes"])
+	})
+
+	jar, err := cookiejar.New(nil)
+	rq.NoError(err)
+	browser := &http.Client{Jar: jar}
+
+	t.Run("oauth", func(t *testing.T) {
+		// stranger is authorized by wechat but not registered
+		fake.SetOAuthUser("stranger")
+		resp, err := browser.Get(server.URL + h5Group + "/me")
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusForbidden, resp.StatusCode)
+
+		fake.SetOAuthUser("user_1")
+		resp, err = browser.Get(server.URL + h5Group + "/me")
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		var user datastore.UserInfo
+		rq.NoError(json.NewDecoder(resp.Body).Decode(&user))
+		rq.Equal("user_1", user.WechatID)
+	})
+
+	t.Run("records page", func(t *testing.T) {
+		store.EXPECT().GetRecords(gomock.Any(), gomock.Any()).Return([]datastore.RecordInfo{
+			{ID: 3, OwnerID: "user_1", Status: 1, GraphUrl: "https://mmbiz.qpic.cn/a/md5_1/0", DuplicateOf: 1},
+			{ID: 2, OwnerID: "user_1", Status: 2, GraphUrl: "https://mmbiz.qpic.cn/a/md5_2/0", DenyReason: "图片模糊"},
+		}, nil)
+		store.EXPECT().GetRecordsByIds(gomock.Any(), []int{1}).Return([]datastore.RecordInfo{
+			{ID: 1, OwnerID: "user_2", Status: 3, GraphUrl: "https://mmbiz.qpic.cn/a/md5_1/0"},
+		}, nil)
+
+		resp, err := browser.Get(server.URL + h5Group + "/records?status=denied")
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		rq.NoError(err)
+		rq.Contains(string(body), "驳回原因：图片模糊")
+		rq.Contains(string(body), "与 #1")
+		rq.Contains(string(body), `<option value="denied" selected>`)
+
+		resp, err = browser.Get(server.URL + h5Group + "/static/style.css")
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("qrcode registration", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/registrations/qrcode",
+			strings.NewReader(`{"leader_id":"user_1","expire_in":3600}`))
+		rq.NoError(err)
+		req.Header.Set("x-alex-auth", src.DefaultApiToken)
+		resp, err := http.DefaultClient.Do(req)
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		var qrcode wechat.QRCode
+		rq.NoError(json.NewDecoder(resp.Body).Decode(&qrcode))
+		scene, ok := fake.QRCodeScene(qrcode.Ticket)
+		rq.True(ok)
+		rq.Equal(qrcode.Scene, scene)
+
+		// newbie follows the account by scanning the qrcode
+		registration := datastore.Registration{ID: 9, WechatID: "newbie", LeaderID: "user_1",
+			Source: datastore.RegistrationByQRCode, Status: datastore.RegistrationPending}
+		store.EXPECT().CreateRegistration(gomock.Any(), gomock.Any()).Return(registration, true, nil)
+
+		reply, _, err := pusher.Push(ctx, wechattest.NewEventMessage("newbie", "official", "subscribe", "qrscene_"+scene))
+		rq.NoError(err)
+		rq.Equal("已提交注册申请，请等待审批", reply.Content)
+		rq.Eventually(func() bool {
+			customs := fake.CustomMessages()
+			return len(customs) > 0 && customs[len(customs)-1].ToUser == "user_1"
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// the leader approves it on the h5 page
+		store.EXPECT().GetRegistration(gomock.Any(), 9).Return(registration, true, nil).Times(2)
+		store.EXPECT().CreateNewUser(gomock.Any(), datastore.UserInfo{
+			WechatID: "newbie", Name: "王五", LeaderID: "user_1", Active: true, Subscribed: true}).Return(nil)
+		approved := registration
+		approved.Status = datastore.RegistrationApproved
+		store.EXPECT().ReviewRegistration(gomock.Any(), 9, datastore.RegistrationApproved, "user_1").Return(approved, true, nil)
+		store.EXPECT().GetRegistrations(gomock.Any(), datastore.RegistrationPending, "user_1").Return(nil, nil)
+
+		resp, err = browser.PostForm(server.URL+h5Group+"/registrations/9", url.Values{"action": {"approve"}, "name": {"王五"}})
+		rq.NoError(err)
+		body, err := io.ReadAll(resp.Body)
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+		rq.Contains(string(body), "没有待审批的注册申请")
+
+		rq.Eventually(func() bool {
+			customs := fake.CustomMessages()
+			return customs[len(customs)-1].ToUser == "newbie"
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// scanning again after approved
+		reply, _, err = pusher.Push(ctx, wechattest.NewEventMessage("newbie", "official", "SCAN", scene))
+		rq.NoError(err)
+		rq.Equal("您已注册，无需重复申请", reply.Content)
+	})
+
+	t.Run("text registration", func(t *testing.T) {
+		registration := datastore.Registration{ID: 10, WechatID: "applicant", Name: "赵六",
+			Source: datastore.RegistrationByText, Status: datastore.RegistrationPending}
+		store.EXPECT().CreateRegistration(gomock.Any(), datastore.Registration{WechatID: "applicant", Name: "赵六",
+			Source: datastore.RegistrationByText}).Return(registration, true, nil)
+
+		reply, _, err := pusher.Push(ctx, wechattest.NewTextMessage("applicant", "official", "注册 赵六"))
+		rq.NoError(err)
+		rq.Equal("已提交注册申请，请等待审批", reply.Content)
+
+		admin := func(method, path, body string) (int, []byte) {
+			req, err := http.NewRequest(method, server.URL+internalV1Group+"/registrations"+path, strings.NewReader(body))
+			rq.NoError(err)
+			req.Header.Set("x-alex-auth", src.DefaultApiToken)
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			defer func() { _ = resp.Body.Close() }()
+			raw, err := io.ReadAll(resp.Body)
+			rq.NoError(err)
+			return resp.StatusCode, raw
+		}
+
+		store.EXPECT().GetRegistrations(gomock.Any(), datastore.RegistrationPending, "").
+			Return([]datastore.Registration{registration}, nil)
+		code, raw := admin(http.MethodGet, "", "")
+		rq.Equal(http.StatusOK, code)
+		var registrations []datastore.Registration
+		rq.NoError(json.Unmarshal(raw, &registrations))
+		rq.Equal([]datastore.Registration{registration}, registrations)
+
+		rejected := registration
+		rejected.Status = datastore.RegistrationRejected
+		store.EXPECT().ReviewRegistration(gomock.Any(), 10, datastore.RegistrationRejected, "admin").Return(rejected, true, nil)
+		code, _ = admin(http.MethodPost, "/10/reject", `{"reviewer":"admin","reason":"非本单位人员"}`)
+		rq.Equal(http.StatusOK, code)
+
+		rq.Eventually(func() bool {
+			customs := fake.CustomMessages()
+			last := customs[len(customs)-1]
+			return last.ToUser == "applicant" && strings.Contains(last.Text.Content, "非本单位人员")
+		}, 5*time.Second, 10*time.Millisecond)
+
+		store.EXPECT().GetRegistration(gomock.Any(), 10).Return(rejected, true, nil)
+		code, _ = admin(http.MethodPost, "/10/approve", `{"reviewer":"admin"}`)
+		rq.Equal(http.StatusConflict, code)
+	})
+
+	t.Run("followers", func(t *testing.T) {
+		fake.Follow("user_1", "小张")
+		fake.Follow("stranger_x", "路人")
+		fake.Follow("newbie", "王五")
+		fake.SetFollowerPageSize(2)
+
+		// leader_1 never followed and is not touched
+		store.EXPECT().UpdateUserFollower(gomock.Any(), "user_1", "小张", true).Return(nil)
+		store.EXPECT().UpdateUserFollower(gomock.Any(), "newbie", "王五", true).Return(nil)
+
+		sync := func(method, path string) (int, wechat.SyncReport) {
+			req, err := http.NewRequest(method, server.URL+internalV1Group+"/followers"+path, nil)
+			rq.NoError(err)
+			req.Header.Set("x-alex-auth", src.DefaultApiToken)
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			defer func() { _ = resp.Body.Close() }()
+
+			var report wechat.SyncReport
+			rq.NoError(json.NewDecoder(resp.Body).Decode(&report))
+			return resp.StatusCode, report
+		}
+
+		code, report := sync(http.MethodPost, "/sync")
+		rq.Equal(http.StatusOK, code)
+		rq.Equal(3, report.Followers)
+		rq.Equal(2, report.Updated)
+		rq.Equal([]string{"leader_1"}, report.Unfollowed)
+		rq.Equal([]string{"stranger_x"}, report.Unregistered)
+
+		// nothing changed since
+		code, report = sync(http.MethodPost, "/sync")
+		rq.Equal(http.StatusOK, code)
+		rq.Equal(0, report.Updated)
+
+		code, report = sync(http.MethodGet, "/report")
+		rq.Equal(http.StatusOK, code)
+		rq.Equal(1, report.UnregisteredCount)
+	})
+
+	t.Run("callback ip", func(t *testing.T) {
+		verify := func(forwardedFor string) int {
+			target, err := pusher.SignedUrl(url.Values{"echostr": []string{"hello"}})
+			rq.NoError(err)
+			req, err := http.NewRequest(http.MethodGet, target, nil)
+			rq.NoError(err)
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/callback_ips/refresh", nil)
+		rq.NoError(err)
+		req.Header.Set("x-alex-auth", src.DefaultApiToken)
+		resp, err := http.DefaultClient.Do(req)
+		rq.NoError(err)
+		var status wechat.CallbackIPStatus
+		rq.NoError(json.NewDecoder(resp.Body).Decode(&status))
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+		rq.Equal([]string{"127.0.0.1/32", "101.226.103.0/25"}, status.Fetched)
+
+		// forwarded by the trusted proxy on 127.0.0.1
+		rq.Equal(http.StatusOK, verify("101.226.103.1"))
+		rq.Equal(http.StatusForbidden, verify("1.2.3.4"))
+
+		raw, err := os.ReadFile(cfg.Portal.CallbackIPFile)
+		rq.NoError(err)
+		rq.Contains(string(raw), "101.226.103.0/25")
+	})
+
+	t.Run("health", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/healthz")
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+
+		readyz := func() (int, wechat.Readiness) {
+			resp, err := http.Get(server.URL + "/readyz")
+			rq.NoError(err)
+			defer func() { _ = resp.Body.Close() }()
+			var ready wechat.Readiness
+			rq.NoError(json.NewDecoder(resp.Body).Decode(&ready))
+			return resp.StatusCode, ready
+		}
+
+		store.EXPECT().Ping(gomock.Any()).Return(nil)
+		code, ready := readyz()
+		rq.Equal(http.StatusOK, code)
+		rq.Equal("ok", ready.Status)
+		rq.Equal("ok", ready.Checks["access_token"].Status)
+		rq.Equal("ok", ready.Checks["users"].Status)
+
+		store.EXPECT().Ping(gomock.Any()).Return(errors.New("connection refused"))
+		code, ready = readyz()
+		rq.Equal(http.StatusServiceUnavailable, code)
+		rq.Equal("fail", ready.Checks["datastore"].Status)
+		rq.Contains(ready.Checks["datastore"].Error, "connection refused")
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/metrics")
+		rq.NoError(err)
+		_ = resp.Body.Close()
+		rq.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+		rq.NoError(err)
+		req.Header.Set("Authorization", "Bearer metrics_token")
+		resp, err = http.DefaultClient.Do(req)
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		rq.Equal(http.StatusOK, resp.StatusCode)
+		raw, err := io.ReadAll(resp.Body)
+		rq.NoError(err)
+
+		for _, series := range []string{
+			`wechat_messages_total{msg_type="image",outcome="duplicated"}`,
+			`wechat_messages_total{msg_type="image",outcome="deduplicated"}`,
+			`wechat_messages_total{msg_type="event",outcome="registration"}`,
+			`wechat_token_age_seconds{credential="access_token"}`,
+			`wechat_ums_cached_users`,
+		} {
+			rq.Contains(string(raw), series)
+		}
+	})
+
+	t.Run("not registered", func(t *testing.T) {
+		reply, _, err := pusher.Push(ctx, wechat.Message{FromUserName: "stranger", MsgType: "text"})
+		rq.NoError(err)
+		rq.Equal("当前用户并未注册，不能使用本服务", reply.Content)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		c.ApplyRuntime(src.RuntimeConfig{RateLimit: src.RateLimitConfig{Member: src.RateLimit{PerMinute: 1}}})
+		defer c.ApplyRuntime(cfg.Runtime)
+
+		reply, _, err := pusher.Push(ctx, wechat.Message{FromUserName: "newbie", MsgType: "text"})
+		rq.NoError(err)
+		rq.Equal("尚不支持当前消息类型", reply.Content)
+
+		reply, _, err = pusher.Push(ctx, wechat.Message{FromUserName: "newbie", MsgType: "text"})
+		rq.NoError(err)
+		rq.Equal("发送太频繁了，请稍后再试", reply.Content)
+
+		// newbie is registered under user_1, who is exempt as a leader
+		for i := 0; i < 3; i++ {
+			reply, _, err = pusher.Push(ctx, wechat.Message{FromUserName: "user_1", MsgType: "text"})
+			rq.NoError(err)
+			rq.Equal("尚不支持当前消息类型", reply.Content)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		c.ApplyRuntime(src.RuntimeConfig{Quota: src.QuotaConfig{User: 2}})
+		defer c.ApplyRuntime(cfg.Runtime)
+
+		msg := wechat.Message{FromUserName: "user_1", MsgType: "image", PicUrl: "https://mmbiz.qpic.cn/sz_mmbiz_jpg/md5_q/0"}
+		use := func(used int, err error) func(context.Context, *datastore.RecordInfo, string, datastore.CreateRecordOption) (bool, error) {
+			return func(_ context.Context, _ *datastore.RecordInfo, _ string, option datastore.CreateRecordOption) (bool, error) {
+				rq.Equal(1, len(option.Quotas()))
+				rq.Equal("user:user_1", option.Quotas()[0].Key)
+				option.Quotas()[0].Used = used
+				return false, err
+			}
+		}
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_q", gomock.Any()).DoAndReturn(use(1, nil))
+		reply, _, err := pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("成功，今天还可以提交0张", reply.Content)
+
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_q", gomock.Any()).
+			DoAndReturn(use(2, datastore.ErrQuotaExceeded))
+		reply, _, err = pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("今日提交已达上限（2张），请明天再来", reply.Content)
+	})
+
+	t.Run("dedup window", func(t *testing.T) {
+		rq.Error(c.CheckRuntime(src.RuntimeConfig{DedupWindowDays: -1}))
+		c.ApplyRuntime(src.RuntimeConfig{DedupWindowDays: 7})
+		defer c.ApplyRuntime(cfg.Runtime)
+
+		msg := wechat.Message{FromUserName: "user_1", MsgType: "image", PicUrl: "https://mmbiz.qpic.cn/sz_mmbiz_jpg/md5_w/0"}
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_w", gomock.Not(datastore.NewCreateRecordOption())).
+			Return(true, nil)
+		reply, _, err := pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("请勿重复上传", reply.Content)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		msg := wechat.Message{FromUserName: "user_1", MsgType: "image", PicUrl: "https://mmbiz.qpic.cn/sz_mmbiz_jpg/md5_d/0"}
+
+		var letter datastore.DeadLetter
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_d", gomock.Any()).Return(false, errors.New("deadlock found"))
+		store.EXPECT().CreateDeadLetter(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, created datastore.DeadLetter) (datastore.DeadLetter, error) {
+				letter = created
+				letter.ID, letter.Status, letter.CreateAt = 5, datastore.DeadLetterPending, time.Now()
+				return letter, nil
+			})
+		reply, _, err := pusher.Push(ctx, msg)
+		rq.NoError(err)
+		rq.Equal("图片暂时没有处理成功，稍后会自动重试并通知您结果", reply.Content)
+		rq.Equal("user_1", letter.WechatID)
+		rq.Contains(letter.Error, "deadlock found")
+		rq.NotEmpty(letter.TraceID)
+
+		retry := func() (int, datastore.DeadLetter) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+internalV1Group+"/dead_letters/5/retry", nil)
+			rq.NoError(err)
+			req.Header.Set("x-alex-auth", src.DefaultApiToken)
+			resp, err := http.DefaultClient.Do(req)
+			rq.NoError(err)
+			defer func() { _ = resp.Body.Close() }()
+			var retried datastore.DeadLetter
+			rq.NoError(json.NewDecoder(resp.Body).Decode(&retried))
+			return resp.StatusCode, retried
+		}
+
+		// another replica claimed it first
+		store.EXPECT().GetDeadLetter(gomock.Any(), 5).Return(letter, true, nil)
+		store.EXPECT().ClaimDeadLetter(gomock.Any(), 5, 0, gomock.Any()).Return(false, nil)
+		code, _ := retry()
+		rq.Equal(http.StatusConflict, code)
+
+		store.EXPECT().GetDeadLetter(gomock.Any(), 5).Return(letter, true, nil)
+		store.EXPECT().ClaimDeadLetter(gomock.Any(), 5, 0, gomock.Any()).Return(true, nil)
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_d", gomock.Any()).Return(false, nil)
+		store.EXPECT().UpdateDeadLetter(gomock.Any(), 5, []string{datastore.DeadLetterPending}, datastore.DeadLetterSucceeded, "").Return(true, nil)
+		code, retried := retry()
+		rq.Equal(http.StatusOK, code)
+		rq.Equal(datastore.DeadLetterSucceeded, retried.Status)
+		rq.Equal(1, retried.Attempts)
+
+		customs := fake.CustomMessages()
+		rq.Equal("user_1", customs[len(customs)-1].ToUser)
+		rq.Contains(customs[len(customs)-1].Text.Content, "已重新处理：成功")
+
+		// a url without md5 fails on every retry, it is not kept
+		reply, _, err = pusher.Push(ctx, wechat.Message{FromUserName: "user_1", MsgType: "image", PicUrl: "https://mmbiz.qpic.cn/no_md5"})
+		rq.NoError(err)
+		rq.Contains(reply.Content, "服务器出现故障，请联系管理员")
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		last := func() datastore.InboundMessage {
+			archiveMutex.Lock()
+			defer archiveMutex.Unlock()
+			return archived[len(archived)-1]
+		}
+
+		reply, _, err := pusher.Push(ctx, wechat.Message{FromUserName: "user_1", MsgType: "text", Content: "archive me"})
+		rq.NoError(err)
+		rq.Equal("尚不支持当前消息类型", reply.Content)
+
+		rq.Eventually(func() bool { return strings.Contains(last().Body, "archive me") }, 5*time.Second, 10*time.Millisecond)
+		msg := last()
+		rq.Equal("user_1", msg.WechatID)
+		rq.Equal("not_supported", msg.Outcome)
+		rq.Contains(msg.Reply, "尚不支持当前消息类型")
+		rq.Contains(msg.Headers, "Content-Type")
+
+		store.EXPECT().GetInboundMessage(gomock.Any(), msg.ID).Return(msg, true, nil)
+		req, err := http.NewRequest(http.MethodGet, server.URL+internalV1Group+"/archive/"+strconv.Itoa(msg.ID), nil)
+		rq.NoError(err)
+		req.Header.Set("x-alex-auth", src.DefaultApiToken)
+		resp, err := http.DefaultClient.Do(req)
+		rq.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		var got datastore.InboundMessage
+		rq.NoError(json.NewDecoder(resp.Body).Decode(&got))
+		rq.Equal(http.StatusOK, resp.StatusCode)
+		rq.Equal(msg.Body, got.Body)
+	})
+}
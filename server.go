@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newHttpServer(srvCfg src.ServerConfig, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              srvCfg.Addr,
+		ReadTimeout:       time.Duration(srvCfg.ReadTimeoutSeconds) * time.Second,
+		ReadHeaderTimeout: time.Duration(srvCfg.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(srvCfg.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(srvCfg.IdleTimeoutSeconds) * time.Second,
+		MaxHeaderBytes:    srvCfg.MaxHeaderBytes,
+	}
+
+	switch {
+	case srvCfg.TLS() && !srvCfg.HTTP2:
+		// net/http negotiates h2 over tls unless TLSNextProto is non-nil
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case !srvCfg.TLS() && srvCfg.HTTP2:
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: srv.IdleTimeout})
+	}
+	srv.Handler = handler
+	return srv
+}
+
+// serve runs srv on ln until ctx is done, then drains the in-flight requests and
+// calls closers in order, both within one shutdown timeout. The closers run even
+// if the drain fails, so that what they flush is not lost to a slow request, but
+// they are not waited for past the timeout.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, srvCfg src.ServerConfig, closers ...func()) error {
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("http server listening on %s, tls=%t, http2=%t", ln.Addr(), srvCfg.TLS(), srvCfg.HTTP2)
+		if srvCfg.TLS() {
+			errCh <- srv.ServeTLS(ln, srvCfg.TLSCertFile, srvCfg.TLSKeyFile)
+		} else {
+			errCh <- srv.Serve(ln)
+		}
+	}()
+
+	var serveErr error
+	select {
+	case err := <-errCh:
+		serveErr = fmt.Errorf("fail to serve http, %w", err)
+	case <-ctx.Done():
+	}
+
+	timeout := time.Duration(srvCfg.ShutdownTimeoutSeconds) * time.Second
+	logrus.Infof("shutting down http server, timeout=%s", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if serveErr == nil {
+		serveErr = drain(shutdownCtx, srv, errCh)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, closer := range closers {
+			closer()
+		}
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		return fmt.Errorf("fail to close resources in %s, %w", timeout, shutdownCtx.Err())
+	}
+	if serveErr != nil {
+		return serveErr
+	}
+	logrus.Info("http server shut down")
+	return nil
+}
+
+// drain waits for the in-flight requests till ctx is done, the ones left are cut off.
+func drain(ctx context.Context, srv *http.Server, errCh <-chan error) error {
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.Errorf("fail to drain in-flight requests, %s", err.Error())
+		_ = srv.Close()
+		return fmt.Errorf("fail to drain in-flight requests, %w", err)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("fail to serve http, %w", err)
+	}
+	return nil
+}
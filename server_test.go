@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	rq := require.New(t)
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte(r.Proto))
+	})
+
+	srvCfg := src.ServerConfig{
+		ReadTimeoutSeconds:     5,
+		WriteTimeoutSeconds:    5,
+		IdleTimeoutSeconds:     5,
+		HTTP2:                  true,
+		ShutdownTimeoutSeconds: 5,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	rq.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var closed []string
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newHttpServer(srvCfg, handler), ln, srvCfg,
+			func() { closed = append(closed, "coordinator") },
+			func() { closed = append(closed, "store") },
+		)
+	}()
+
+	// h2c with prior knowledge
+	client := http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	type result struct {
+		proto string
+		err   error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := client.Get("http://" + ln.Addr().String())
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		buf := make([]byte, 16)
+		n, _ := resp.Body.Read(buf)
+		resCh <- result{proto: string(buf[:n])}
+	}()
+
+	// shut down while the request is in flight
+	<-started
+	cancel()
+
+	res := <-resCh
+	rq.NoError(res.err)
+	rq.Equal("HTTP/2.0", res.proto)
+
+	rq.NoError(<-served)
+	rq.Equal([]string{"coordinator", "store"}, closed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	rq := require.New(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	srvCfg := src.ServerConfig{ShutdownTimeoutSeconds: 1}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	rq.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan string, 2)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newHttpServer(srvCfg, handler), ln, srvCfg,
+			func() {
+				time.Sleep(700 * time.Millisecond)
+				closed <- "coordinator"
+			},
+			func() { closed <- "store" },
+		)
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	// the request outlives the drain, the closers still run
+	<-started
+	start := time.Now()
+	cancel()
+
+	rq.Error(<-served)
+	rq.Less(time.Since(start), 1500*time.Millisecond, "the drain and the closers share the timeout")
+	rq.Equal("coordinator", <-closed)
+	rq.Equal("store", <-closed)
+}
@@ -1,58 +1,282 @@
 package src
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-
-	"github.com/sirupsen/logrus"
+	"os"
 )
 
 const (
 	defaultDatabase = "wechat"
 
-	defaultTokenFile = "/usr/app/token.json"
+	defaultTokenFile  = "/usr/app/token.json"
+	defaultTicketFile = "/usr/app/jsapi_ticket.json"
+
+	defaultApiBaseUrl        = "https://api.weixin.qq.com"
+	defaultOAuthAuthorizeUrl = "https://open.weixin.qq.com/connect/oauth2/authorize"
+
+	defaultNotifyMaxAttempts = 5
+
+	TokenStoreFile   = "file"
+	TokenStoreDB     = "db"
+	TokenStoreRemote = "remote"
+
+	defaultListenAddr      = ":8096"
+	defaultReadTimeout     = 30
+	defaultWriteTimeout    = 60
+	defaultIdleTimeout     = 120
+	defaultMaxHeaderBytes  = 1 << 20
+	defaultShutdownTimeout = 30
+
+	defaultReloadPoll = 10
+	defaultLogLevel   = "info"
+
+	defaultServiceName = "wechat"
+
+	defaultTimeZone = "Asia/Shanghai"
+
+	defaultWorkers            = 16
+	defaultQueueSize          = 64
+	defaultDeadline           = 4500
+	defaultDeadLetterAttempts = 5
+	defaultDeadLetterPoll     = 30
+	defaultDeadLetterBackoff  = 60
+	defaultArchiveRetention   = 30
+
+	// WechatTimeoutMillis is how long wechat waits for a reply before it retries
+	WechatTimeoutMillis = 5000
+
+	defaultMaxSkew         = 300
+	defaultNonceCacheSize  = 10000
+	defaultCallbackIPFile  = "/usr/app/callback_ip.json"
+	defaultCallbackIPHours = 24
 )
 
 type DbConfig struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password string `json:"password" secret:"true"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 }
 
 func (dbCfg DbConfig) Dns() string {
 	// "username:password@tcp(host:post)/dbname"
-	dns := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
 		dbCfg.Username, dbCfg.Password, dbCfg.Host, dbCfg.Port, defaultDatabase)
-	logrus.Infof("dns: %s", dns)
-	return dns
 }
 
 type Config struct {
 	DbConfig
-	Token         string `json:"token"`
-	AppID         string `json:"app_id"`
-	AppSecret     string `json:"app_secret"`
-	TokenFilePath string `json:"token_file_path"`
+	Token          string `json:"token" secret:"true"`
+	AppID          string `json:"app_id"`
+	AppSecret      string `json:"app_secret" secret:"true"`
+	TokenFilePath  string `json:"token_file_path"`
+	TicketFilePath string `json:"ticket_file_path"`
+	ApiBaseUrl     string `json:"api_base_url"`
+
+	// TokenStore is one of file, db or remote
+	TokenStore     string `json:"token_store"`
+	TokenServerUrl string `json:"token_server_url"`
+	// TokenServer exposes the token to other internal services
+	TokenServer bool `json:"token_server"`
+
+	// PublicBaseUrl is where wechat redirects the browser back, e.g. https://wx.example.com
+	PublicBaseUrl     string `json:"public_base_url"`
+	OAuthAuthorizeUrl string `json:"oauth_authorize_url"`
+	SessionSecret     string `json:"session_secret" secret:"true"`
+
+	// TimeZone is where the business day starts, e.g. of the daily quota, an IANA name
+	TimeZone string `json:"time_zone"`
+
+	Notify NotifyConfig `json:"notify"`
+	// FollowerSyncHours is the interval of syncing followers from wechat, 0 only syncs on demand
+	FollowerSyncHours int `json:"follower_sync_hours"`
+
+	Server   ServerConfig   `json:"server"`
+	Portal   PortalConfig   `json:"portal"`
+	Pipeline PipelineConfig `json:"pipeline"`
+
+	DeadLetter DeadLetterConfig `json:"dead_letter"`
+	Archive    ArchiveConfig    `json:"archive"`
+
+	// ReloadPollSeconds is how often the config file is checked for changes, see ConfigWatcher
+	ReloadPollSeconds int           `json:"reload_poll_seconds"`
+	Runtime           RuntimeConfig `json:"runtime"`
+
+	Tracing TracingConfig `json:"tracing"`
+	// MetricsToken is the bearer token to scrape /metrics with, not served without it
+	MetricsToken string `json:"metrics_token" secret:"true"`
 }
 
-func NewConfigFromFile(path string) (Config, error) {
-	var cfg Config
-	raw, err := ioutil.ReadFile(path)
-	if err != nil {
-		return cfg, fmt.Errorf("fail to read config file, %w", err)
-	}
-	logrus.Infof("config: %s", string(raw))
+// PipelineConfig bounds the messages processed at the same time, a spike is shed with
+// a quick reply rather than queued up to the retries of wechat.
+type PipelineConfig struct {
+	// Workers process the messages, each may hold a db connection
+	Workers int `json:"workers"`
+	// QueueSize is how many messages may wait for a worker
+	QueueSize int `json:"queue_size"`
+	// DeadlineMillis is the time a message may wait for a worker, below the 5s of wechat,
+	// one started is waited for till the 5s are about to run out
+	DeadlineMillis int `json:"deadline_millis"`
+}
+
+// DeadLetterConfig retries the messages failed to process in the background, the user is told
+// the outcome by a customer service message.
+type DeadLetterConfig struct {
+	// MaxAttempts is the retries before the message is given up
+	MaxAttempts int `json:"max_attempts"`
+	// PollSeconds is how often the letters due are looked for
+	PollSeconds int `json:"poll_seconds"`
+	// BackoffSeconds is the wait before the first retry, doubled after each
+	BackoffSeconds int `json:"backoff_seconds"`
+}
+
+// ArchiveConfig keeps the payloads pushed to the portal with their replies, to reproduce
+// what a user reports and to replay them by wechat-replay.
+type ArchiveConfig struct {
+	Enabled bool `json:"enabled"`
+	// RetentionDays is how long a payload is kept
+	RetentionDays int `json:"retention_days"`
+}
+
+// PortalConfig guards /wechat/portal against a captured signed url being replayed.
+type PortalConfig struct {
+	// MaxSkewSeconds is how far the timestamp of a request may be from now, in either direction
+	MaxSkewSeconds int `json:"max_skew_seconds"`
+	// NonceCacheSize bounds the nonces remembered within the skew window, the oldest are forgotten first
+	NonceCacheSize int `json:"nonce_cache_size"`
+
+	// IPAllowlist only accepts requests from the ips wechat returns by getcallbackip and AllowedCIDRs
+	IPAllowlist bool `json:"ip_allowlist"`
+	// AllowedCIDRs are accepted besides the wechat ips, e.g. 10.0.0.0/8 for a probe, an ip is taken as a /32
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	// CallbackIPRefreshHours is how often getcallbackip is fetched
+	CallbackIPRefreshHours int `json:"callback_ip_refresh_hours"`
+	// CallbackIPFile caches the fetched ips, a cold start accepts wechat before the first fetch
+	CallbackIPFile string `json:"callback_ip_file"`
+}
 
-	if err := json.NewDecoder(bytes.NewBuffer(raw)).Decode(&cfg); err != nil {
-		return cfg, fmt.Errorf("fail to decode config file, %w", err)
+// TracingConfig exports the spans, the trace id is still logged and replied if Exporter is empty.
+type TracingConfig struct {
+	// Exporter is otlp or file
+	Exporter string `json:"exporter"`
+	// OtlpEndpoint is the base url of an OTLP/HTTP collector, spans are posted as json to /v1/traces
+	OtlpEndpoint string `json:"otlp_endpoint"`
+	// FilePath gets a json line per span
+	FilePath    string `json:"file_path"`
+	ServiceName string `json:"service_name"`
+}
+
+// RuntimeConfig is what a reload applies without restart,
+// a change anywhere else in the config is rejected.
+type RuntimeConfig struct {
+	// LogLevel is a logrus level, e.g. debug, info or warn
+	LogLevel string `json:"log_level"`
+	// Replies overrides the reply texts by key, e.g. {"duplicated": "这张图片已经上传过了"}
+	Replies map[string]string `json:"replies"`
+	// RateLimit throttles the messages of the registered users before they are processed
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Quota caps the records submitted a day
+	Quota QuotaConfig `json:"quota"`
+	// DedupWindowDays is how long a picture is a duplicate of the record it first came with,
+	// zero is forever
+	DedupWindowDays int `json:"dedup_window_days"`
+}
+
+// QuotaConfig caps the records submitted in a business day, duplicates are not counted.
+// A zero cap is unlimited, an override of zero exempts the user or the team.
+type QuotaConfig struct {
+	// Global is of all the users together
+	Global int `json:"global"`
+	// Team is of a leader and the members together
+	Team int `json:"team"`
+	User int `json:"user"`
+	// Teams and Users override Team and User by the wechat id of the leader or the user
+	Teams map[string]int `json:"teams"`
+	Users map[string]int `json:"users"`
+}
+
+// RateLimit is a token bucket of PerMinute messages, Burst is the size of the bucket and defaults
+// to PerMinute. A zero PerMinute is unlimited.
+type RateLimit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// RateLimitConfig limits each user by the role, a role without limit, e.g. leader, is exempt
+// from the global limit as well.
+type RateLimitConfig struct {
+	// Global is shared by the users of the roles limited, it keeps a flood of all of them off the db
+	Global RateLimit `json:"global"`
+	Member RateLimit `json:"member"`
+	Leader RateLimit `json:"leader"`
+}
+
+// ServerConfig is the http server of the portal, timeouts are in seconds.
+type ServerConfig struct {
+	Addr                string `json:"addr"`
+	ReadTimeoutSeconds  int    `json:"read_timeout_seconds"`
+	WriteTimeoutSeconds int    `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds  int    `json:"idle_timeout_seconds"`
+	MaxHeaderBytes      int    `json:"max_header_bytes"`
+
+	// TLS is served when both files are set
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// HTTP2 is negotiated by ALPN over TLS, or served as h2c over plain text
+	HTTP2 bool `json:"http2"`
+
+	// TrustedProxies may set X-Forwarded-For, e.g. the nginx in front, ips or cidrs.
+	// None is trusted if empty, the client ip is then the peer of the connection.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// ShutdownTimeoutSeconds bounds draining in-flight requests and closing the resources on SIGTERM
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+}
+
+func (srvCfg ServerConfig) TLS() bool {
+	return srvCfg.TLSCertFile != "" && srvCfg.TLSKeyFile != ""
+}
+
+func (srvCfg *ServerConfig) setDefaults() {
+	if srvCfg.Addr == "" {
+		srvCfg.Addr = defaultListenAddr
+	}
+	if srvCfg.ReadTimeoutSeconds <= 0 {
+		srvCfg.ReadTimeoutSeconds = defaultReadTimeout
+	}
+	if srvCfg.WriteTimeoutSeconds <= 0 {
+		srvCfg.WriteTimeoutSeconds = defaultWriteTimeout
+	}
+	if srvCfg.IdleTimeoutSeconds <= 0 {
+		srvCfg.IdleTimeoutSeconds = defaultIdleTimeout
+	}
+	if srvCfg.MaxHeaderBytes <= 0 {
+		srvCfg.MaxHeaderBytes = defaultMaxHeaderBytes
 	}
-	if cfg.TokenFilePath == "" {
-		cfg.TokenFilePath = defaultTokenFile
+	if srvCfg.ShutdownTimeoutSeconds <= 0 {
+		srvCfg.ShutdownTimeoutSeconds = defaultShutdownTimeout
 	}
-	return cfg, err
+}
+
+// NotifyTemplate maps a notification to a wechat template message, a template without id is not sent.
+// Url and data values are text/template rendered with the notification, e.g. {"keyword1": "{{.Owner.Name}}"}.
+type NotifyTemplate struct {
+	TemplateID string            `json:"template_id"`
+	Url        string            `json:"url"`
+	Data       map[string]string `json:"data"`
+}
+
+type NotifyConfig struct {
+	// Review is sent to the leader when a record is waiting for confirm
+	Review NotifyTemplate `json:"review"`
+	// Result is sent to the submitter when the record is confirmed or denied
+	Result      NotifyTemplate `json:"result"`
+	MaxAttempts int            `json:"max_attempts"`
+}
+
+// NewConfigFromFile loads the config file overridden by the environment variables.
+func NewConfigFromFile(path string) (Config, error) {
+	return LoadConfig(path, os.LookupEnv, nil)
 }
 
 const DefaultApiToken = "hanzezhentest"
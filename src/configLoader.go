@@ -0,0 +1,448 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix prefixes the environment variables of the config, e.g. WECHAT_APP_ID, WECHAT_SERVER_ADDR
+	EnvPrefix = "WECHAT_"
+	// secretFileSuffix reads the value of a secret from a file, e.g. WECHAT_APP_SECRET_FILE or -app_secret_file
+	secretFileSuffix = "_FILE"
+
+	redacted = "******"
+)
+
+// configField is a string, int, bool or string list leaf of Config, the path is made of the json names.
+// A list is comma separated in the environment variables and the flags.
+// Fields of the embedded DbConfig are at the top level, as they are in the json file.
+type configField struct {
+	path   []string
+	secret bool
+	value  reflect.Value
+}
+
+func (f configField) name() string {
+	return strings.Join(f.path, ".")
+}
+
+func (f configField) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+func (f configField) set(raw string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s is not an integer, %w", f.name(), err)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s is not a bool, %w", f.name(), err)
+		}
+		f.value.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// configFields walks cfg, which must be addressable, maps like the notify data are left to the file.
+func configFields(cfg reflect.Value, prefix []string, fields []configField) []configField {
+	t := cfg.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		value := cfg.Field(i)
+		if sf.Anonymous && value.Kind() == reflect.Struct {
+			fields = configFields(value, prefix, fields)
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := append(append([]string(nil), prefix...), name)
+
+		switch value.Kind() {
+		case reflect.Struct:
+			fields = configFields(value, path, fields)
+		case reflect.String, reflect.Int, reflect.Bool:
+			fields = append(fields, configField{path: path, secret: sf.Tag.Get("secret") == "true", value: value})
+		case reflect.Slice:
+			if value.Type().Elem().Kind() == reflect.String {
+				fields = append(fields, configField{path: path, value: value})
+			}
+		}
+	}
+	return fields
+}
+
+// ConfigFlags holds the config flags set on the command line, by field name.
+type ConfigFlags map[string]string
+
+// RegisterConfigFlags adds a flag for every config field, e.g. -app_id or -server.addr.
+// Secrets only take a file, e.g. -app_secret_file, so that they do not show in ps.
+func RegisterConfigFlags(fs *flag.FlagSet) ConfigFlags {
+	flags := make(ConfigFlags)
+	for _, field := range configFields(reflect.ValueOf(&Config{}).Elem(), nil, nil) {
+		name := field.name()
+		if field.secret {
+			fs.Func(name+strings.ToLower(secretFileSuffix), "file containing "+name, func(path string) error {
+				raw, err := readSecretFile(path)
+				if err != nil {
+					return err
+				}
+				flags[name] = raw
+				return nil
+			})
+			continue
+		}
+		fs.Func(name, "override "+name, func(raw string) error {
+			flags[name] = raw
+			return nil
+		})
+	}
+	return flags
+}
+
+// LoadConfig layers the config sources, a later one overrides the earlier:
+// the file (json, yaml or toml by its extension, skipped if path is empty),
+// the environment variables, then the flags. Defaults fill what is left and
+// the result is validated.
+func LoadConfig(path string, lookupEnv func(string) (string, bool), flags ConfigFlags) (Config, error) {
+	var cfg Config
+	if path != "" {
+		if err := decodeConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	fields := configFields(reflect.ValueOf(&cfg).Elem(), nil, nil)
+	for _, field := range fields {
+		raw, ok, err := lookupConfigEnv(field, lookupEnv)
+		if err != nil {
+			return cfg, err
+		}
+		if ok {
+			if err := field.set(raw); err != nil {
+				return cfg, fmt.Errorf("invalid %s, %w", field.envName(), err)
+			}
+		}
+	}
+	for _, field := range fields {
+		if raw, ok := flags[field.name()]; ok {
+			if err := field.set(raw); err != nil {
+				return cfg, fmt.Errorf("invalid flag -%s, %w", field.name(), err)
+			}
+		}
+	}
+
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	logrus.Infof("config: %s", cfg.Redacted())
+	return cfg, nil
+}
+
+func lookupConfigEnv(field configField, lookupEnv func(string) (string, bool)) (string, bool, error) {
+	raw, ok := lookupEnv(field.envName())
+	if !field.secret {
+		return raw, ok, nil
+	}
+
+	path, fromFile := lookupEnv(field.envName() + secretFileSuffix)
+	switch {
+	case fromFile && ok:
+		return "", false, fmt.Errorf("%s and %s are both set", field.envName(), field.envName()+secretFileSuffix)
+	case fromFile:
+		raw, err := readSecretFile(path)
+		return raw, err == nil, err
+	}
+	return raw, ok, nil
+}
+
+// readSecretFile trims the trailing newline which editors and echo leave.
+func readSecretFile(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("fail to read secret file, %w", err)
+	}
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+// decodeConfigFile decodes yaml and toml into a generic map first and goes through json,
+// so that the json tags are the only names of the fields.
+func decodeConfigFile(path string, cfg *Config) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("fail to read config file, %w", err)
+	}
+
+	var generic map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &generic); err != nil {
+			return fmt.Errorf("fail to decode yaml config file, %w", err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(raw, &generic); err != nil {
+			return fmt.Errorf("fail to decode toml config file, %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file %s, expect .json, .yaml, .yml or .toml", path)
+	}
+	if generic != nil {
+		if raw, err = json.Marshal(generic); err != nil {
+			return fmt.Errorf("fail to convert config file, %w", err)
+		}
+	}
+
+	if err := json.NewDecoder(bytes.NewBuffer(raw)).Decode(cfg); err != nil {
+		return fmt.Errorf("fail to decode config file, %w", err)
+	}
+	return nil
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.TokenFilePath == "" {
+		cfg.TokenFilePath = defaultTokenFile
+	}
+	if cfg.TicketFilePath == "" {
+		cfg.TicketFilePath = defaultTicketFile
+	}
+	if cfg.ApiBaseUrl == "" {
+		cfg.ApiBaseUrl = defaultApiBaseUrl
+	}
+	if cfg.OAuthAuthorizeUrl == "" {
+		cfg.OAuthAuthorizeUrl = defaultOAuthAuthorizeUrl
+	}
+	if cfg.Notify.MaxAttempts <= 0 {
+		cfg.Notify.MaxAttempts = defaultNotifyMaxAttempts
+	}
+	cfg.Server.setDefaults()
+	if cfg.Portal.MaxSkewSeconds <= 0 {
+		cfg.Portal.MaxSkewSeconds = defaultMaxSkew
+	}
+	if cfg.Portal.NonceCacheSize <= 0 {
+		cfg.Portal.NonceCacheSize = defaultNonceCacheSize
+	}
+	if cfg.Portal.CallbackIPRefreshHours <= 0 {
+		cfg.Portal.CallbackIPRefreshHours = defaultCallbackIPHours
+	}
+	if cfg.Portal.CallbackIPFile == "" {
+		cfg.Portal.CallbackIPFile = defaultCallbackIPFile
+	}
+	if cfg.ReloadPollSeconds <= 0 {
+		cfg.ReloadPollSeconds = defaultReloadPoll
+	}
+	if cfg.Runtime.LogLevel == "" {
+		cfg.Runtime.LogLevel = defaultLogLevel
+	}
+	if cfg.Pipeline.Workers <= 0 {
+		cfg.Pipeline.Workers = defaultWorkers
+	}
+	if cfg.Pipeline.QueueSize <= 0 {
+		cfg.Pipeline.QueueSize = defaultQueueSize
+	}
+	if cfg.Pipeline.DeadlineMillis <= 0 {
+		cfg.Pipeline.DeadlineMillis = defaultDeadline
+	}
+	if cfg.DeadLetter.MaxAttempts <= 0 {
+		cfg.DeadLetter.MaxAttempts = defaultDeadLetterAttempts
+	}
+	if cfg.DeadLetter.PollSeconds <= 0 {
+		cfg.DeadLetter.PollSeconds = defaultDeadLetterPoll
+	}
+	if cfg.DeadLetter.BackoffSeconds <= 0 {
+		cfg.DeadLetter.BackoffSeconds = defaultDeadLetterBackoff
+	}
+	if cfg.Archive.RetentionDays <= 0 {
+		cfg.Archive.RetentionDays = defaultArchiveRetention
+	}
+	if cfg.TimeZone == "" {
+		cfg.TimeZone = defaultTimeZone
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = defaultServiceName
+	}
+}
+
+// Validate reports all the problems at once, a deploy should not take several rounds to fix.
+func (cfg Config) Validate() error {
+	var problems []string
+	required := func(name, value string) {
+		if value == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+	absUrl := func(name, value string) {
+		if value == "" {
+			return
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s %q is not an absolute http url", name, value))
+		}
+	}
+
+	required("token", cfg.Token)
+	required("app_id", cfg.AppID)
+	// consumers of a remote token store never talk to wechat with the secret
+	if cfg.TokenStore != TokenStoreRemote {
+		required("app_secret", cfg.AppSecret)
+	}
+	// the oauth and the h5 pages are always served, a session key derived from nothing is public
+	required("session_secret", cfg.SessionSecret)
+	required("host", cfg.Host)
+	required("username", cfg.Username)
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", cfg.Port))
+	}
+
+	switch cfg.TokenStore {
+	case "", TokenStoreFile, TokenStoreDB:
+	case TokenStoreRemote:
+		required("token_server_url", cfg.TokenServerUrl)
+	default:
+		problems = append(problems, fmt.Sprintf("token_store %q is not one of file, db or remote", cfg.TokenStore))
+	}
+	absUrl("api_base_url", cfg.ApiBaseUrl)
+	absUrl("token_server_url", cfg.TokenServerUrl)
+	absUrl("public_base_url", cfg.PublicBaseUrl)
+	absUrl("oauth_authorize_url", cfg.OAuthAuthorizeUrl)
+
+	if cfg.FollowerSyncHours < 0 {
+		problems = append(problems, "follower_sync_hours must not be negative")
+	}
+	if (cfg.Server.TLSCertFile == "") != (cfg.Server.TLSKeyFile == "") {
+		problems = append(problems, "server.tls_cert_file and server.tls_key_file must be set together")
+	}
+	switch cfg.Tracing.Exporter {
+	case "":
+	case ExporterOtlp:
+		required("tracing.otlp_endpoint", cfg.Tracing.OtlpEndpoint)
+		absUrl("tracing.otlp_endpoint", cfg.Tracing.OtlpEndpoint)
+	case ExporterFile:
+		required("tracing.file_path", cfg.Tracing.FilePath)
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter %q is not one of otlp or file", cfg.Tracing.Exporter))
+	}
+	cidrs := func(name string, values []string) {
+		for _, value := range values {
+			if _, err := ParseCIDR(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %q is not an ip or cidr", name, value))
+			}
+		}
+	}
+	cidrs("server.trusted_proxies", cfg.Server.TrustedProxies)
+	cidrs("portal.allowed_cidrs", cfg.Portal.AllowedCIDRs)
+	rateLimit := func(name string, limit RateLimit) {
+		if limit.PerMinute < 0 || limit.Burst < 0 {
+			problems = append(problems, fmt.Sprintf("runtime.rate_limit.%s must not be negative", name))
+		}
+	}
+	rateLimit("global", cfg.Runtime.RateLimit.Global)
+	rateLimit("member", cfg.Runtime.RateLimit.Member)
+	rateLimit("leader", cfg.Runtime.RateLimit.Leader)
+	if cfg.Pipeline.DeadlineMillis >= WechatTimeoutMillis {
+		problems = append(problems, fmt.Sprintf("pipeline.deadline_millis %d must be below %d, wechat retries then",
+			cfg.Pipeline.DeadlineMillis, WechatTimeoutMillis))
+	}
+	quota := cfg.Runtime.Quota
+	negative := quota.Global < 0 || quota.Team < 0 || quota.User < 0
+	for _, overrides := range []map[string]int{quota.Teams, quota.Users} {
+		for _, n := range overrides {
+			negative = negative || n < 0
+		}
+	}
+	if negative {
+		problems = append(problems, "runtime.quota must not be negative")
+	}
+	if cfg.Runtime.DedupWindowDays < 0 {
+		problems = append(problems, "runtime.dedup_window_days must not be negative")
+	}
+	if _, err := time.LoadLocation(cfg.TimeZone); err != nil {
+		problems = append(problems, fmt.Sprintf("time_zone %q is unknown", cfg.TimeZone))
+	}
+	if _, err := logrus.ParseLevel(cfg.Runtime.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("runtime.log_level %q is not a log level", cfg.Runtime.LogLevel))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config, %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ParseCIDR also takes a plain ip as the network of itself.
+func ParseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", value)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %s, %w", value, err)
+	}
+	return network, nil
+}
+
+// Redacted dumps the config as json with the secrets masked.
+func (cfg Config) Redacted() string {
+	for _, field := range configFields(reflect.ValueOf(&cfg).Elem(), nil, nil) {
+		if field.secret && field.value.String() != "" {
+			field.value.SetString(redacted)
+		}
+	}
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Sprintf("fail to dump config, %s", err.Error())
+	}
+	return string(raw)
+}
+
+// ParseTime takes an RFC3339 time, the fallback if value is empty, e.g. a query not given.
+func ParseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,268 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const runtimeSection = "runtime"
+
+var errRestartRequired = errors.New("restart required")
+
+var watcherTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "config_watcher").WithContext(ctx)
+}
+
+type runtimeHook struct {
+	check func(RuntimeConfig) error
+	apply func(RuntimeConfig)
+}
+
+// ConfigStatus is the effective config, the version counts the applied reloads.
+type ConfigStatus struct {
+	Version      int       `json:"version"`
+	Digest       string    `json:"digest"`
+	LoadedAt     time.Time `json:"loaded_at"`
+	Path         string    `json:"path"`
+	LastReloadAt time.Time `json:"last_reload_at"`
+	LastError    string    `json:"last_error,omitempty"`
+	Config       string    `json:"config"` // redacted
+}
+
+// ConfigWatcher reloads the config when the file changes, on SIGHUP, or by the endpoint.
+// Only the runtime section is applied, environment variables and flags keep overriding the file.
+type ConfigWatcher struct {
+	path      string
+	lookupEnv func(string) (string, bool)
+	flags     ConfigFlags
+
+	reloading sync.Mutex // one reload at a time
+	mutex     sync.RWMutex
+	current   Config
+	status    ConfigStatus
+	modTime   time.Time
+	hooks     []runtimeHook
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewConfigWatcher takes the config loaded at startup by the same sources.
+func NewConfigWatcher(path string, lookupEnv func(string) (string, bool), flags ConfigFlags, cfg Config) *ConfigWatcher {
+	w := &ConfigWatcher{
+		path:      path,
+		lookupEnv: lookupEnv,
+		flags:     flags,
+		current:   cfg,
+		status: ConfigStatus{
+			Version:  1,
+			Digest:   digest(cfg),
+			LoadedAt: time.Now(),
+			Path:     path,
+			Config:   cfg.Redacted(),
+		},
+		done: make(chan struct{}),
+	}
+	w.modTime, _ = w.stat()
+	return w
+}
+
+// OnReload registers a hook of the runtime config, check is optional. All the checks pass
+// before any apply is called, so that a reload is applied as a whole or not at all.
+func (w *ConfigWatcher) OnReload(check func(RuntimeConfig) error, apply func(RuntimeConfig)) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.hooks = append(w.hooks, runtimeHook{check: check, apply: apply})
+}
+
+// Start polls the modification time of the file, a signal on trigger reloads at once.
+func (w *ConfigWatcher) Start(interval time.Duration, trigger <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-trigger:
+				watcherTracer(ctx).Infof("%s received, reloading config", sig)
+				_ = w.Reload(ctx)
+			case <-ticker.C:
+				modTime, err := w.stat()
+				if err != nil || !modTime.After(w.modTime) {
+					continue
+				}
+				watcherTracer(ctx).Infof("config file %s changed, reloading", w.path)
+				_ = w.Reload(ctx)
+			}
+		}
+	}()
+}
+
+// Stop waits for the reload in flight.
+func (w *ConfigWatcher) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	<-w.done
+}
+
+func (w *ConfigWatcher) stat() (time.Time, error) {
+	if w.path == "" {
+		return time.Time{}, fmt.Errorf("no config file")
+	}
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Reload loads the config again from the same sources. It is rejected when anything but
+// the runtime section changed, or a hook fails the check. The error is kept in the status.
+func (w *ConfigWatcher) Reload(ctx context.Context) error {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	tracer := watcherTracer(ctx)
+
+	// taken before loading, a write in between is picked up by the next poll
+	modTime, _ := w.stat()
+	err := w.reload(modTime)
+
+	w.mutex.Lock()
+	w.modTime = modTime
+	w.status.LastReloadAt = time.Now()
+	w.status.LastError = ""
+	if err != nil {
+		w.status.LastError = err.Error()
+	}
+	version := w.status.Version
+	w.mutex.Unlock()
+
+	if err != nil {
+		tracer.Errorf("config reload rejected, the effective version is still %d, %s", version, err.Error())
+		return err
+	}
+	tracer.Infof("config reloaded, version=%d", version)
+	return nil
+}
+
+func (w *ConfigWatcher) reload(modTime time.Time) error {
+	cfg, err := LoadConfig(w.path, w.lookupEnv, w.flags)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.RLock()
+	current, hooks := w.current, w.hooks
+	w.mutex.RUnlock()
+
+	if changed := changedFields(reflect.ValueOf(current), reflect.ValueOf(cfg), nil, nil); len(changed) > 0 {
+		return fmt.Errorf("%w to change %s, only %s is reloadable",
+			errRestartRequired, strings.Join(changed, ", "), runtimeSection)
+	}
+	if reflect.DeepEqual(current.Runtime, cfg.Runtime) {
+		return nil
+	}
+	for _, hook := range hooks {
+		if hook.check == nil {
+			continue
+		}
+		if err := hook.check(cfg.Runtime); err != nil {
+			return err
+		}
+	}
+	for _, hook := range hooks {
+		hook.apply(cfg.Runtime)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.current = cfg
+	w.status.Version++
+	w.status.Digest = digest(cfg)
+	w.status.LoadedAt = time.Now()
+	w.status.Config = cfg.Redacted()
+	return nil
+}
+
+// Current returns the effective config.
+func (w *ConfigWatcher) Current() Config {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.current
+}
+
+func (w *ConfigWatcher) Status() ConfigStatus {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.status
+}
+
+// changedFields lists the json names of the fields which differ out of the runtime section.
+func changedFields(old, new reflect.Value, prefix []string, changed []string) []string {
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			changed = changedFields(old.Field(i), new.Field(i), prefix, changed)
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || (len(prefix) == 0 && name == runtimeSection) {
+			continue
+		}
+		path := append(append([]string(nil), prefix...), name)
+
+		if sf.Type.Kind() == reflect.Struct {
+			changed = changedFields(old.Field(i), new.Field(i), path, changed)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changed = append(changed, strings.Join(path, "."))
+		}
+	}
+	return changed
+}
+
+func digest(cfg Config) string {
+	sum := sha256.Sum256([]byte(cfg.Redacted()))
+	return hex.EncodeToString(sum[:6])
+}
+
+func (w *ConfigWatcher) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("", func(context *gin.Context) {
+		context.JSON(http.StatusOK, w.Status())
+	})
+
+	group.POST("/reload", func(context *gin.Context) {
+		err := w.Reload(context.Request.Context())
+		switch {
+		case errors.Is(err, errRestartRequired):
+			context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			context.JSON(http.StatusOK, w.Status())
+		}
+	})
+}
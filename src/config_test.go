@@ -0,0 +1,155 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	rq := require.New(t)
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		rq.NoError(ioutil.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(key string) (string, bool) {
+			v, ok := vars[key]
+			return v, ok
+		}
+	}
+
+	files := map[string]string{
+		"config.json": `{"token":"t","app_id":"file_app","host":"db","port":3306,"username":"u","server":{"addr":":9000"}}`,
+		"config.yaml": "token: t\napp_id: file_app\nhost: db\nport: 3306\nusername: u\nserver:\n  addr: \":9000\"\n",
+		"config.toml": "token = \"t\"\napp_id = \"file_app\"\nhost = \"db\"\nport = 3306\nusername = \"u\"\n[server]\naddr = \":9000\"\n",
+	}
+	secret := write("app_secret", "s3cret\n")
+
+	for name, content := range files {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterConfigFlags(fs)
+		rq.NoError(fs.Parse([]string{"-server.addr", ":9100", "-password_file", secret}))
+
+		cfg, err := LoadConfig(write(name, content), env(map[string]string{
+			"WECHAT_APP_ID":                 "env_app",
+			"WECHAT_APP_SECRET_FILE":        secret,
+			"WECHAT_SESSION_SECRET_FILE":    secret,
+			"WECHAT_SERVER_HTTP2":           "true",
+			"WECHAT_NOTIFY_MAX_ATTEMPTS":    "2",
+			"WECHAT_SERVER_TRUSTED_PROXIES": "10.0.0.1, 172.16.0.0/12",
+		}), flags)
+		rq.NoError(err, name)
+
+		rq.Equal("env_app", cfg.AppID, name)
+		rq.Equal("s3cret", cfg.AppSecret, name)
+		rq.Equal("s3cret", cfg.Password, name)
+		rq.Equal(":9100", cfg.Server.Addr, name)
+		rq.True(cfg.Server.HTTP2, name)
+		rq.Equal(2, cfg.Notify.MaxAttempts, name)
+		rq.Equal([]string{"10.0.0.1", "172.16.0.0/12"}, cfg.Server.TrustedProxies, name)
+		rq.Equal(3306, cfg.Port, name)
+		rq.Equal(defaultApiBaseUrl, cfg.ApiBaseUrl, name)
+
+		dump := cfg.Redacted()
+		rq.NotContains(dump, "s3cret", name)
+		rq.Contains(dump, `"app_secret":"******"`, name)
+		rq.Equal("s3cret", cfg.AppSecret, "redacting works on a copy")
+	}
+
+	_, err := LoadConfig(write("bad.json", `{"port":70000,"token_store":"redis","api_base_url":"weixin",`+
+		`"portal":{"allowed_cidrs":["10.0.0.0/33"]}}`), env(nil), nil)
+	rq.Error(err)
+	for _, problem := range []string{"token is required", "app_secret is required", "session_secret is required", "port 70000",
+		`token_store "redis"`, `api_base_url "weixin"`, `portal.allowed_cidrs "10.0.0.0/33"`} {
+		rq.True(strings.Contains(err.Error(), problem), "%s not in %s", problem, err.Error())
+	}
+
+	_, err = LoadConfig("", env(map[string]string{"WECHAT_PORT": "abc"}), nil)
+	rq.ErrorContains(err, "WECHAT_PORT")
+
+	_, err = LoadConfig("", env(map[string]string{"WECHAT_TOKEN": "t", "WECHAT_TOKEN_FILE": secret}), nil)
+	rq.ErrorContains(err, "both set")
+
+	_, err = LoadConfig(write("config.ini", ""), env(nil), nil)
+	rq.ErrorContains(err, "unsupported config file")
+}
+
+func TestConfigWatcher(t *testing.T) {
+	rq := require.New(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(appID, logLevel string) {
+		content := "token: t\napp_id: " + appID + "\napp_secret: s\nsession_secret: s\nhost: db\nport: 3306\nusername: u\n" +
+			"runtime:\n  log_level: " + logLevel + "\n  replies:\n    duplicated: 重复了\n"
+		rq.NoError(ioutil.WriteFile(path, []byte(content), 0600))
+	}
+	noEnv := func(string) (string, bool) { return "", false }
+
+	write("app", "info")
+	cfg, err := LoadConfig(path, noEnv, nil)
+	rq.NoError(err)
+	rq.Equal(map[string]string{"duplicated": "重复了"}, cfg.Runtime.Replies)
+
+	w := NewConfigWatcher(path, noEnv, nil, cfg)
+	var applied []RuntimeConfig
+	var rejectWarn bool
+	w.OnReload(func(rt RuntimeConfig) error {
+		if rejectWarn && rt.LogLevel == "warn" {
+			return errors.New("warn is not allowed")
+		}
+		return nil
+	}, func(rt RuntimeConfig) {
+		applied = append(applied, rt)
+	})
+	ctx := context.Background()
+
+	// nothing changed
+	rq.NoError(w.Reload(ctx))
+	rq.Empty(applied)
+	rq.Equal(1, w.Status().Version)
+
+	write("app", "debug")
+	rq.NoError(w.Reload(ctx))
+	rq.Len(applied, 1)
+	rq.Equal("debug", w.Current().Runtime.LogLevel)
+	rq.Equal(2, w.Status().Version)
+
+	// app_id needs a restart, nothing is applied
+	write("another_app", "warn")
+	err = w.Reload(ctx)
+	rq.ErrorIs(err, errRestartRequired)
+	rq.Contains(err.Error(), "app_id")
+	rq.Len(applied, 1)
+	rq.Equal(2, w.Status().Version)
+	rq.Equal(err.Error(), w.Status().LastError)
+
+	rejectWarn = true
+	write("app", "warn")
+	rq.Error(w.Reload(ctx))
+	rq.Equal("debug", w.Current().Runtime.LogLevel)
+
+	write("app", "loud")
+	rq.ErrorContains(w.Reload(ctx), "runtime.log_level")
+
+	// polling picks up the change
+	rejectWarn = false
+	w.Start(10*time.Millisecond, nil)
+	defer w.Stop()
+	write("app", "error")
+	later := time.Now().Add(time.Minute)
+	rq.NoError(os.Chtimes(path, later, later))
+	rq.Eventually(func() bool { return w.Status().Version == 3 }, 5*time.Second, 10*time.Millisecond)
+	rq.Empty(w.Status().LastError)
+	rq.Equal("error", w.Current().Runtime.LogLevel)
+}
@@ -2,13 +2,15 @@ package datastore
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -18,10 +20,41 @@ type DataStore interface {
 	CreateNewUser(ctx context.Context, user UserInfo) error
 	GetAllUsers(ctx context.Context) ([]UserInfo, error)
 	GetUserById(ctx context.Context, id string) (UserInfo, bool, error)
+	UpdateUserNotify(ctx context.Context, id string, mute bool) error
+	UpdateUserFollower(ctx context.Context, id string, nickname string, subscribed bool) error
 
-	CreateRecord(ctx context.Context, record RecordInfo, md5 string, checkExist bool) (existed bool, err error)
+	CreateRecord(ctx context.Context, record *RecordInfo, md5 string, option CreateRecordOption) (existed bool, err error)
+	GetRecords(ctx context.Context, option RecordQueryOption) ([]RecordInfo, error)
+	CountRecords(ctx context.Context, option RecordQueryOption) (int64, error)
+	GetRecordsByIds(ctx context.Context, ids []int) ([]RecordInfo, error)
+	ReviewRecord(ctx context.Context, id int, status string, reviewer string, reason string) (RecordInfo, bool, error)
 
 	GetAllHashes(ctx context.Context, option HashQueryOption) ([]Hash, error)
+	HashExists(ctx context.Context, md5 string) (bool, error)
+
+	CreateRegistration(ctx context.Context, registration Registration) (Registration, bool, error)
+	GetRegistration(ctx context.Context, id int) (Registration, bool, error)
+	GetPendingRegistration(ctx context.Context, wechatID string) (Registration, bool, error)
+	GetRegistrations(ctx context.Context, status string, leaderID string) ([]Registration, error)
+	ReviewRegistration(ctx context.Context, id int, status string, reviewer string) (Registration, bool, error)
+
+	GetToken(ctx context.Context, name string) (AccessToken, bool, error)
+	SaveToken(ctx context.Context, token AccessToken) error
+	AcquireTokenLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error)
+
+	CreateDeadLetter(ctx context.Context, letter DeadLetter) (DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int) (DeadLetter, bool, error)
+	GetDeadLetters(ctx context.Context, status string, limit int) ([]DeadLetter, error)
+	GetDueDeadLetters(ctx context.Context, before time.Time, limit int) ([]DeadLetter, error)
+	ClaimDeadLetter(ctx context.Context, id int, attempts int, nextRetryAt time.Time) (bool, error)
+	UpdateDeadLetter(ctx context.Context, id int, from []string, status string, lastError string) (bool, error)
+
+	CreateInboundMessage(ctx context.Context, msg InboundMessage) (InboundMessage, error)
+	GetInboundMessage(ctx context.Context, id int) (InboundMessage, bool, error)
+	GetInboundMessages(ctx context.Context, option InboundQueryOption) ([]InboundMessage, error)
+	PurgeInboundMessages(ctx context.Context, before time.Time) (int64, error)
+
+	Ping(ctx context.Context) error
 }
 
 type UserInfo struct {
@@ -31,6 +64,13 @@ type UserInfo struct {
 	Active   bool      `gorm:"default:true" json:"active"`
 	CreateAt time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP;<-:create" json:"create_at"`
 	Reserve  string    `gorm:"size:256" json:",omitempty"`
+
+	// MuteNotify opts the user out of template message notifications
+	MuteNotify bool `gorm:"column:mute_notify;default:false" json:"mute_notify"`
+	// Nickname and Subscribed are synced from wechat, Subscribed has no default
+	// as gorm writes the default in place of false, the migration backfills it
+	Nickname   string `gorm:"size:128" json:"nickname,omitempty"`
+	Subscribed bool   `gorm:"column:subscribed;not null" json:"subscribed"`
 }
 
 type RecordInfo struct {
@@ -43,6 +83,11 @@ type RecordInfo struct {
 	UpdatedAt time.Time    `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP on update current_timestamp" json:"updated_at"`
 	Reserve1  string       `gorm:"size:256" json:",omitempty"`
 	Reserve2  string       `gorm:"size:256" json:",omitempty"`
+
+	// DenyReason is filled by the reviewer when the record is denied
+	DenyReason string `gorm:"size:512" json:"deny_reason,omitempty"`
+	// DuplicateOf is the id of the original record when auto denied as duplicated
+	DuplicateOf int `gorm:"column:duplicate_of" json:"duplicate_of,omitempty"`
 }
 
 func NewRecordInfo(ownerID, status, graphUrl string) (RecordInfo, error) {
@@ -75,6 +120,20 @@ func RecordStatusFromString(status string) (RecordStatus, error) {
 	return autoDenied, fmt.Errorf("unknown status %s", status)
 }
 
+func (status RecordStatus) String() string {
+	switch status {
+	case confirmed:
+		return Confirmed
+	case waitingForConfirm:
+		return WaitingForConfirm
+	case denied:
+		return Denied
+	case autoDenied:
+		return AutoDenied
+	}
+	return fmt.Sprintf("unknown(%d)", int(status))
+}
+
 const (
 	Confirmed         = "confirmed"
 	WaitingForConfirm = "waitingForConfirm"
@@ -93,6 +152,9 @@ type Hash struct {
 	Reserve  string `gorm:"size:256" json:",omitempty"`
 }
 
+var createRecordLatency = metrics.NewHistogramVec("wechat_datastore_create_record_duration_seconds",
+	"Latency of CreateRecord, the dedup transaction.", nil, "result")
+
 type mysqlDataStore struct {
 	db *gorm.DB
 }
@@ -106,17 +168,75 @@ func NewMysqlDataStore(cfg src.Config, cleanup bool) (*mysqlDataStore, error) {
 	}
 
 	store := &mysqlDataStore{db: db}
+	if err := registerPoolMetrics(db); err != nil {
+		return nil, err
+	}
 	if cleanup {
 		if err := store.cleanup(); err != nil {
 			return nil, fmt.Errorf("fail to clean up tables, %w", err)
 		}
 	}
-	if err := db.AutoMigrate(&UserInfo{}, &RecordInfo{}, &Hash{}); err != nil {
+	// the users there before subscribed is kept are taken as subscribed till their next sync
+	backfill := db.Migrator().HasTable(&UserInfo{}) && !db.Migrator().HasColumn(&UserInfo{}, "subscribed")
+	if err := db.AutoMigrate(&UserInfo{}, &RecordInfo{}, &Hash{}, &AccessToken{}, &Registration{}, &DeadLetter{}, &InboundMessage{},
+		&QuotaUsage{}); err != nil {
 		return nil, fmt.Errorf("fail to migrate tables, %w", err)
 	}
+	if backfill {
+		result := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Model(&UserInfo{}).UpdateColumn("subscribed", true)
+		if result.Error != nil {
+			return nil, fmt.Errorf("fail to backfill subscribed of users, %w", result.Error)
+		}
+	}
 	return store, nil
 }
 
+// registerPoolMetrics exports the stats of the connection pool under gorm.
+func registerPoolMetrics(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("fail to get sql db, %w", err)
+	}
+	stat := func(value func(stats sql.DBStats) float64) func() (float64, bool) {
+		return func() (float64, bool) { return value(sqlDB.Stats()), true }
+	}
+
+	metrics.NewGaugeFunc("wechat_db_open_connections", "Connections established, in use and idle.").
+		Set(stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	metrics.NewGaugeFunc("wechat_db_in_use_connections", "Connections in use.").
+		Set(stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	metrics.NewGaugeFunc("wechat_db_idle_connections", "Idle connections.").
+		Set(stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	metrics.NewGaugeFunc("wechat_db_max_open_connections", "Limit of open connections, 0 is unlimited.").
+		Set(stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	metrics.NewCounterFunc("wechat_db_wait_count_total", "Connections waited for.").
+		Set(stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	metrics.NewCounterFunc("wechat_db_wait_duration_seconds_total", "Time blocked waiting for a connection.").
+		Set(stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	return nil
+}
+
+// Ping checks a connection of the pool is alive.
+func (store *mysqlDataStore) Ping(ctx context.Context) error {
+	sqlDB, err := store.db.DB()
+	if err != nil {
+		return fmt.Errorf("fail to get sql db, %w", err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("fail to ping mysql, %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection pool, queries in flight are not interrupted.
+func (store *mysqlDataStore) Close() error {
+	sqlDB, err := store.db.DB()
+	if err != nil {
+		return fmt.Errorf("fail to get sql db, %w", err)
+	}
+	return sqlDB.Close()
+}
+
 func (store *mysqlDataStore) cleanup() error {
 	var result *gorm.DB
 	const drop = "DROP TABLE IF EXISTS %s"
@@ -129,6 +249,21 @@ func (store *mysqlDataStore) cleanup() error {
 	if result = store.db.Exec(fmt.Sprintf(drop, "hashes")); result.Error != nil {
 		return fmt.Errorf("fail to clean up table Hash, %w", result.Error)
 	}
+	if result = store.db.Exec(fmt.Sprintf(drop, "access_tokens")); result.Error != nil {
+		return fmt.Errorf("fail to clean up table AccessToken, %w", result.Error)
+	}
+	if result = store.db.Exec(fmt.Sprintf(drop, "registrations")); result.Error != nil {
+		return fmt.Errorf("fail to clean up table Registration, %w", result.Error)
+	}
+	if result = store.db.Exec(fmt.Sprintf(drop, "dead_letters")); result.Error != nil {
+		return fmt.Errorf("fail to clean up table DeadLetter, %w", result.Error)
+	}
+	if result = store.db.Exec(fmt.Sprintf(drop, "inbound_messages")); result.Error != nil {
+		return fmt.Errorf("fail to clean up table InboundMessage, %w", result.Error)
+	}
+	if result = store.db.Exec(fmt.Sprintf(drop, "quota_usages")); result.Error != nil {
+		return fmt.Errorf("fail to clean up table QuotaUsage, %w", result.Error)
+	}
 	return nil
 }
 
@@ -156,6 +291,24 @@ func (store *mysqlDataStore) GetUserById(ctx context.Context, id string) (UserIn
 	return user, true, result.Error
 }
 
+func (store *mysqlDataStore) UpdateUserNotify(ctx context.Context, id string, mute bool) error {
+	result := store.db.WithContext(ctx).Model(&UserInfo{}).Where("wechat_id=?", id).Update("mute_notify", mute)
+	if result.Error != nil {
+		return fmt.Errorf("fail to update notify of user %s, %w", id, result.Error)
+	}
+	return nil
+}
+
+// UpdateUserFollower saves what wechat knows about the user.
+func (store *mysqlDataStore) UpdateUserFollower(ctx context.Context, id string, nickname string, subscribed bool) error {
+	result := store.db.WithContext(ctx).Model(&UserInfo{}).Where("wechat_id=?", id).
+		Updates(map[string]interface{}{"nickname": nickname, "subscribed": subscribed})
+	if result.Error != nil {
+		return fmt.Errorf("fail to update follower of user %s, %w", id, result.Error)
+	}
+	return nil
+}
+
 /*
  * CURD for records
  */
@@ -163,6 +316,9 @@ func (store *mysqlDataStore) GetUserById(ctx context.Context, id string) (UserIn
 type RecordQueryOption struct {
 	from, to               time.Time
 	minorStatus, maxStatus RecordStatus
+	ownerID                string
+	ownerIDs               []string
+	limit                  int
 }
 
 func NewRecordQueryOption(from, to time.Time, minorStatus, maxStatus string) (RecordQueryOption, error) {
@@ -182,40 +338,220 @@ func NewRecordQueryOption(from, to time.Time, minorStatus, maxStatus string) (Re
 	return op, nil
 }
 
-// CreateRecord WARNING: MUST NOT reply on "existed" when set "checkExist" to false
-func (store *mysqlDataStore) CreateRecord(ctx context.Context, record RecordInfo, md5 string, _ bool) (existed bool, err error) {
-	db := store.db.WithContext(ctx)
+// WithOwner only queries records uploaded by the given user.
+func (op RecordQueryOption) WithOwner(ownerID string) RecordQueryOption {
+	op.ownerID = ownerID
+	return op
+}
+
+// WithOwners only queries records uploaded by any of the given users, e.g. the members of a team.
+func (op RecordQueryOption) WithOwners(ownerIDs ...string) RecordQueryOption {
+	op.ownerIDs = ownerIDs
+	return op
+}
+
+// WithLimit only queries the latest n records.
+func (op RecordQueryOption) WithLimit(n int) RecordQueryOption {
+	op.limit = n
+	return op
+}
+
+// CreateRecordOption tells CreateRecord what a duplicate is, and the quotas a record is
+// created within.
+type CreateRecordOption struct {
+	dedupSince time.Time
+
+	quotaFrom, quotaTo time.Time
+	quotas             []*Quota
+}
+
+func NewCreateRecordOption() CreateRecordOption {
+	return CreateRecordOption{}
+}
+
+// WithDedupSince only takes a record created since as the original of a duplicate, a hash
+// seen before is linked to the new record then. The zero time is since ever.
+func (op CreateRecordOption) WithDedupSince(since time.Time) CreateRecordOption {
+	op.dedupSince = since
+	return op
+}
+
+// WithQuotas counts the record on the quotas of the business day [from, to) if it is not
+// a duplicate, or fails with ErrQuotaExceeded if one of them is used up.
+func (op CreateRecordOption) WithQuotas(from, to time.Time, quotas ...*Quota) CreateRecordOption {
+	op.quotaFrom, op.quotaTo = from, to
+	op.quotas = quotas
+	return op
+}
+
+// Quotas returns the quotas given by WithQuotas, e.g. for a fake DataStore to fill.
+func (op CreateRecordOption) Quotas() []*Quota {
+	return op.quotas
+}
 
-	// check md5 and set status accordingly
-	tx := db.Begin()
-	defer func() {
+// CreateRecord inserts the record, a duplicate of an earlier one is auto denied.
+// The record is filled with what is inserted, e.g. the id and the status of a duplicate.
+func (store *mysqlDataStore) CreateRecord(ctx context.Context, record *RecordInfo, md5 string, option CreateRecordOption) (existed bool, err error) {
+	defer func(start time.Time) {
+		result := "ok"
 		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
+			result = "error"
 		}
-	}()
+		createRecordLatency.Observe(time.Since(start).Seconds(), result)
+	}(time.Now())
+
+	// nested in the transaction of a dry run, it is a savepoint
+	err = store.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		existed, err = createRecord(tx, record, md5, option)
+		return err
+	})
+	return existed, err
+}
 
+// createRecord checks md5 and sets the status accordingly, within tx.
+func createRecord(tx *gorm.DB, record *RecordInfo, md5 string, option CreateRecordOption) (existed bool, err error) {
 	result := tx.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&Hash{MD5: md5})
 	if result.Error != nil {
 		return false, fmt.Errorf("fail to insert hash, %w", result.Error)
 	}
 
 	// check if duplicated
+	var origin Hash
 	if result.RowsAffected == 0 {
-		existed = true
+		// locked till commit, so a concurrent upload of an expired hash sees it linked again
+		if result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("md5=?", md5).First(&origin); result.Error != nil {
+			err = fmt.Errorf("fail to get original hash, %w", result.Error)
+			return
+		}
+		existed, err = originWithin(tx, origin, option.dedupSince)
+		if err != nil {
+			return
+		}
+	}
+	if existed {
 		// set status if duplicated
 		record.Status = autoDenied
+		record.DuplicateOf = origin.RecordID
+	} else if err = useQuotas(tx, option); err != nil {
+		return
 	}
 
-	// insert record
-	if result := tx.Create(&record); result.Error != nil {
+	// insert record, the time is set here as the default of the column is not read back
+	if record.CreateAt.IsZero() {
+		record.CreateAt = time.Now()
+	}
+	if result := tx.Create(record); result.Error != nil {
 		err = fmt.Errorf("fail to insert record, %w", result.Error)
 		return
 	}
+
+	// link the hash to the record it first came with, or came with again after the window
+	if !existed {
+		if result := tx.Model(&Hash{}).Where("md5=?", md5).Update("record_id", record.ID); result.Error != nil {
+			err = fmt.Errorf("fail to link hash to record, %w", result.Error)
+			return
+		}
+		if err = incrQuotas(tx, option); err != nil {
+			return
+		}
+	}
 	return
 }
 
+// originWithin tells if the record the hash is linked to is created since, the zero time is
+// since ever.
+func originWithin(tx *gorm.DB, origin Hash, since time.Time) (bool, error) {
+	if since.IsZero() {
+		return true, nil
+	}
+	var record RecordInfo
+	result := tx.Select("id", "create_at").Where("id=?", origin.RecordID).Limit(1).Find(&record)
+	if result.Error != nil {
+		return false, fmt.Errorf("fail to get original record, %w", result.Error)
+	}
+	return result.RowsAffected > 0 && !record.CreateAt.Before(since), nil
+}
+
+func (store *mysqlDataStore) queryRecords(ctx context.Context, option RecordQueryOption) *gorm.DB {
+	db := store.db.WithContext(ctx).Model(&RecordInfo{}).
+		Where("create_at >= ? AND create_at < ?", option.from, option.to).
+		Where("status >= ? AND status <= ?", option.minorStatus, option.maxStatus)
+	if option.ownerID != "" {
+		db = db.Where("owner_id=?", option.ownerID)
+	}
+	if option.ownerIDs != nil {
+		db = db.Where("owner_id IN ?", option.ownerIDs)
+	}
+	return db
+}
+
+func (store *mysqlDataStore) GetRecords(ctx context.Context, option RecordQueryOption) ([]RecordInfo, error) {
+	var records []RecordInfo
+
+	db := store.queryRecords(ctx, option)
+	if option.limit > 0 {
+		db = db.Limit(option.limit)
+	}
+	if result := db.Order("create_at desc, id desc").Find(&records); result.Error != nil {
+		return nil, fmt.Errorf("fail to get records, %w", result.Error)
+	}
+	return records, nil
+}
+
+// CountRecords ignores the limit of the option.
+func (store *mysqlDataStore) CountRecords(ctx context.Context, option RecordQueryOption) (int64, error) {
+	var n int64
+	if option.ownerIDs != nil && len(option.ownerIDs) == 0 {
+		return 0, nil
+	}
+	if result := store.queryRecords(ctx, option).Count(&n); result.Error != nil {
+		return 0, fmt.Errorf("fail to count records, %w", result.Error)
+	}
+	return n, nil
+}
+
+func (store *mysqlDataStore) GetRecordsByIds(ctx context.Context, ids []int) ([]RecordInfo, error) {
+	var records []RecordInfo
+	if len(ids) == 0 {
+		return records, nil
+	}
+	if result := store.db.WithContext(ctx).Where("id IN ?", ids).Find(&records); result.Error != nil {
+		return nil, fmt.Errorf("fail to get records by ids, %w", result.Error)
+	}
+	return records, nil
+}
+
+// ReviewRecord confirms or denies a record waiting for confirm,
+// false is returned when there is no such record waiting.
+func (store *mysqlDataStore) ReviewRecord(ctx context.Context, id int, status string, reviewer string, reason string) (RecordInfo, bool, error) {
+	var record RecordInfo
+
+	rStatus, err := RecordStatusFromString(status)
+	if err != nil {
+		return record, false, fmt.Errorf("illeagal record status, %w", err)
+	}
+	if rStatus != confirmed && rStatus != denied {
+		return record, false, fmt.Errorf("record can only be %s or %s, got %s", Confirmed, Denied, status)
+	}
+
+	db := store.db.WithContext(ctx)
+	result := db.Model(&RecordInfo{}).
+		Where("id=? AND status=?", id, waitingForConfirm).
+		Updates(map[string]interface{}{"status": rStatus, "updated_by": reviewer, "deny_reason": reason})
+	if result.Error != nil {
+		return record, false, fmt.Errorf("fail to review record %d, %w", id, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return record, false, nil
+	}
+
+	if result := db.Where("id=?", id).First(&record); result.Error != nil {
+		return record, false, fmt.Errorf("fail to get reviewed record %d, %w", id, result.Error)
+	}
+	return record, true, nil
+}
+
 /*
  * CURD for hash
  */
@@ -243,3 +579,21 @@ from
 	}
 	return hashes, nil
 }
+
+// HashExists tells if a record with the md5 has been uploaded.
+func (store *mysqlDataStore) HashExists(ctx context.Context, md5 string) (bool, error) {
+	var n int64
+	if result := store.db.WithContext(ctx).Model(&Hash{}).Where("md5=?", md5).Count(&n); result.Error != nil {
+		return false, fmt.Errorf("fail to check hash, %w", result.Error)
+	}
+	return n > 0, nil
+}
+
+// errDuplicateEntry is ER_DUP_ENTRY of mysql
+const errDuplicateEntry = 1062
+
+// isDuplicateKey tells if err is mysql rejecting a row by a unique key.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysqldriver.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry
+}
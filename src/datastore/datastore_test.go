@@ -36,6 +36,7 @@ func TestDataStore(t *testing.T) {
 	rq.NoError(err)
 
 	ctx := context.Background()
+	rq.NoError(store.Ping(ctx))
 
 	t.Run("users", func(t *testing.T) {
 		rq.NoError(store.CreateNewUser(ctx, UserInfo{
@@ -43,8 +44,9 @@ func TestDataStore(t *testing.T) {
 			Name:     "user_1",
 		}))
 		rq.NoError(store.CreateNewUser(ctx, UserInfo{
-			WechatID: "id_2",
-			Name:     "user_2",
+			WechatID:   "id_2",
+			Name:       "user_2",
+			Subscribed: true,
 		}))
 
 		users, err := store.GetAllUsers(ctx)
@@ -58,6 +60,23 @@ func TestDataStore(t *testing.T) {
 		_, exist, err = store.GetUserById(ctx, "id_3")
 		rq.NoError(err)
 		rq.False(exist)
+
+		// false is kept, not taken as the zero value to default
+		user, _, err := store.GetUserById(ctx, "id_1")
+		rq.NoError(err)
+		rq.False(user.Subscribed)
+
+		rq.NoError(store.UpdateUserNotify(ctx, "id_2", true))
+		user, _, err = store.GetUserById(ctx, "id_2")
+		rq.NoError(err)
+		rq.True(user.MuteNotify)
+		rq.True(user.Subscribed)
+
+		rq.NoError(store.UpdateUserFollower(ctx, "id_2", "nick_2", false))
+		user, _, err = store.GetUserById(ctx, "id_2")
+		rq.NoError(err)
+		rq.Equal("nick_2", user.Nickname)
+		rq.False(user.Subscribed)
 	})
 
 	t.Run("record", func(t *testing.T) {
@@ -68,16 +87,21 @@ func TestDataStore(t *testing.T) {
 		}
 
 		// create record, success
-		exist, err := store.CreateRecord(ctx, r1, "123", true)
+		first := r1
+		exist, err := store.CreateRecord(ctx, &first, "123", NewCreateRecordOption())
 		rq.False(exist)
 		rq.NoError(err)
+		rq.NotZero(first.ID)
+		rq.False(first.CreateAt.IsZero())
 
 		// create record with duplicated md5,
 		// record -> success
 		// duplicated md5 -> exist = true
-		exist, err = store.CreateRecord(ctx, r1, "123", true)
+		dup := r1
+		exist, err = store.CreateRecord(ctx, &dup, "123", NewCreateRecordOption())
 		rq.True(exist)
 		rq.NoError(err)
+		rq.Equal(first.ID, dup.DuplicateOf)
 
 		hashes, err := store.GetAllHashes(ctx, HashQueryOption{
 			from: Zero(time.Now()),
@@ -85,5 +109,233 @@ func TestDataStore(t *testing.T) {
 		})
 		rq.NoError(err)
 		rq.Equal(1, len(hashes))
+
+		option, err := NewRecordQueryOption(Zero(time.Now()), time.Now().Add(time.Minute), AutoDenied, Confirmed)
+		rq.NoError(err)
+		records, err := store.GetRecords(ctx, option.WithOwner("id_1"))
+		rq.NoError(err)
+		rq.Equal(2, len(records))
+
+		n, err := store.CountRecords(ctx, option.WithOwners("id_1", "id_2"))
+		rq.NoError(err)
+		rq.Equal(int64(2), n)
+		n, err = store.CountRecords(ctx, option.WithOwners())
+		rq.NoError(err)
+		rq.Equal(int64(0), n)
+
+		// latest first, the duplicated one points to the original
+		rq.Equal(RecordStatus(autoDenied), records[0].Status)
+		rq.Equal(records[1].ID, records[0].DuplicateOf)
+
+		originals, err := store.GetRecordsByIds(ctx, []int{records[0].DuplicateOf})
+		rq.NoError(err)
+		rq.Equal(1, len(originals))
+
+		// only records waiting for confirm can be reviewed
+		_, ok, err := store.ReviewRecord(ctx, records[0].ID, Confirmed, "id_2", "")
+		rq.NoError(err)
+		rq.False(ok)
+
+		reviewed, ok, err := store.ReviewRecord(ctx, records[1].ID, Denied, "id_2", "blurred")
+		rq.NoError(err)
+		rq.True(ok)
+		rq.Equal(RecordStatus(denied), reviewed.Status)
+		rq.Equal("blurred", reviewed.DenyReason)
+		rq.Equal("id_2", reviewed.UpdatedBy)
+
+		_, ok, err = store.ReviewRecord(ctx, records[1].ID, Confirmed, "id_2", "")
+		rq.NoError(err)
+		rq.False(ok)
+	})
+
+	t.Run("dedup window", func(t *testing.T) {
+		since := time.Now().Add(-24 * time.Hour)
+		old := RecordInfo{OwnerID: "id_3", Status: waitingForConfirm, CreateAt: since.Add(-24 * time.Hour)}
+		exist, err := store.CreateRecord(ctx, &old, "window", NewCreateRecordOption())
+		rq.NoError(err)
+		rq.False(exist)
+
+		// the original is out of the window, the hash goes with the new one
+		renewed := RecordInfo{OwnerID: "id_3", Status: waitingForConfirm}
+		exist, err = store.CreateRecord(ctx, &renewed, "window", NewCreateRecordOption().WithDedupSince(since))
+		rq.NoError(err)
+		rq.False(exist)
+
+		dup := RecordInfo{OwnerID: "id_3", Status: waitingForConfirm}
+		exist, err = store.CreateRecord(ctx, &dup, "window", NewCreateRecordOption().WithDedupSince(since))
+		rq.NoError(err)
+		rq.True(exist)
+		rq.Equal(renewed.ID, dup.DuplicateOf)
+	})
+	t.Run("quota", func(t *testing.T) {
+		from := Zero(time.Now())
+		to := from.Add(24 * time.Hour)
+		quota := func() *Quota {
+			return &Quota{Key: "user:id_5", Limit: 1, Owners: []string{"id_5"}}
+		}
+
+		first, used := RecordInfo{OwnerID: "id_5", Status: waitingForConfirm}, quota()
+		exist, err := store.CreateRecord(ctx, &first, "q1", NewCreateRecordOption().WithQuotas(from, to, used))
+		rq.NoError(err)
+		rq.False(exist)
+		rq.Equal(0, used.Used)
+
+		// used up, neither the record nor the hash is created
+		second, used := RecordInfo{OwnerID: "id_5", Status: waitingForConfirm}, quota()
+		_, err = store.CreateRecord(ctx, &second, "q2", NewCreateRecordOption().WithQuotas(from, to, used))
+		rq.ErrorIs(err, ErrQuotaExceeded)
+		rq.Equal(1, used.Used)
+		exist, err = store.HashExists(ctx, "q2")
+		rq.NoError(err)
+		rq.False(exist)
+
+		// duplicates are not counted
+		dup := RecordInfo{OwnerID: "id_5", Status: waitingForConfirm}
+		exist, err = store.CreateRecord(ctx, &dup, "q1", NewCreateRecordOption().WithQuotas(from, to, quota()))
+		rq.NoError(err)
+		rq.True(exist)
+	})
+
+	t.Run("registration", func(t *testing.T) {
+		registration, created, err := store.CreateRegistration(ctx, Registration{
+			WechatID: "id_4",
+			LeaderID: "id_1",
+			Source:   RegistrationByQRCode,
+		})
+		rq.NoError(err)
+		rq.True(created)
+		rq.Equal(RegistrationPending, registration.Status)
+
+		// one pending registration a user
+		again, created, err := store.CreateRegistration(ctx, Registration{WechatID: "id_4", Source: RegistrationByText})
+		rq.NoError(err)
+		rq.False(created)
+		rq.Equal(registration.ID, again.ID)
+
+		pending, ok, err := store.GetPendingRegistration(ctx, "id_4")
+		rq.NoError(err)
+		rq.True(ok)
+		rq.Equal(registration.ID, pending.ID)
+
+		registrations, err := store.GetRegistrations(ctx, RegistrationPending, "id_1")
+		rq.NoError(err)
+		rq.Equal(1, len(registrations))
+		registrations, err = store.GetRegistrations(ctx, RegistrationPending, "id_2")
+		rq.NoError(err)
+		rq.Equal(0, len(registrations))
+
+		reviewed, ok, err := store.ReviewRegistration(ctx, registration.ID, RegistrationApproved, "id_1")
+		rq.NoError(err)
+		rq.True(ok)
+		rq.Equal(RegistrationApproved, reviewed.Status)
+
+		// reviewed only once
+		_, ok, err = store.ReviewRegistration(ctx, registration.ID, RegistrationRejected, "id_1")
+		rq.NoError(err)
+		rq.False(ok)
+
+		_, ok, err = store.GetPendingRegistration(ctx, "id_4")
+		rq.NoError(err)
+		rq.False(ok)
+
+		// applies again once reviewed
+		_, created, err = store.CreateRegistration(ctx, Registration{WechatID: "id_4", Source: RegistrationByText})
+		rq.NoError(err)
+		rq.True(created)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		letter, err := store.CreateDeadLetter(ctx, DeadLetter{WechatID: "id_1", MsgType: "image",
+			Message: `{"FromUserName":"id_1"}`, Error: "fail to insert record", TraceID: "trace_1",
+			NextRetryAt: time.Now().Add(-time.Second)})
+		rq.NoError(err)
+		rq.Equal(DeadLetterPending, letter.Status)
+
+		due, err := store.GetDueDeadLetters(ctx, time.Now(), 10)
+		rq.NoError(err)
+		rq.Equal(1, len(due))
+
+		// claimed once, by attempts
+		ok, err := store.ClaimDeadLetter(ctx, letter.ID, 0, time.Now().Add(time.Minute))
+		rq.NoError(err)
+		rq.True(ok)
+		ok, err = store.ClaimDeadLetter(ctx, letter.ID, 0, time.Now().Add(time.Minute))
+		rq.NoError(err)
+		rq.False(ok)
+
+		due, err = store.GetDueDeadLetters(ctx, time.Now(), 10)
+		rq.NoError(err)
+		rq.Equal(0, len(due))
+
+		ok, err = store.UpdateDeadLetter(ctx, letter.ID, []string{DeadLetterPending}, DeadLetterSucceeded, "")
+		rq.NoError(err)
+		rq.True(ok)
+		ok, err = store.UpdateDeadLetter(ctx, letter.ID, []string{DeadLetterPending}, DeadLetterDiscarded, "")
+		rq.NoError(err)
+		rq.False(ok)
+
+		got, ok, err := store.GetDeadLetter(ctx, letter.ID)
+		rq.NoError(err)
+		rq.True(ok)
+		rq.Equal(1, got.Attempts)
+		rq.Equal("fail to insert record", got.Error)
+
+		letters, err := store.GetDeadLetters(ctx, DeadLetterSucceeded, 10)
+		rq.NoError(err)
+		rq.Equal(1, len(letters))
+	})
+
+	t.Run("inbound messages", func(t *testing.T) {
+		for _, user := range []string{"id_1", "id_2", "id_1"} {
+			_, err := store.CreateInboundMessage(ctx, InboundMessage{WechatID: user, MsgType: "text",
+				Body: "<xml></xml>", TraceID: "trace_" + user, Outcome: "not_supported"})
+			rq.NoError(err)
+		}
+
+		option := NewInboundQueryOption(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		msgs, err := store.GetInboundMessages(ctx, option.WithUser("id_1"))
+		rq.NoError(err)
+		rq.Equal(2, len(msgs))
+
+		// paged by id
+		msgs, err = store.GetInboundMessages(ctx, option.After(msgs[0].ID).WithLimit(1))
+		rq.NoError(err)
+		rq.Equal(1, len(msgs))
+		rq.Equal("id_2", msgs[0].WechatID)
+
+		got, ok, err := store.GetInboundMessage(ctx, msgs[0].ID)
+		rq.NoError(err)
+		rq.True(ok)
+		rq.Equal("trace_id_2", got.TraceID)
+
+		purged, err := store.PurgeInboundMessages(ctx, time.Now().Add(time.Hour))
+		rq.NoError(err)
+		rq.Equal(int64(3), purged)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dryRun := NewDryRunDataStore(store)
+		record := func() *RecordInfo {
+			return &RecordInfo{OwnerID: "id_1", Status: waitingForConfirm, GraphUrl: "url_dry"}
+		}
+
+		// 123 is uploaded before
+		existed, err := dryRun.CreateRecord(ctx, record(), "123", NewCreateRecordOption())
+		rq.NoError(err)
+		rq.True(existed)
+
+		existed, err = dryRun.CreateRecord(ctx, record(), "dry", NewCreateRecordOption())
+		rq.NoError(err)
+		rq.False(existed)
+		// rolled back already, a duplicate of the run all the same
+		existed, err = store.HashExists(ctx, "dry")
+		rq.NoError(err)
+		rq.False(existed)
+		existed, err = dryRun.CreateRecord(ctx, record(), "dry", NewCreateRecordOption())
+		rq.NoError(err)
+		rq.True(existed)
+
+		// other writes are refused
+		rq.ErrorIs(dryRun.CreateNewUser(ctx, UserInfo{WechatID: "id_dry"}), ErrDryRun)
 	})
 }
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DeadLetterPending   = "pending"
+	DeadLetterSucceeded = "succeeded"
+	// DeadLetterFailed is given up after the max attempts
+	DeadLetterFailed    = "failed"
+	DeadLetterDiscarded = "discarded"
+
+	maxDeadLetterError = 1024
+)
+
+// DeadLetter is a message failed to process, kept to be retried in the background.
+type DeadLetter struct {
+	ID       int    `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	WechatID string `gorm:"column:wechat_id;size:256;not null;index" json:"wechat_id"`
+	MsgType  string `gorm:"column:msg_type;size:32" json:"msg_type"`
+	// Message is the json of the whole message pushed by wechat
+	Message string `gorm:"type:text;not null" json:"message"`
+	Error   string `gorm:"size:1024" json:"error"`
+	// TraceID is of the request the message failed in
+	TraceID     string    `gorm:"column:trace_id;size:64" json:"trace_id"`
+	Status      string    `gorm:"size:32;not null;index:idx_dead_letter_due,priority:1" json:"status"`
+	Attempts    int       `gorm:"not null;default:0" json:"attempts"`
+	NextRetryAt time.Time `gorm:"column:next_retry_at;index:idx_dead_letter_due,priority:2" json:"next_retry_at"`
+	CreateAt    time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP;<-:create" json:"create_at"`
+	UpdatedAt   time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP on update current_timestamp" json:"updated_at"`
+}
+
+func truncateError(msg string) string {
+	if len(msg) > maxDeadLetterError {
+		return msg[:maxDeadLetterError]
+	}
+	return msg
+}
+
+/*
+ * CURD for dead letters
+ */
+
+func (store *mysqlDataStore) CreateDeadLetter(ctx context.Context, letter DeadLetter) (DeadLetter, error) {
+	letter.Status = DeadLetterPending
+	letter.Error = truncateError(letter.Error)
+	if result := store.db.WithContext(ctx).Create(&letter); result.Error != nil {
+		return letter, fmt.Errorf("fail to create dead letter, %w", result.Error)
+	}
+	return letter, nil
+}
+
+func (store *mysqlDataStore) GetDeadLetter(ctx context.Context, id int) (DeadLetter, bool, error) {
+	var letter DeadLetter
+	result := store.db.WithContext(ctx).Where("id=?", id).First(&letter)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return letter, false, nil
+	}
+	return letter, result.Error == nil, result.Error
+}
+
+// GetDeadLetters lists the dead letters in the status, latest first.
+func (store *mysqlDataStore) GetDeadLetters(ctx context.Context, status string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	db := store.db.WithContext(ctx).Where("status=?", status)
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	if result := db.Order("id desc").Find(&letters); result.Error != nil {
+		return nil, fmt.Errorf("fail to get dead letters, %w", result.Error)
+	}
+	return letters, nil
+}
+
+// GetDueDeadLetters lists the pending dead letters to be retried before the given time, earliest first.
+func (store *mysqlDataStore) GetDueDeadLetters(ctx context.Context, before time.Time, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	result := store.db.WithContext(ctx).
+		Where("status=? AND next_retry_at<=?", DeadLetterPending, before).
+		Order("next_retry_at").
+		Limit(limit).
+		Find(&letters)
+	if result.Error != nil {
+		return nil, fmt.Errorf("fail to get due dead letters, %w", result.Error)
+	}
+	return letters, nil
+}
+
+// ClaimDeadLetter takes the attempt after the given one, and holds the letter off until the
+// next retry. False is returned if another replica has claimed it, or it is not pending.
+func (store *mysqlDataStore) ClaimDeadLetter(ctx context.Context, id int, attempts int, nextRetryAt time.Time) (bool, error) {
+	result := store.db.WithContext(ctx).Model(&DeadLetter{}).
+		Where("id=? AND status=? AND attempts=?", id, DeadLetterPending, attempts).
+		Updates(map[string]interface{}{"attempts": attempts + 1, "next_retry_at": nextRetryAt})
+	if result.Error != nil {
+		return false, fmt.Errorf("fail to claim dead letter %d, %w", id, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// UpdateDeadLetter moves the letter from one of the given status, false is returned if it is
+// in none of them. lastError is kept if empty.
+func (store *mysqlDataStore) UpdateDeadLetter(ctx context.Context, id int, from []string, status string, lastError string) (bool, error) {
+	updates := map[string]interface{}{"status": status}
+	if lastError != "" {
+		updates["error"] = truncateError(lastError)
+	}
+	result := store.db.WithContext(ctx).Model(&DeadLetter{}).
+		Where("id=? AND status IN ?", id, from).
+		Updates(updates)
+	if result.Error != nil {
+		return false, fmt.Errorf("fail to update dead letter %d, %w", id, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrDryRun is returned by the writes a dry run does not simulate.
+var ErrDryRun = errors.New("not allowed in dry run")
+
+// dryRunDataStore reads through to the store it wraps and never writes to it. A record is
+// created by the real CreateRecord in a transaction rolled back right after, so a live upload
+// never waits for the run. The hashes created during the run are kept in memory, a later record
+// of one of them is a duplicate.
+type dryRunDataStore struct {
+	DataStore
+	db *gorm.DB
+
+	mutex  sync.Mutex
+	hashes map[string]struct{}
+}
+
+func NewDryRunDataStore(store *mysqlDataStore) DataStore {
+	return &dryRunDataStore{DataStore: store, db: store.db, hashes: make(map[string]struct{})}
+}
+
+func (store *dryRunDataStore) CreateRecord(ctx context.Context, record *RecordInfo, md5 string, option CreateRecordOption) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.hashes[md5]; ok {
+		return true, nil
+	}
+	tx := store.db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return false, fmt.Errorf("fail to begin dry run transaction, %w", tx.Error)
+	}
+	defer tx.Rollback()
+
+	existed, err := createRecord(tx, record, md5, option)
+	if err != nil {
+		return false, err
+	}
+	store.hashes[md5] = struct{}{}
+	return existed, nil
+}
+
+func (store *dryRunDataStore) CreateNewUser(context.Context, UserInfo) error { return ErrDryRun }
+
+func (store *dryRunDataStore) UpdateUserNotify(context.Context, string, bool) error {
+	return ErrDryRun
+}
+
+func (store *dryRunDataStore) UpdateUserFollower(context.Context, string, string, bool) error {
+	return ErrDryRun
+}
+
+func (store *dryRunDataStore) ReviewRecord(context.Context, int, string, string, string) (RecordInfo, bool, error) {
+	return RecordInfo{}, false, ErrDryRun
+}
+
+func (store *dryRunDataStore) CreateRegistration(context.Context, Registration) (Registration, bool, error) {
+	return Registration{}, false, ErrDryRun
+}
+
+func (store *dryRunDataStore) ReviewRegistration(context.Context, int, string, string) (Registration, bool, error) {
+	return Registration{}, false, ErrDryRun
+}
+
+func (store *dryRunDataStore) SaveToken(context.Context, AccessToken) error { return ErrDryRun }
+
+func (store *dryRunDataStore) AcquireTokenLease(context.Context, string, string, time.Duration) (bool, error) {
+	return false, ErrDryRun
+}
+
+func (store *dryRunDataStore) CreateDeadLetter(context.Context, DeadLetter) (DeadLetter, error) {
+	return DeadLetter{}, ErrDryRun
+}
+
+func (store *dryRunDataStore) ClaimDeadLetter(context.Context, int, int, time.Time) (bool, error) {
+	return false, ErrDryRun
+}
+
+func (store *dryRunDataStore) UpdateDeadLetter(context.Context, int, []string, string, string) (bool, error) {
+	return false, ErrDryRun
+}
+
+func (store *dryRunDataStore) CreateInboundMessage(context.Context, InboundMessage) (InboundMessage, error) {
+	return InboundMessage{}, ErrDryRun
+}
+
+func (store *dryRunDataStore) PurgeInboundMessages(context.Context, time.Time) (int64, error) {
+	return 0, ErrDryRun
+}
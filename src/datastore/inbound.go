@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InboundMessage is a payload pushed to the portal, archived with what it was answered.
+type InboundMessage struct {
+	ID       int    `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	WechatID string `gorm:"column:wechat_id;size:256;index" json:"wechat_id"`
+	MsgType  string `gorm:"column:msg_type;size:32" json:"msg_type"`
+	// Body is the xml as pushed by wechat, Headers the json of the http headers
+	Body    string `gorm:"type:text;not null" json:"body"`
+	Headers string `gorm:"type:text" json:"headers"`
+	TraceID string `gorm:"column:trace_id;size:64;index" json:"trace_id"`
+	Reply   string `gorm:"type:text" json:"reply"`
+	// Outcome is the one counted by wechat_messages_total, e.g. duplicated
+	Outcome  string    `gorm:"size:32;index" json:"outcome"`
+	CreateAt time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP;<-:create;index" json:"create_at"`
+}
+
+type InboundQueryOption struct {
+	from, to time.Time
+	wechatID string
+	outcome  string
+	afterID  int
+	limit    int
+}
+
+// NewInboundQueryOption queries the messages archived in [from, to), the oldest first.
+func NewInboundQueryOption(from, to time.Time) InboundQueryOption {
+	return InboundQueryOption{from: from, to: to}
+}
+
+// WithUser only queries the messages from the given user.
+func (op InboundQueryOption) WithUser(wechatID string) InboundQueryOption {
+	op.wechatID = wechatID
+	return op
+}
+
+// WithOutcome only queries the messages processed with the given outcome.
+func (op InboundQueryOption) WithOutcome(outcome string) InboundQueryOption {
+	op.outcome = outcome
+	return op
+}
+
+// After only queries the messages archived after the given one, to page through.
+func (op InboundQueryOption) After(id int) InboundQueryOption {
+	op.afterID = id
+	return op
+}
+
+// WithLimit only queries the first n messages.
+func (op InboundQueryOption) WithLimit(n int) InboundQueryOption {
+	op.limit = n
+	return op
+}
+
+/*
+ * CURD for inbound messages
+ */
+
+func (store *mysqlDataStore) CreateInboundMessage(ctx context.Context, msg InboundMessage) (InboundMessage, error) {
+	if result := store.db.WithContext(ctx).Create(&msg); result.Error != nil {
+		return msg, fmt.Errorf("fail to create inbound message, %w", result.Error)
+	}
+	return msg, nil
+}
+
+func (store *mysqlDataStore) GetInboundMessage(ctx context.Context, id int) (InboundMessage, bool, error) {
+	var msg InboundMessage
+	result := store.db.WithContext(ctx).Where("id=?", id).First(&msg)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return msg, false, nil
+	}
+	if result.Error != nil {
+		return msg, false, fmt.Errorf("fail to get inbound message %d, %w", id, result.Error)
+	}
+	return msg, true, nil
+}
+
+func (store *mysqlDataStore) GetInboundMessages(ctx context.Context, option InboundQueryOption) ([]InboundMessage, error) {
+	var msgs []InboundMessage
+
+	db := store.db.WithContext(ctx).
+		Where("create_at >= ? AND create_at < ?", option.from, option.to).
+		Where("id > ?", option.afterID)
+	if option.wechatID != "" {
+		db = db.Where("wechat_id=?", option.wechatID)
+	}
+	if option.outcome != "" {
+		db = db.Where("outcome=?", option.outcome)
+	}
+	if option.limit > 0 {
+		db = db.Limit(option.limit)
+	}
+	if result := db.Order("id").Find(&msgs); result.Error != nil {
+		return nil, fmt.Errorf("fail to get inbound messages, %w", result.Error)
+	}
+	return msgs, nil
+}
+
+// PurgeInboundMessages deletes the messages archived before the given time, and returns how many.
+func (store *mysqlDataStore) PurgeInboundMessages(ctx context.Context, before time.Time) (int64, error) {
+	result := store.db.WithContext(ctx).Where("create_at < ?", before).Delete(&InboundMessage{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("fail to purge inbound messages, %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -4,10 +4,22 @@ import (
 	"context"
 	"errors"
 	"gorm.io/gorm"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm/logger"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+// maxSpanStatement cuts the sql kept in spans, a batch insert can be long
+const maxSpanStatement = 1024
+
+var (
+	slowQueries   = metrics.NewCounterVec("wechat_datastore_slow_queries_total", "SQL slower than the slow threshold.")
+	failedQueries = metrics.NewCounterVec("wechat_datastore_failed_queries_total", "SQL failed, record not found excluded.")
 )
 
 var dataStoreTracer = func(ctx context.Context) *logrus.Entry {
@@ -22,6 +34,12 @@ func (logger Logger) LogMode(_ logger.LogLevel) logger.Interface {
 	return logger
 }
 
+// ParamsFilter keeps the values out of the sql logged and traced, they carry the tokens,
+// the sessions and the archived messages.
+func (logger Logger) ParamsFilter(_ context.Context, sql string, _ ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
 func (logger Logger) Info(ctx context.Context, format string, msg ...interface{}) {
 	dataStoreTracer(ctx).Infof(format, msg...)
 }
@@ -33,12 +51,25 @@ func (logger Logger) Error(ctx context.Context, format string, msg ...interface{
 }
 func (logger Logger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
 	elapsed := time.Since(begin)
-	sql, _ := fc()
+	sql, rows := fc()
+
+	spanErr := err
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		spanErr = nil
+	}
+	statement := sql
+	if len(statement) > maxSpanStatement {
+		statement = statement[:maxSpanStatement] + "..."
+	}
+	src.RecordSpan(ctx, "sql", begin, begin.Add(elapsed), spanErr,
+		"db.system", "mysql", "db.statement", statement, "db.rows_affected", strconv.FormatInt(rows, 10))
 
 	switch {
 	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		failedQueries.Inc()
 		dataStoreTracer(ctx).Errorf("SQL failed: %s, err=%s", sql, err.Error())
 	case elapsed > logger.slowThreshold:
+		slowQueries.Inc()
 		dataStoreTracer(ctx).Warningf("[SLOW SQL] - %s | %s", elapsed.String(), sql)
 	default:
 		dataStoreTracer(ctx).Debugf("SQL - %s | %s", elapsed.String(), sql)
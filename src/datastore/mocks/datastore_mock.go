@@ -7,6 +7,7 @@ package mock_datastore
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	datastore "github.com/hanzezhenalex/wechat/src/datastore"
@@ -35,6 +36,81 @@ func (m *MockDataStore) EXPECT() *MockDataStoreMockRecorder {
 	return m.recorder
 }
 
+// AcquireTokenLease mocks base method.
+func (m *MockDataStore) AcquireTokenLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcquireTokenLease", ctx, name, holder, ttl)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcquireTokenLease indicates an expected call of AcquireTokenLease.
+func (mr *MockDataStoreMockRecorder) AcquireTokenLease(ctx, name, holder, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquireTokenLease", reflect.TypeOf((*MockDataStore)(nil).AcquireTokenLease), ctx, name, holder, ttl)
+}
+
+// ClaimDeadLetter mocks base method.
+func (m *MockDataStore) ClaimDeadLetter(ctx context.Context, id int, attempts int, nextRetryAt time.Time) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimDeadLetter", ctx, id, attempts, nextRetryAt)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimDeadLetter indicates an expected call of ClaimDeadLetter.
+func (mr *MockDataStoreMockRecorder) ClaimDeadLetter(ctx, id, attempts, nextRetryAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimDeadLetter", reflect.TypeOf((*MockDataStore)(nil).ClaimDeadLetter), ctx, id, attempts, nextRetryAt)
+}
+
+// CountRecords mocks base method.
+func (m *MockDataStore) CountRecords(ctx context.Context, option datastore.RecordQueryOption) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountRecords", ctx, option)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountRecords indicates an expected call of CountRecords.
+func (mr *MockDataStoreMockRecorder) CountRecords(ctx, option interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountRecords", reflect.TypeOf((*MockDataStore)(nil).CountRecords), ctx, option)
+}
+
+// CreateDeadLetter mocks base method.
+func (m *MockDataStore) CreateDeadLetter(ctx context.Context, letter datastore.DeadLetter) (datastore.DeadLetter, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateDeadLetter", ctx, letter)
+	ret0, _ := ret[0].(datastore.DeadLetter)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateDeadLetter indicates an expected call of CreateDeadLetter.
+func (mr *MockDataStoreMockRecorder) CreateDeadLetter(ctx, letter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDeadLetter", reflect.TypeOf((*MockDataStore)(nil).CreateDeadLetter), ctx, letter)
+}
+
+// CreateInboundMessage mocks base method.
+func (m *MockDataStore) CreateInboundMessage(ctx context.Context, msg datastore.InboundMessage) (datastore.InboundMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateInboundMessage", ctx, msg)
+	ret0, _ := ret[0].(datastore.InboundMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateInboundMessage indicates an expected call of CreateInboundMessage.
+func (mr *MockDataStoreMockRecorder) CreateInboundMessage(ctx, msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateInboundMessage", reflect.TypeOf((*MockDataStore)(nil).CreateInboundMessage), ctx, msg)
+}
+
 // CreateNewUser mocks base method.
 func (m *MockDataStore) CreateNewUser(ctx context.Context, user datastore.UserInfo) error {
 	m.ctrl.T.Helper()
@@ -50,18 +126,34 @@ func (mr *MockDataStoreMockRecorder) CreateNewUser(ctx, user interface{}) *gomoc
 }
 
 // CreateRecord mocks base method.
-func (m *MockDataStore) CreateRecord(ctx context.Context, record datastore.RecordInfo, md5 string, checkExist bool) (bool, error) {
+func (m *MockDataStore) CreateRecord(ctx context.Context, record *datastore.RecordInfo, md5 string, option datastore.CreateRecordOption) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateRecord", ctx, record, md5, checkExist)
+	ret := m.ctrl.Call(m, "CreateRecord", ctx, record, md5, option)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CreateRecord indicates an expected call of CreateRecord.
-func (mr *MockDataStoreMockRecorder) CreateRecord(ctx, record, md5, checkExist interface{}) *gomock.Call {
+func (mr *MockDataStoreMockRecorder) CreateRecord(ctx, record, md5, option interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRecord", reflect.TypeOf((*MockDataStore)(nil).CreateRecord), ctx, record, md5, checkExist)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRecord", reflect.TypeOf((*MockDataStore)(nil).CreateRecord), ctx, record, md5, option)
+}
+
+// CreateRegistration mocks base method.
+func (m *MockDataStore) CreateRegistration(ctx context.Context, registration datastore.Registration) (datastore.Registration, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRegistration", ctx, registration)
+	ret0, _ := ret[0].(datastore.Registration)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateRegistration indicates an expected call of CreateRegistration.
+func (mr *MockDataStoreMockRecorder) CreateRegistration(ctx, registration interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRegistration", reflect.TypeOf((*MockDataStore)(nil).CreateRegistration), ctx, registration)
 }
 
 // GetAllHashes mocks base method.
@@ -94,6 +186,176 @@ func (mr *MockDataStoreMockRecorder) GetAllUsers(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllUsers", reflect.TypeOf((*MockDataStore)(nil).GetAllUsers), ctx)
 }
 
+// GetDeadLetter mocks base method.
+func (m *MockDataStore) GetDeadLetter(ctx context.Context, id int) (datastore.DeadLetter, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeadLetter", ctx, id)
+	ret0, _ := ret[0].(datastore.DeadLetter)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetDeadLetter indicates an expected call of GetDeadLetter.
+func (mr *MockDataStoreMockRecorder) GetDeadLetter(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeadLetter", reflect.TypeOf((*MockDataStore)(nil).GetDeadLetter), ctx, id)
+}
+
+// GetDeadLetters mocks base method.
+func (m *MockDataStore) GetDeadLetters(ctx context.Context, status string, limit int) ([]datastore.DeadLetter, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeadLetters", ctx, status, limit)
+	ret0, _ := ret[0].([]datastore.DeadLetter)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeadLetters indicates an expected call of GetDeadLetters.
+func (mr *MockDataStoreMockRecorder) GetDeadLetters(ctx, status, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeadLetters", reflect.TypeOf((*MockDataStore)(nil).GetDeadLetters), ctx, status, limit)
+}
+
+// GetDueDeadLetters mocks base method.
+func (m *MockDataStore) GetDueDeadLetters(ctx context.Context, before time.Time, limit int) ([]datastore.DeadLetter, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDueDeadLetters", ctx, before, limit)
+	ret0, _ := ret[0].([]datastore.DeadLetter)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDueDeadLetters indicates an expected call of GetDueDeadLetters.
+func (mr *MockDataStoreMockRecorder) GetDueDeadLetters(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDueDeadLetters", reflect.TypeOf((*MockDataStore)(nil).GetDueDeadLetters), ctx, before, limit)
+}
+
+// GetInboundMessage mocks base method.
+func (m *MockDataStore) GetInboundMessage(ctx context.Context, id int) (datastore.InboundMessage, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetInboundMessage", ctx, id)
+	ret0, _ := ret[0].(datastore.InboundMessage)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetInboundMessage indicates an expected call of GetInboundMessage.
+func (mr *MockDataStoreMockRecorder) GetInboundMessage(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInboundMessage", reflect.TypeOf((*MockDataStore)(nil).GetInboundMessage), ctx, id)
+}
+
+// GetInboundMessages mocks base method.
+func (m *MockDataStore) GetInboundMessages(ctx context.Context, option datastore.InboundQueryOption) ([]datastore.InboundMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetInboundMessages", ctx, option)
+	ret0, _ := ret[0].([]datastore.InboundMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetInboundMessages indicates an expected call of GetInboundMessages.
+func (mr *MockDataStoreMockRecorder) GetInboundMessages(ctx, option interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInboundMessages", reflect.TypeOf((*MockDataStore)(nil).GetInboundMessages), ctx, option)
+}
+
+// GetPendingRegistration mocks base method.
+func (m *MockDataStore) GetPendingRegistration(ctx context.Context, wechatID string) (datastore.Registration, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPendingRegistration", ctx, wechatID)
+	ret0, _ := ret[0].(datastore.Registration)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetPendingRegistration indicates an expected call of GetPendingRegistration.
+func (mr *MockDataStoreMockRecorder) GetPendingRegistration(ctx, wechatID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPendingRegistration", reflect.TypeOf((*MockDataStore)(nil).GetPendingRegistration), ctx, wechatID)
+}
+
+// GetRecords mocks base method.
+func (m *MockDataStore) GetRecords(ctx context.Context, option datastore.RecordQueryOption) ([]datastore.RecordInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRecords", ctx, option)
+	ret0, _ := ret[0].([]datastore.RecordInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRecords indicates an expected call of GetRecords.
+func (mr *MockDataStoreMockRecorder) GetRecords(ctx, option interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRecords", reflect.TypeOf((*MockDataStore)(nil).GetRecords), ctx, option)
+}
+
+// GetRecordsByIds mocks base method.
+func (m *MockDataStore) GetRecordsByIds(ctx context.Context, ids []int) ([]datastore.RecordInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRecordsByIds", ctx, ids)
+	ret0, _ := ret[0].([]datastore.RecordInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRecordsByIds indicates an expected call of GetRecordsByIds.
+func (mr *MockDataStoreMockRecorder) GetRecordsByIds(ctx, ids interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRecordsByIds", reflect.TypeOf((*MockDataStore)(nil).GetRecordsByIds), ctx, ids)
+}
+
+// GetRegistration mocks base method.
+func (m *MockDataStore) GetRegistration(ctx context.Context, id int) (datastore.Registration, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRegistration", ctx, id)
+	ret0, _ := ret[0].(datastore.Registration)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetRegistration indicates an expected call of GetRegistration.
+func (mr *MockDataStoreMockRecorder) GetRegistration(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRegistration", reflect.TypeOf((*MockDataStore)(nil).GetRegistration), ctx, id)
+}
+
+// GetRegistrations mocks base method.
+func (m *MockDataStore) GetRegistrations(ctx context.Context, status string, leaderID string) ([]datastore.Registration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRegistrations", ctx, status, leaderID)
+	ret0, _ := ret[0].([]datastore.Registration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRegistrations indicates an expected call of GetRegistrations.
+func (mr *MockDataStoreMockRecorder) GetRegistrations(ctx, status, leaderID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRegistrations", reflect.TypeOf((*MockDataStore)(nil).GetRegistrations), ctx, status, leaderID)
+}
+
+// GetToken mocks base method.
+func (m *MockDataStore) GetToken(ctx context.Context, name string) (datastore.AccessToken, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetToken", ctx, name)
+	ret0, _ := ret[0].(datastore.AccessToken)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetToken indicates an expected call of GetToken.
+func (mr *MockDataStoreMockRecorder) GetToken(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetToken", reflect.TypeOf((*MockDataStore)(nil).GetToken), ctx, name)
+}
+
 // GetUserById mocks base method.
 func (m *MockDataStore) GetUserById(ctx context.Context, id string) (datastore.UserInfo, bool, error) {
 	m.ctrl.T.Helper()
@@ -109,3 +371,136 @@ func (mr *MockDataStoreMockRecorder) GetUserById(ctx, id interface{}) *gomock.Ca
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserById", reflect.TypeOf((*MockDataStore)(nil).GetUserById), ctx, id)
 }
+
+// HashExists mocks base method.
+func (m *MockDataStore) HashExists(ctx context.Context, md5 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HashExists", ctx, md5)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HashExists indicates an expected call of HashExists.
+func (mr *MockDataStoreMockRecorder) HashExists(ctx, md5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HashExists", reflect.TypeOf((*MockDataStore)(nil).HashExists), ctx, md5)
+}
+
+// Ping mocks base method.
+func (m *MockDataStore) Ping(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ping", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ping indicates an expected call of Ping.
+func (mr *MockDataStoreMockRecorder) Ping(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockDataStore)(nil).Ping), ctx)
+}
+
+// PurgeInboundMessages mocks base method.
+func (m *MockDataStore) PurgeInboundMessages(ctx context.Context, before time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeInboundMessages", ctx, before)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeInboundMessages indicates an expected call of PurgeInboundMessages.
+func (mr *MockDataStoreMockRecorder) PurgeInboundMessages(ctx, before interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeInboundMessages", reflect.TypeOf((*MockDataStore)(nil).PurgeInboundMessages), ctx, before)
+}
+
+// ReviewRecord mocks base method.
+func (m *MockDataStore) ReviewRecord(ctx context.Context, id int, status string, reviewer string, reason string) (datastore.RecordInfo, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReviewRecord", ctx, id, status, reviewer, reason)
+	ret0, _ := ret[0].(datastore.RecordInfo)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ReviewRecord indicates an expected call of ReviewRecord.
+func (mr *MockDataStoreMockRecorder) ReviewRecord(ctx, id, status, reviewer, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReviewRecord", reflect.TypeOf((*MockDataStore)(nil).ReviewRecord), ctx, id, status, reviewer, reason)
+}
+
+// ReviewRegistration mocks base method.
+func (m *MockDataStore) ReviewRegistration(ctx context.Context, id int, status string, reviewer string) (datastore.Registration, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReviewRegistration", ctx, id, status, reviewer)
+	ret0, _ := ret[0].(datastore.Registration)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ReviewRegistration indicates an expected call of ReviewRegistration.
+func (mr *MockDataStoreMockRecorder) ReviewRegistration(ctx, id, status, reviewer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReviewRegistration", reflect.TypeOf((*MockDataStore)(nil).ReviewRegistration), ctx, id, status, reviewer)
+}
+
+// SaveToken mocks base method.
+func (m *MockDataStore) SaveToken(ctx context.Context, token datastore.AccessToken) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveToken", ctx, token)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveToken indicates an expected call of SaveToken.
+func (mr *MockDataStoreMockRecorder) SaveToken(ctx, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveToken", reflect.TypeOf((*MockDataStore)(nil).SaveToken), ctx, token)
+}
+
+// UpdateDeadLetter mocks base method.
+func (m *MockDataStore) UpdateDeadLetter(ctx context.Context, id int, from []string, status string, lastError string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDeadLetter", ctx, id, from, status, lastError)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateDeadLetter indicates an expected call of UpdateDeadLetter.
+func (mr *MockDataStoreMockRecorder) UpdateDeadLetter(ctx, id, from, status, lastError interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDeadLetter", reflect.TypeOf((*MockDataStore)(nil).UpdateDeadLetter), ctx, id, from, status, lastError)
+}
+
+// UpdateUserFollower mocks base method.
+func (m *MockDataStore) UpdateUserFollower(ctx context.Context, id string, nickname string, subscribed bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateUserFollower", ctx, id, nickname, subscribed)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateUserFollower indicates an expected call of UpdateUserFollower.
+func (mr *MockDataStoreMockRecorder) UpdateUserFollower(ctx, id, nickname, subscribed interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserFollower", reflect.TypeOf((*MockDataStore)(nil).UpdateUserFollower), ctx, id, nickname, subscribed)
+}
+
+// UpdateUserNotify mocks base method.
+func (m *MockDataStore) UpdateUserNotify(ctx context.Context, id string, mute bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateUserNotify", ctx, id, mute)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateUserNotify indicates an expected call of UpdateUserNotify.
+func (mr *MockDataStoreMockRecorder) UpdateUserNotify(ctx, id, mute interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserNotify", reflect.TypeOf((*MockDataStore)(nil).UpdateUserNotify), ctx, id, mute)
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrQuotaExceeded is returned by CreateRecord when a quota is used up, nothing is created then.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota caps the records created by the owners in a business day, duplicates are not counted.
+// CreateRecord fills Used with the records before the one it creates.
+type Quota struct {
+	// Key names the counter of the quota, e.g. user:<wechat_id>
+	Key    string
+	Limit  int
+	Owners []string // nil for all the users
+	Used   int
+}
+
+// QuotaUsage is the counter of a quota in a business day. It is locked while a record is
+// created, so the uploads at the same time can not go beyond the quota together.
+type QuotaUsage struct {
+	Key  string `gorm:"column:quota_key;size:256;primaryKey" json:"key"`
+	Day  string `gorm:"column:day;size:16;primaryKey" json:"day"`
+	Used int    `gorm:"column:used;not null" json:"used"`
+}
+
+const quotaDayLayout = "2006-01-02"
+
+/*
+ * quotas within the transaction of CreateRecord
+ */
+
+// useQuotas locks the counters in the order given, so the same quotas in the same order never
+// deadlock. A counter starts with the records of the day already there, e.g. the ones created
+// before the counters were kept.
+func useQuotas(tx *gorm.DB, option CreateRecordOption) error {
+	day := option.quotaFrom.Format(quotaDayLayout)
+	for _, quota := range option.quotas {
+		var usage QuotaUsage
+		result := tx.Where("quota_key=? AND day=?", quota.Key, day).Limit(1).Find(&usage)
+		if result.Error != nil {
+			return fmt.Errorf("fail to get usage of quota %s, %w", quota.Key, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			used, err := countQuota(tx, quota, option.quotaFrom, option.quotaTo)
+			if err != nil {
+				return err
+			}
+			usage = QuotaUsage{Key: quota.Key, Day: day, Used: int(used)}
+			if result := tx.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&usage); result.Error != nil {
+				return fmt.Errorf("fail to create usage of quota %s, %w", quota.Key, result.Error)
+			}
+		}
+
+		result = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("quota_key=? AND day=?", quota.Key, day).First(&usage)
+		if result.Error != nil {
+			return fmt.Errorf("fail to lock usage of quota %s, %w", quota.Key, result.Error)
+		}
+		quota.Used = usage.Used
+		if quota.Used >= quota.Limit {
+			return fmt.Errorf("%d of quota %s used, %w", quota.Used, quota.Key, ErrQuotaExceeded)
+		}
+	}
+	return nil
+}
+
+// countQuota counts the records submitted by the owners of the quota, duplicates are auto denied.
+func countQuota(tx *gorm.DB, quota *Quota, from, to time.Time) (int64, error) {
+	db := tx.Model(&RecordInfo{}).
+		Where("create_at >= ? AND create_at < ?", from, to).
+		Where("status >= ? AND status <= ?", denied, confirmed)
+	if quota.Owners != nil {
+		db = db.Where("owner_id IN ?", quota.Owners)
+	}
+	var used int64
+	if result := db.Count(&used); result.Error != nil {
+		return 0, fmt.Errorf("fail to count records of quota %s, %w", quota.Key, result.Error)
+	}
+	return used, nil
+}
+
+// incrQuotas counts the record created on the counters locked by useQuotas.
+func incrQuotas(tx *gorm.DB, option CreateRecordOption) error {
+	day := option.quotaFrom.Format(quotaDayLayout)
+	for _, quota := range option.quotas {
+		result := tx.Model(&QuotaUsage{}).Where("quota_key=? AND day=?", quota.Key, day).
+			UpdateColumn("used", gorm.Expr("used + 1"))
+		if result.Error != nil {
+			return fmt.Errorf("fail to count record on quota %s, %w", quota.Key, result.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RegistrationPending  = "pending"
+	RegistrationApproved = "approved"
+	RegistrationRejected = "rejected"
+
+	RegistrationByQRCode = "qrcode"
+	RegistrationByText   = "text"
+)
+
+// Registration is a pending user, it becomes a UserInfo once approved.
+type Registration struct {
+	ID         int       `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	WechatID   string    `gorm:"column:wechat_id;size:256;not null;index" json:"wechat_id"`
+	Name       string    `gorm:"size:128" json:"name"`
+	LeaderID   string    `gorm:"column:leader_id;size:128;index" json:"leader_id"`
+	Source     string    `gorm:"size:32;not null" json:"source"`
+	Status     string    `gorm:"size:32;not null" json:"status"`
+	ReviewedBy string    `gorm:"column:reviewed_by;size:256" json:"reviewed_by,omitempty"`
+	CreateAt   time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP;<-:create" json:"create_at"`
+	UpdatedAt  time.Time `gorm:"type:TIMESTAMP;default:CURRENT_TIMESTAMP on update current_timestamp" json:"updated_at"`
+	// PendingOf is the wechat id while pending and null after, mysql has no partial unique
+	// index, the unique null-able column keeps a user to one pending registration
+	PendingOf *string `gorm:"column:pending_of;size:256;uniqueIndex" json:"-"`
+}
+
+/*
+ * CURD for registrations
+ */
+
+// CreateRegistration creates a pending registration, false is returned with the pending one
+// if the user has applied already.
+func (store *mysqlDataStore) CreateRegistration(ctx context.Context, registration Registration) (Registration, bool, error) {
+	registration.Status = RegistrationPending
+	registration.PendingOf = &registration.WechatID
+	result := store.db.WithContext(ctx).Create(&registration)
+	if isDuplicateKey(result.Error) {
+		pending, ok, err := store.GetPendingRegistration(ctx, registration.WechatID)
+		if err != nil || !ok {
+			return registration, false, fmt.Errorf("fail to get the pending registration of %s, %v", registration.WechatID, err)
+		}
+		return pending, false, nil
+	}
+	if result.Error != nil {
+		return registration, false, fmt.Errorf("fail to create registration, %w", result.Error)
+	}
+	return registration, true, nil
+}
+
+func (store *mysqlDataStore) GetRegistration(ctx context.Context, id int) (Registration, bool, error) {
+	var registration Registration
+	result := store.db.WithContext(ctx).Where("id=?", id).First(&registration)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return registration, false, nil
+	}
+	return registration, result.Error == nil, result.Error
+}
+
+// GetPendingRegistration returns the latest pending registration of the wechat user.
+func (store *mysqlDataStore) GetPendingRegistration(ctx context.Context, wechatID string) (Registration, bool, error) {
+	var registration Registration
+	result := store.db.WithContext(ctx).
+		Where("wechat_id=? AND status=?", wechatID, RegistrationPending).
+		Order("id desc").
+		First(&registration)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return registration, false, nil
+	}
+	return registration, result.Error == nil, result.Error
+}
+
+// GetRegistrations lists registrations in the status, of all leaders when leaderID is empty.
+func (store *mysqlDataStore) GetRegistrations(ctx context.Context, status string, leaderID string) ([]Registration, error) {
+	var registrations []Registration
+
+	db := store.db.WithContext(ctx).Where("status=?", status)
+	if leaderID != "" {
+		db = db.Where("leader_id=?", leaderID)
+	}
+	if result := db.Order("id").Find(&registrations); result.Error != nil {
+		return nil, fmt.Errorf("fail to get registrations, %w", result.Error)
+	}
+	return registrations, nil
+}
+
+// ReviewRegistration approves or rejects a pending registration,
+// false is returned when there is no such registration pending.
+func (store *mysqlDataStore) ReviewRegistration(ctx context.Context, id int, status string, reviewer string) (Registration, bool, error) {
+	var registration Registration
+	if status != RegistrationApproved && status != RegistrationRejected {
+		return registration, false, fmt.Errorf("registration can only be %s or %s, got %s",
+			RegistrationApproved, RegistrationRejected, status)
+	}
+
+	db := store.db.WithContext(ctx)
+	result := db.Model(&Registration{}).
+		Where("id=? AND status=?", id, RegistrationPending).
+		Updates(map[string]interface{}{"status": status, "reviewed_by": reviewer, "pending_of": nil})
+	if result.Error != nil {
+		return registration, false, fmt.Errorf("fail to review registration %d, %w", id, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return registration, false, nil
+	}
+
+	if result := db.Where("id=?", id).First(&registration); result.Error != nil {
+		return registration, false, fmt.Errorf("fail to get reviewed registration %d, %w", id, result.Error)
+	}
+	return registration, true, nil
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AccessToken is a credential shared by all replicas, the lease elects
+// the only replica allowed to refresh it from wechat.
+type AccessToken struct {
+	Name        string    `gorm:"column:name;size:128;primaryKey;not null" json:"name"`
+	Token       string    `gorm:"column:token;size:1024" json:"token"`
+	ExpireAt    time.Time `gorm:"column:expire_at" json:"expire_at"`
+	FetchedAt   time.Time `gorm:"column:fetched_at" json:"fetched_at"`
+	LeaseHolder string    `gorm:"column:lease_holder;size:256" json:"lease_holder"`
+	LeaseUntil  time.Time `gorm:"column:lease_until" json:"lease_until"`
+}
+
+/*
+ * CURD for tokens
+ */
+
+func (store *mysqlDataStore) GetToken(ctx context.Context, name string) (AccessToken, bool, error) {
+	var token AccessToken
+	result := store.db.WithContext(ctx).Where("name=?", name).First(&token)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return token, false, nil
+	}
+	return token, result.Error == nil, result.Error
+}
+
+// SaveToken upserts the token value. A new row starts with the lease free, as mysql
+// rejects the zero time, an existing row keeps its lease columns untouched.
+func (store *mysqlDataStore) SaveToken(ctx context.Context, token AccessToken) error {
+	token.LeaseUntil = time.Now()
+	result := store.db.WithContext(ctx).Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"token", "expire_at", "fetched_at"}),
+	}).Create(&token)
+	if result.Error != nil {
+		return fmt.Errorf("fail to save token %s, %w", token.Name, result.Error)
+	}
+	return nil
+}
+
+// AcquireTokenLease grants the lease to holder if it is free, expired or already held by holder.
+func (store *mysqlDataStore) AcquireTokenLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	db := store.db.WithContext(ctx)
+	now := time.Now()
+
+	// make sure the row exists, so that the lease can be taken by a conditional update
+	if result := db.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&AccessToken{
+		Name:       name,
+		ExpireAt:   now,
+		FetchedAt:  now,
+		LeaseUntil: now,
+	}); result.Error != nil {
+		return false, fmt.Errorf("fail to init token row %s, %w", name, result.Error)
+	}
+
+	result := db.Model(&AccessToken{}).
+		Where("name = ? AND (lease_holder = ? OR lease_until < ?)", name, holder, now).
+		Updates(map[string]interface{}{
+			"lease_holder": holder,
+			"lease_until":  now.Add(ttl),
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("fail to acquire lease of token %s, %w", name, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// unmatchedRoute keeps scans of random paths from growing the series
+const unmatchedRoute = "unmatched"
+
+var (
+	httpRequests = NewCounterVec("wechat_http_requests_total",
+		"HTTP requests by route and status.", "method", "route", "status")
+	httpLatency = NewHistogramVec("wechat_http_request_duration_seconds",
+		"Latency of HTTP requests by route.", nil, "method", "route")
+)
+
+// Middleware counts the requests by the route pattern, e.g. /internal/api/v1/records/:id/review.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		httpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		httpLatency.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
+// Handler serves Default in the prometheus text format.
+func Handler() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Header("Content-Type", contentType)
+		context.Status(http.StatusOK)
+		if err := Default.Write(context.Writer); err != nil {
+			logrus.WithField("comp", "metrics").Errorf("fail to write metrics, %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Package metrics exposes counters, histograms and gauges in the prometheus text format.
+// It covers what the portal needs, labels are given by value in the order they are declared.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	// labelSeparator joins the label values into the key of a series, it never shows in a value
+	labelSeparator = "\xff"
+)
+
+// DefBuckets are the latency buckets in seconds, the same as the prometheus client.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry served by Handler.
+var Default = NewRegistry()
+
+type sample struct {
+	suffix string // _bucket, _sum or _count of histograms
+	labels []string
+	values []string
+	value  float64
+}
+
+type family interface {
+	describe() (name, help, typ string)
+	collect() []sample
+}
+
+type Registry struct {
+	mutex    sync.RWMutex
+	families map[string]family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// register replaces the family of the same name, constructing a component twice,
+// as the tests do, keeps the latest.
+func (r *Registry) register(f family) {
+	name, _, _ := f.describe()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families[name] = f
+}
+
+// Write renders the families sorted by name, the series sorted by labels.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.RLock()
+	families := make([]family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.RUnlock()
+	sort.Slice(families, func(i, j int) bool {
+		a, _, _ := families[i].describe()
+		b, _, _ := families[j].describe()
+		return a < b
+	})
+
+	var sb strings.Builder
+	for _, f := range families {
+		name, help, typ := f.describe()
+		samples := f.collect()
+		if len(samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+		for _, s := range samples {
+			sb.WriteString(name + s.suffix)
+			writeLabels(&sb, s.labels, s.values)
+			sb.WriteString(" " + formatValue(s.value) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeLabels(sb *strings.Builder, labels, values []string) {
+	if len(labels) == 0 {
+		return
+	}
+	sb.WriteString("{")
+	for i, label := range labels {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+	}
+	sb.WriteString("}")
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) describe() (string, string, string) {
+	return d.name, d.help, d.typ
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+/* Counter */
+
+type CounterVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec registers a counter to Default, the name should end with _total.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, typ: typeCounter, labels: labels}, values: make(map[string]float64)}
+	Default.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can not decrease", c.name))
+	}
+	key := c.key(values)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+// Value is for tests.
+func (c *CounterVec) Value(values ...string) float64 {
+	key := c.key(values)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) collect() []sample {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var samples []sample
+	for _, key := range sortedKeys(c.values) {
+		samples = append(samples, sample{labels: c.labels, values: splitKey(key, len(c.labels)), value: c.values[key]})
+	}
+	return samples
+}
+
+/* Histogram */
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogram
+}
+
+// NewHistogramVec registers a histogram to Default, DefBuckets are used if buckets is empty.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: typeHistogram, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	Default.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.values[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = series
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		series.counts[i]++
+	}
+	series.sum += v
+	series.count++
+}
+
+// Count is for tests.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if series, ok := h.values[key]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) collect() []sample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	var samples []sample
+	for _, key := range sortedKeys(h.values) {
+		series, values := h.values[key], splitKey(key, len(h.labels))
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			samples = append(samples, sample{suffix: "_bucket", labels: bucketLabels,
+				values: append(append([]string(nil), values...), formatValue(bound)), value: float64(cumulative)})
+		}
+		samples = append(samples,
+			sample{suffix: "_bucket", labels: bucketLabels,
+				values: append(append([]string(nil), values...), "+Inf"), value: float64(series.count)},
+			sample{suffix: "_sum", labels: h.labels, values: values, value: series.sum},
+			sample{suffix: "_count", labels: h.labels, values: values, value: float64(series.count)},
+		)
+	}
+	return samples
+}
+
+/* Func */
+
+// FuncVec reads the values when scraped, for what is kept elsewhere, e.g. the size of a cache.
+type FuncVec struct {
+	desc
+	mutex sync.Mutex
+	funcs map[string]func() (float64, bool)
+}
+
+// NewGaugeFunc registers a gauge to Default, the series are given by Set.
+func NewGaugeFunc(name, help string, labels ...string) *FuncVec {
+	f := &FuncVec{desc: desc{name: name, help: help, typ: typeGauge, labels: labels}, funcs: make(map[string]func() (float64, bool))}
+	Default.register(f)
+	return f
+}
+
+// NewCounterFunc registers a counter kept elsewhere, e.g. the wait count of the sql pool.
+func NewCounterFunc(name, help string, labels ...string) *FuncVec {
+	f := NewGaugeFunc(name, help, labels...)
+	f.typ = typeCounter
+	return f
+}
+
+// Set replaces the function of a series, the series is skipped while fn returns false.
+func (f *FuncVec) Set(fn func() (float64, bool), values ...string) {
+	key := f.key(values)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.funcs[key] = fn
+}
+
+func (f *FuncVec) collect() []sample {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var samples []sample
+	for _, key := range sortedKeys(f.funcs) {
+		if v, ok := f.funcs[key](); ok {
+			samples = append(samples, sample{labels: f.labels, values: splitKey(key, len(f.labels)), value: v})
+		}
+	}
+	return samples
+}
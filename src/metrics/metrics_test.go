@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	rq := require.New(t)
+	defer func(registry *Registry) { Default = registry }(Default)
+	Default = NewRegistry()
+
+	counter := NewCounterVec("test_events_total", "Events.", "kind")
+	counter.Inc("b")
+	counter.Add(2, `a"1`)
+	histogram := NewHistogramVec("test_latency_seconds", "Latency\nof tests.", []float64{1, 0.1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+	gauge := NewGaugeFunc("test_size", "Size.", "name")
+	gauge.Set(func() (float64, bool) { return 7, true }, "x")
+	gauge.Set(func() (float64, bool) { return 0, false }, "skipped")
+	NewGaugeFunc("test_empty", "Nothing is written.")
+
+	var sb strings.Builder
+	rq.NoError(Default.Write(&sb))
+	rq.Equal(`# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total{kind="a\"1"} 2
+test_events_total{kind="b"} 1
+# HELP test_latency_seconds Latency\nof tests.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.55
+test_latency_seconds_count 3
+# HELP test_size Size.
+# TYPE test_size gauge
+test_size{name="x"} 7
+`, sb.String())
+
+	rq.Panics(func() { counter.Inc() }, "label values missing")
+	rq.Panics(func() { counter.Add(-1, "a") }, "counter decreased")
+}
+
+func TestMiddleware(t *testing.T) {
+	rq := require.New(t)
+	gin.SetMode(gin.TestMode)
+
+	eng := gin.New()
+	eng.Use(Middleware())
+	eng.GET("/records/:id", func(context *gin.Context) { context.Status(http.StatusNoContent) })
+	eng.GET("/metrics", Handler())
+
+	before := httpRequests.Value(http.MethodGet, "/records/:id", "204")
+	unmatched := httpRequests.Value(http.MethodGet, unmatchedRoute, "404")
+	for _, path := range []string{"/records/1", "/records/2", "/nothing"} {
+		eng.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	rq.Equal(before+2, httpRequests.Value(http.MethodGet, "/records/:id", "204"))
+	rq.Equal(unmatched+1, httpRequests.Value(http.MethodGet, unmatchedRoute, "404"))
+
+	w := httptest.NewRecorder()
+	eng.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	rq.Equal(http.StatusOK, w.Code)
+	rq.Equal(contentType, w.Header().Get("Content-Type"))
+	rq.Contains(w.Body.String(), `wechat_http_request_duration_seconds_count{method="GET",route="/records/:id"}`)
+}
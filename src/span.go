@@ -0,0 +1,240 @@
+package src
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentHeader = "traceparent"
+
+	SpanKindInternal = "internal"
+	SpanKindServer   = "server"
+	SpanKindClient   = "client"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+// SpanContext is what crosses process boundaries in the traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Traceparent encodes the span context as https://www.w3.org/TR/trace-context/.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent returns false for a malformed header, the trace starts over then.
+// Versions after 00 may append fields, only the first four are read.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != len(sc.TraceID) || len(parts[1]) != 32 {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != len(sc.SpanID) || len(parts[2]) != 16 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 || !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	return sc, true
+}
+
+type spanKey struct{}
+
+// Span is one timed operation of a trace, exported when it ends if the trace is sampled.
+// The methods are safe on a nil span.
+type Span struct {
+	mutex  sync.Mutex
+	name   string
+	kind   string
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+	attrs  map[string]string
+	err    string
+	ended  bool
+}
+
+// StartSpan starts a child of the span in ctx, or a new trace if there is none.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, SpanKindInternal, nil)
+}
+
+// StartClientSpan is for calls to other services, the ctx should be used by the request.
+func StartClientSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, SpanKindClient, nil)
+}
+
+// StartServerSpan continues the trace of remote, which is nil when the caller did not send one.
+func StartServerSpan(ctx context.Context, name string, remote *SpanContext) (context.Context, *Span) {
+	return startSpan(ctx, name, SpanKindServer, remote)
+}
+
+func startSpan(ctx context.Context, name, kind string, remote *SpanContext) (context.Context, *Span) {
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+
+	parent, ok := ctx.Value(spanKey{}).(SpanContext)
+	if remote != nil {
+		parent, ok = *remote, true
+	}
+	if ok {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		span.sc.TraceID = newTraceID()
+		span.sc.Sampled = true
+	}
+	span.sc.SpanID = newSpanID()
+
+	ctx = context.WithValue(ctx, spanKey{}, span.sc)
+	return context.WithValue(ctx, traceIdKey{}, span.sc.TraceID.String()), span
+}
+
+// SpanContextFromContext returns false if no span was started in ctx.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// InjectTraceparent propagates the span of ctx to an internal service.
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		header.Set(traceparentHeader, sc.Traceparent())
+	}
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetName renames the span, e.g. once the route of a request is known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.name = name
+}
+
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span failed, a nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err.Error()
+}
+
+// End exports the span, ending it twice is a no-op.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        end,
+		Attributes: make(map[string]string, len(s.attrs)),
+		Error:      s.err,
+	}
+	for key, value := range s.attrs {
+		data.Attributes[key] = value
+	}
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	s.mutex.Unlock()
+
+	if s.sc.Sampled {
+		exportSpan(data)
+	}
+}
+
+// RecordSpan records an operation which is already done, e.g. a sql statement
+// reported by the gorm logger. attrs are key value pairs.
+func RecordSpan(ctx context.Context, name string, start, end time.Time, err error, attrs ...string) {
+	_, span := StartSpan(ctx, name)
+	span.start = start
+	for i := 0; i+1 < len(attrs); i += 2 {
+		span.SetAttr(attrs[i], attrs[i+1])
+	}
+	span.SetError(err)
+	span.EndAt(end)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
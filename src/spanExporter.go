@@ -0,0 +1,319 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+const (
+	ExporterOtlp = "otlp"
+	ExporterFile = "file"
+
+	spanQueueSize     = 2048
+	spanBatchSize     = 256
+	spanFlushInterval = 5 * time.Second
+	otlpTimeout       = 10 * time.Second
+	otlpTracesPath    = "/v1/traces"
+)
+
+var exporterTracer = logrus.WithField("comp", "span_exporter")
+
+var droppedSpans = metrics.NewCounterVec("wechat_tracing_dropped_spans_total",
+	"Spans dropped because the export queue is full or the export failed.")
+
+// SpanData is a span ended, also the line format of the file exporter.
+type SpanData struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type SpanExporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Close() error
+}
+
+var (
+	processorMutex sync.RWMutex
+	processor      *spanProcessor
+)
+
+func exportSpan(span SpanData) {
+	processorMutex.RLock()
+	defer processorMutex.RUnlock()
+	if processor != nil {
+		processor.enqueue(span)
+	}
+}
+
+// InitTracing starts exporting the spans, spans are only kept in ctx for the trace id if
+// no exporter is configured. The returned func flushes the spans queued and stops.
+func InitTracing(cfg TracingConfig) (func(), error) {
+	var exporter SpanExporter
+	switch cfg.Exporter {
+	case "":
+		return func() {}, nil
+	case ExporterOtlp:
+		exporter = NewOtlpExporter(cfg.OtlpEndpoint, cfg.ServiceName)
+	case ExporterFile:
+		file, err := os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("fail to open span file, %w", err)
+		}
+		exporter = NewFileExporter(file)
+	default:
+		return nil, fmt.Errorf("unknown span exporter %s", cfg.Exporter)
+	}
+	return SetSpanExporter(exporter), nil
+}
+
+// SetSpanExporter replaces the exporter, the returned func flushes and closes it.
+func SetSpanExporter(exporter SpanExporter) func() {
+	p := newSpanProcessor(exporter)
+
+	processorMutex.Lock()
+	previous := processor
+	processor = p
+	processorMutex.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+
+	return func() {
+		processorMutex.Lock()
+		if processor == p {
+			processor = nil
+		}
+		processorMutex.Unlock()
+		p.stop()
+	}
+}
+
+// spanProcessor exports the spans in batches off the request path, spans are dropped
+// rather than blocking when the exporter can not keep up.
+type spanProcessor struct {
+	exporter SpanExporter
+	queue    chan SpanData
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newSpanProcessor(exporter SpanExporter) *spanProcessor {
+	p := &spanProcessor{
+		exporter: exporter,
+		queue:    make(chan SpanData, spanQueueSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *spanProcessor) enqueue(span SpanData) {
+	select {
+	case p.queue <- span:
+	default:
+		droppedSpans.Inc()
+	}
+}
+
+func (p *spanProcessor) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, spanBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+		defer cancel()
+		if err := p.exporter.Export(ctx, batch); err != nil {
+			droppedSpans.Add(float64(len(batch)))
+			exporterTracer.Warningf("fail to export %d spans, %s", len(batch), err.Error())
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// stop is called once nothing enqueues any more, see SetSpanExporter.
+func (p *spanProcessor) stop() {
+	p.stopOnce.Do(func() {
+		close(p.queue)
+		<-p.done
+		if err := p.exporter.Close(); err != nil {
+			exporterTracer.Warningf("fail to close span exporter, %s", err.Error())
+		}
+	})
+}
+
+/* file */
+
+type fileExporter struct {
+	mutex sync.Mutex
+	w     io.WriteCloser
+}
+
+// NewFileExporter writes a json line per span.
+func NewFileExporter(w io.WriteCloser) SpanExporter {
+	return &fileExporter{w: w}
+}
+
+func (fe *fileExporter) Export(_ context.Context, spans []SpanData) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return fmt.Errorf("fail to encode span, %w", err)
+		}
+	}
+
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	if _, err := fe.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("fail to write spans, %w", err)
+	}
+	return nil
+}
+
+func (fe *fileExporter) Close() error {
+	return fe.w.Close()
+}
+
+/* otlp */
+
+// otlpExporter posts OTLP/HTTP json, https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type otlpExporter struct {
+	client      *http.Client
+	url         string
+	serviceName string
+}
+
+func NewOtlpExporter(endpoint, serviceName string) SpanExporter {
+	return &otlpExporter{
+		client:      &http.Client{Timeout: otlpTimeout},
+		url:         strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		serviceName: serviceName,
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+var otlpKinds = map[string]int{SpanKindInternal: 1, SpanKindServer: 2, SpanKindClient: 3}
+
+func (oe *otlpExporter) Export(ctx context.Context, spans []SpanData) error {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              otlpKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		for key, value := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		converted = append(converted, s)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: oe.serviceName}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/hanzezhenalex/wechat"},
+				"spans": converted,
+			}},
+		}},
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("fail to encode spans, %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oe.url, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("fail to create req to otlp collector, %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := oe.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to send spans to otlp collector, %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("otlp collector responded %d, %s", resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+func (oe *otlpExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	rq := require.New(t)
+
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rq.True(ok)
+	rq.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	rq.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	rq.True(sc.Sampled)
+	rq.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// a later version may add fields
+	sc, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	rq.True(ok)
+	rq.False(sc.Sampled)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(header)
+		rq.False(ok, header)
+	}
+}
+
+type bufferCloser struct {
+	mutex sync.Mutex
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func TestSpanExport(t *testing.T) {
+	rq := require.New(t)
+	gin.SetMode(gin.TestMode)
+
+	buf := &bufferCloser{}
+	stop := SetSpanExporter(NewFileExporter(buf))
+
+	eng := gin.New()
+	eng.Use(TracerMiddleware())
+	eng.GET("/records/:id", func(c *gin.Context) {
+		ctx, span := StartSpan(c.Request.Context(), "dedup.handle")
+		RecordSpan(ctx, "sql", time.Now().Add(-time.Millisecond), time.Now(), errors.New("deadlock"),
+			"db.statement", "SELECT 1")
+		span.End()
+		c.String(http.StatusInternalServerError, GetTraceId(ctx))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/records/1", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	eng.ServeHTTP(w, req)
+	rq.Equal("4bf92f3577b34da6a3ce929d0e0e4736", w.Body.String(), "the trace id goes to the reply")
+
+	// not sampled by the caller
+	req = httptest.NewRequest(http.MethodGet, "/records/2", nil)
+	req.Header.Set(traceparentHeader, "00-11111111111111111111111111111111-00f067aa0ba902b7-00")
+	eng.ServeHTTP(httptest.NewRecorder(), req)
+
+	stop()
+	spans := make(map[string]SpanData)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var span SpanData
+		rq.NoError(json.Unmarshal([]byte(line), &span))
+		rq.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		spans[span.Name] = span
+	}
+	rq.Len(spans, 3)
+
+	server := spans["GET /records/:id"]
+	rq.Equal(SpanKindServer, server.Kind)
+	rq.Equal("00f067aa0ba902b7", server.ParentSpanID)
+	rq.Equal("500", server.Attributes["http.status_code"])
+	rq.NotEmpty(server.Error)
+	rq.Equal(server.SpanID, spans["dedup.handle"].ParentSpanID)
+	rq.Equal(spans["dedup.handle"].SpanID, spans["sql"].ParentSpanID)
+	rq.Equal("deadlock", spans["sql"].Error)
+	rq.Equal("SELECT 1", spans["sql"].Attributes["db.statement"])
+}
+
+func TestOtlpExporter(t *testing.T) {
+	rq := require.New(t)
+
+	type export struct {
+		path string
+		body map[string]interface{}
+		err  error
+	}
+	exports := make(chan export, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := export{path: r.URL.Path}
+		got.err = json.NewDecoder(r.Body).Decode(&got.body)
+		exports <- got
+	}))
+	defer collector.Close()
+
+	exporter := NewOtlpExporter(collector.URL+"/", "wechat")
+	_, span := StartClientSpan(DetachContext(context.Background()), "wechat.api /cgi-bin/user/get")
+	span.SetError(errors.New("timeout"))
+	span.End()
+	rq.NoError(exporter.Export(context.Background(), []SpanData{{
+		TraceID: span.SpanContext().TraceID.String(), SpanID: span.SpanContext().SpanID.String(),
+		Name: "wechat.api /cgi-bin/user/get", Kind: SpanKindClient, Start: time.Unix(1, 0), End: time.Unix(2, 0),
+		Error: "timeout",
+	}}))
+
+	got := <-exports
+	rq.Equal(otlpTracesPath, got.path)
+	rq.NoError(got.err)
+	raw, err := json.Marshal(got.body)
+	rq.NoError(err)
+	for _, part := range []string{`"stringValue":"wechat"`, `"kind":3`, `"startTimeUnixNano":"1000000000"`,
+		`"status":{"code":2,"message":"timeout"}`} {
+		rq.Contains(string(raw), part)
+	}
+}
@@ -2,10 +2,12 @@ package src
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -46,10 +48,17 @@ func (hook TraceHooker) Fire(entry *logrus.Entry) error {
 	return nil
 }
 
+// TracerMiddleware starts the server span of the request, continuing the trace of the
+// traceparent header if the caller sent a valid one. The trace id goes into every log entry.
 func TracerMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), traceIdKey{}, uuid.NewV4().String())
+		var remote *SpanContext
+		if sc, ok := ParseTraceparent(c.GetHeader(traceparentHeader)); ok {
+			remote = &sc
+		}
+		ctx, span := StartServerSpan(c.Request.Context(), c.Request.Method+" "+c.Request.URL.Path, remote)
 		c.Request = c.Request.WithContext(ctx)
+		defer span.End()
 
 		startTime := time.Now()
 		reqMethod := c.Request.Method
@@ -65,6 +74,17 @@ func TracerMiddleware() gin.HandlerFunc {
 		statusCode := c.Writer.Status()
 
 		logger.Infof("[RESP] %d | %s | %s", statusCode, latencyTime, reqUrl)
+
+		// the route pattern keeps the span names few, the path is kept as an attribute
+		if route := c.FullPath(); route != "" {
+			span.SetName(reqMethod + " " + route)
+		}
+		span.SetAttr("http.method", reqMethod)
+		span.SetAttr("http.target", c.Request.URL.Path)
+		span.SetAttr("http.status_code", strconv.Itoa(statusCode))
+		if statusCode >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("http status %d", statusCode))
+		}
 	}
 }
 
@@ -75,3 +95,12 @@ func GetTraceId(ctx context.Context) string {
 	}
 	return "unknown"
 }
+
+// DetachContext keeps the trace id and the span of ctx for work that outlives the request.
+func DetachContext(ctx context.Context) context.Context {
+	detached := context.WithValue(context.Background(), traceIdKey{}, GetTraceId(ctx))
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		detached = context.WithValue(detached, spanKey{}, sc)
+	}
+	return detached
+}
@@ -0,0 +1,157 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+)
+
+const (
+	errCodeInvalidCredential = 40001
+	errCodeInvalidToken      = 40014
+	errCodeTokenExpired      = 42001
+	errCodeMenuNotExist      = 46003
+)
+
+var apiTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "wechat_api").WithContext(ctx)
+}
+
+// ApiError is the error body every wechat api may return.
+type ApiError struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (e ApiError) Error() string {
+	return fmt.Sprintf("wechat api error, errcode=%d, errmsg=%s", e.ErrCode, e.ErrMsg)
+}
+
+func (e ApiError) tokenRejected() bool {
+	return e.ErrCode == errCodeInvalidCredential || e.ErrCode == errCodeInvalidToken || e.ErrCode == errCodeTokenExpired
+}
+
+// apiClient calls wechat apis with the access token kept by tokenManager,
+// a rejected token is refreshed and the call retried once.
+type apiClient struct {
+	client  *http.Client
+	baseUrl string
+	tm      *tokenManager
+}
+
+func newApiClient(cfg src.Config, tm *tokenManager) *apiClient {
+	return &apiClient{
+		client:  &http.Client{Timeout: fetchTimeout},
+		baseUrl: cfg.ApiBaseUrl,
+		tm:      tm,
+	}
+}
+
+func (api *apiClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return api.call(ctx, http.MethodGet, path, query, nil, out)
+}
+
+func (api *apiClient) post(ctx context.Context, path string, body interface{}, out interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("fail to encode req body of %s, %w", path, err)
+	}
+	return api.call(ctx, http.MethodPost, path, nil, raw, out)
+}
+
+// sendText sends a customer service message, wechat only delivers it
+// within 48 hours after the user last talked to the account.
+func (api *apiClient) sendText(ctx context.Context, to, content string) error {
+	return api.post(ctx, "/cgi-bin/message/custom/send", map[string]interface{}{
+		"touser":  to,
+		"msgtype": msgText,
+		"text":    map[string]string{"content": content},
+	}, nil)
+}
+
+func (api *apiClient) call(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	err := api.do(ctx, method, path, query, body, out)
+
+	if apiErr, ok := err.(ApiError); ok && apiErr.tokenRejected() {
+		apiTracer(ctx).Warningf("access token rejected by %s, refresh and retry, %s", path, apiErr.Error())
+		if _, err := api.tm.Refresh(ctx); err != nil {
+			return fmt.Errorf("fail to refresh rejected access token, %w", err)
+		}
+		err = api.do(ctx, method, path, query, body, out)
+	}
+	return err
+}
+
+// do is an attempt of call, traced as a client span.
+func (api *apiClient) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	ctx, span := src.StartClientSpan(ctx, "wechat.api "+path)
+	defer span.End()
+	span.SetAttr("http.method", method)
+
+	err := api.send(ctx, method, path, query, body, out)
+	if apiErr, ok := err.(ApiError); ok {
+		span.SetAttr("wechat.errcode", strconv.Itoa(apiErr.ErrCode))
+	}
+	span.SetError(err)
+	return err
+}
+
+func (api *apiClient) send(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	token, err := api.tm.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("fail to get access token, %w", err)
+	}
+
+	values := url.Values{}
+	for k, v := range query {
+		values[k] = v
+	}
+	values.Set("access_token", token)
+	target := api.baseUrl + path + "?" + values.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return fmt.Errorf("fail to create req for %s, %w", path, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to send req to %s, %w", path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read resp of %s, %w", path, err)
+	}
+
+	var apiErr ApiError
+	if err := json.Unmarshal(raw, &apiErr); err != nil {
+		return fmt.Errorf("fail to decode resp of %s, %w", path, err)
+	}
+	if apiErr.ErrCode != 0 {
+		return apiErr
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return fmt.Errorf("fail to decode resp of %s, %w", path, err)
+		}
+	}
+	return nil
+}
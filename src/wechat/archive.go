@@ -0,0 +1,213 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+const (
+	archiveQueueSize     = 512
+	archiveWriteTimeout  = 3 * time.Second
+	archivePurgeInterval = time.Hour
+
+	archived        = "archived"
+	archiveDropped  = "dropped"
+	archiveFailed   = "error"
+	archivePurged   = "purged"
+	archiveFromDays = 1
+)
+
+var archiveTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "archive").WithContext(ctx)
+}
+
+var archiveMessages = metrics.NewCounterVec("wechat_archive_messages_total",
+	"Inbound messages by result, archived, dropped as the queue is full, error or purged.", "result")
+
+// Archive keeps every payload pushed to the portal with its headers, trace id, reply and
+// outcome. They are written in the background not to hold the reply, and purged after
+// the retention.
+type Archive struct {
+	store     datastore.DataStore
+	enabled   bool
+	retention time.Duration
+
+	queue  chan datastore.InboundMessage
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newArchive(cfg src.ArchiveConfig, store datastore.DataStore) *Archive {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Archive{
+		store:     store,
+		enabled:   cfg.Enabled,
+		retention: time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+		queue:     make(chan datastore.InboundMessage, archiveQueueSize),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	if a.enabled {
+		go a.daemon(ctx)
+	} else {
+		close(a.done)
+	}
+	return a
+}
+
+func (a *Archive) daemon(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(archivePurgeInterval)
+	defer ticker.Stop()
+
+	a.purge(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			// the messages queued are still written, within their own timeout
+			for {
+				select {
+				case msg := <-a.queue:
+					a.write(context.Background(), msg)
+				default:
+					return
+				}
+			}
+		case msg := <-a.queue:
+			a.write(ctx, msg)
+		case <-ticker.C:
+			a.purge(ctx)
+		}
+	}
+}
+
+// Stop writes the messages queued and stops the purge.
+func (a *Archive) Stop() {
+	a.cancel()
+	<-a.done
+}
+
+// add queues the payload to be archived, it is dropped if the queue is full.
+func (a *Archive) add(ctx context.Context, header http.Header, body []byte, msg Message, reply, outcome string) {
+	if !a.enabled {
+		return
+	}
+	headers, err := json.Marshal(header)
+	if err != nil {
+		archiveTracer(ctx).Warningf("fail to encode headers, %s", err.Error())
+	}
+
+	select {
+	case a.queue <- datastore.InboundMessage{
+		WechatID: msg.FromUserName,
+		MsgType:  msg.MsgType,
+		Body:     string(body),
+		Headers:  string(headers),
+		TraceID:  src.GetTraceId(ctx),
+		Reply:    reply,
+		Outcome:  outcome,
+	}:
+	default:
+		archiveMessages.Inc(archiveDropped)
+		archiveTracer(ctx).Warningf("archive queue is full, message of %s dropped", msg.FromUserName)
+	}
+}
+
+func (a *Archive) write(ctx context.Context, msg datastore.InboundMessage) {
+	ctx, cancel := context.WithTimeout(ctx, archiveWriteTimeout)
+	defer cancel()
+
+	if _, err := a.store.CreateInboundMessage(ctx, msg); err != nil {
+		archiveMessages.Inc(archiveFailed)
+		archiveTracer(ctx).WithField("trace_id", msg.TraceID).Errorf("fail to archive message of %s, %s", msg.WechatID, err.Error())
+		return
+	}
+	archiveMessages.Inc(archived)
+}
+
+func (a *Archive) purge(ctx context.Context) {
+	purged, err := a.store.PurgeInboundMessages(ctx, time.Now().Add(-a.retention))
+	if err != nil {
+		archiveTracer(ctx).Errorf("fail to purge archived messages, %s", err.Error())
+		return
+	}
+	archiveMessages.Add(float64(purged), archivePurged)
+	if purged > 0 {
+		archiveTracer(ctx).Infof("%d archived messages purged", purged)
+	}
+}
+
+func (a *Archive) RegisterEndpoints(group *gin.RouterGroup) {
+	// from and to are RFC3339, the last day by default, see InboundQueryOption for the rest
+	group.GET("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		now := time.Now()
+		from, err := src.ParseTime(context.Query("from"), now.AddDate(0, 0, -archiveFromDays))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		to, err := src.ParseTime(context.Query("to"), now)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+		after, err := strconv.Atoi(context.DefaultQuery("after", "0"))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid after"})
+			return
+		}
+		limit, err := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		option := datastore.NewInboundQueryOption(from, to).
+			WithUser(context.Query("wechat_id")).
+			WithOutcome(context.Query("outcome")).
+			After(after).
+			WithLimit(limit)
+		msgs, err := a.store.GetInboundMessages(ctx, option)
+		if err != nil {
+			archiveTracer(ctx).Errorf("fail to get archived messages, %s", err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if msgs == nil {
+			msgs = []datastore.InboundMessage{}
+		}
+		context.JSON(http.StatusOK, msgs)
+	})
+
+	group.GET("/:id", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		id, err := strconv.Atoi(context.Param("id"))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		msg, ok, err := a.store.GetInboundMessage(ctx, id)
+		switch {
+		case err != nil:
+			archiveTracer(ctx).Errorf("fail to get archived message %d, %s", id, err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case !ok:
+			context.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("archived message %d not found", id)})
+		default:
+			context.JSON(http.StatusOK, msg)
+		}
+	})
+}
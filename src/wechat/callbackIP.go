@@ -0,0 +1,269 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+)
+
+const (
+	rejectIP = "ip"
+
+	callbackIPTimeout = time.Minute
+)
+
+var callbackIPTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "callback_ip").WithContext(ctx)
+}
+
+type callbackIPResp struct {
+	IPList []string `json:"ip_list"`
+}
+
+// callbackIPCache is the file of the fetched ips.
+type callbackIPCache struct {
+	IPList    []string  `json:"ip_list"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// CallbackIPs keeps the portal to the servers of wechat, the ips are fetched from getcallbackip
+// periodically and cached in a file, so a restart accepts wechat before the token is ready.
+type CallbackIPs struct {
+	enabled bool
+	api     *apiClient
+	path    string
+	static  []*net.IPNet
+
+	mutex     sync.RWMutex
+	fetched   []*net.IPNet
+	fetchedAt time.Time
+	lastError string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newCallbackIPs(cfg src.PortalConfig, api *apiClient) (*CallbackIPs, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ips := &CallbackIPs{
+		enabled: cfg.IPAllowlist,
+		api:     api,
+		path:    cfg.CallbackIPFile,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	for _, cidr := range cfg.AllowedCIDRs {
+		network, err := src.ParseCIDR(cidr)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("fail to parse allowed cidrs, %w", err)
+		}
+		ips.static = append(ips.static, network)
+	}
+
+	if !ips.enabled {
+		close(ips.done)
+		return ips, nil
+	}
+	if err := ips.load(); err != nil {
+		callbackIPTracer(ctx).Warningf("fail to load cached callback ips, %s", err.Error())
+	}
+	go ips.daemon(ctx, time.Duration(cfg.CallbackIPRefreshHours)*time.Hour)
+	return ips, nil
+}
+
+func (ips *CallbackIPs) daemon(ctx context.Context, interval time.Duration) {
+	defer close(ips.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, callbackIPTimeout)
+		if err := ips.Refresh(refreshCtx); err != nil {
+			callbackIPTracer(ctx).Errorf("fail to refresh callback ips, %s", err.Error())
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop cancels the periodic refresh and waits for it.
+func (ips *CallbackIPs) Stop() {
+	ips.cancel()
+	<-ips.done
+}
+
+// Refresh fetches the ips from wechat, the ones known are kept if it fails.
+func (ips *CallbackIPs) Refresh(ctx context.Context) error {
+	var resp callbackIPResp
+	err := ips.api.get(ctx, "/cgi-bin/getcallbackip", nil, &resp)
+	if err == nil && len(resp.IPList) == 0 {
+		err = fmt.Errorf("getcallbackip returned no ip")
+	}
+	var networks []*net.IPNet
+	if err == nil {
+		networks, err = parseIPList(resp.IPList)
+	}
+	if err != nil {
+		ips.mutex.Lock()
+		ips.lastError = err.Error()
+		ips.mutex.Unlock()
+		return err
+	}
+
+	cache := callbackIPCache{IPList: resp.IPList, FetchedAt: time.Now()}
+	ips.mutex.Lock()
+	ips.fetched, ips.fetchedAt, ips.lastError = networks, cache.FetchedAt, ""
+	ips.mutex.Unlock()
+	callbackIPTracer(ctx).Infof("%d callback ips fetched", len(networks))
+
+	if err := ips.save(cache); err != nil {
+		callbackIPTracer(ctx).Warningf("fail to cache callback ips, %s", err.Error())
+	}
+	return nil
+}
+
+func (ips *CallbackIPs) load() error {
+	raw, err := os.ReadFile(ips.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to read callback ip file, %w", err)
+	}
+	var cache callbackIPCache
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return fmt.Errorf("fail to decode callback ip file, %w", err)
+	}
+	networks, err := parseIPList(cache.IPList)
+	if err != nil {
+		return err
+	}
+
+	ips.mutex.Lock()
+	defer ips.mutex.Unlock()
+	ips.fetched, ips.fetchedAt = networks, cache.FetchedAt
+	return nil
+}
+
+func (ips *CallbackIPs) save(cache callbackIPCache) error {
+	raw, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("fail to encode callback ips, %w", err)
+	}
+	// written aside and renamed, a crash never leaves a truncated cache
+	tmp := ips.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return fmt.Errorf("fail to write callback ip file, %w", err)
+	}
+	if err := os.Rename(tmp, ips.path); err != nil {
+		return fmt.Errorf("fail to replace callback ip file, %w", err)
+	}
+	return nil
+}
+
+// parseIPList takes the entries of getcallbackip, ips or cidrs.
+func parseIPList(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		network, err := src.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse callback ip, %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Allows tells whether ip is of wechat or the allowed cidrs, everything is allowed if disabled.
+func (ips *CallbackIPs) Allows(ip net.IP) bool {
+	if !ips.enabled {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range ips.static {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	ips.mutex.RLock()
+	defer ips.mutex.RUnlock()
+	for _, network := range ips.fetched {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects the clients not allowed, the client ip is read from X-Forwarded-For
+// only if the peer is a trusted proxy, see ServerConfig.TrustedProxies.
+func (ips *CallbackIPs) Middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		clientIP := context.ClientIP()
+		if ips.Allows(net.ParseIP(clientIP)) {
+			context.Next()
+			return
+		}
+		portalRejected.Inc(rejectIP)
+		authTracer.WithContext(context.Request.Context()).
+			WithField("reason", rejectIP).
+			Warningf("illegal request, %s is not a callback ip of wechat, abort", clientIP)
+		context.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+// CallbackIPStatus is what the endpoint shows.
+type CallbackIPStatus struct {
+	Enabled   bool      `json:"enabled"`
+	Static    []string  `json:"static"`
+	Fetched   []string  `json:"fetched"`
+	FetchedAt time.Time `json:"fetched_at"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (ips *CallbackIPs) Status() CallbackIPStatus {
+	status := CallbackIPStatus{Enabled: ips.enabled, Static: []string{}, Fetched: []string{}}
+	for _, network := range ips.static {
+		status.Static = append(status.Static, network.String())
+	}
+	ips.mutex.RLock()
+	defer ips.mutex.RUnlock()
+	for _, network := range ips.fetched {
+		status.Fetched = append(status.Fetched, network.String())
+	}
+	status.FetchedAt, status.LastError = ips.fetchedAt, ips.lastError
+	return status
+}
+
+func (ips *CallbackIPs) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("", func(context *gin.Context) {
+		context.JSON(http.StatusOK, ips.Status())
+	})
+
+	group.POST("/refresh", func(context *gin.Context) {
+		if err := ips.Refresh(context.Request.Context()); err != nil {
+			cTracer(context.Request.Context()).Errorf("fail to refresh callback ips, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, ips.Status())
+	})
+}
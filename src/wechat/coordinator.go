@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/hanzezhenalex/wechat/src"
 	"github.com/hanzezhenalex/wechat/src/datastore"
@@ -18,60 +20,288 @@ var cTracer = func(ctx context.Context) *logrus.Entry {
 }
 
 type Coordinator struct {
-	ums *UserMngr
-	svc Service
-	tm  *tokenManager
+	store  datastore.DataStore
+	ums    *UserMngr
+	svc    *Deduplication
+	tm     *tokenManager
+	ticket *tokenManager
+	api    *apiClient
+	js     *jsSDK
+	oauth  *OAuth
+	h5     *H5Pages
+	menu   *MenuManager
+	notify *Notifier
+	review *Reviewer
+	reg    *Registrar
+	follow *FollowerSync
+	ips    *CallbackIPs
+	limit  *rateLimiter
+	quota  *quota
+	pipe   *pipeline
+	dead   *DeadLetters
+	arch   *Archive
+
+	tokenServer bool
 }
 
 func NewCoordinator(cfg src.Config, store datastore.DataStore) (*Coordinator, error) {
-	svc, err := NewDeduplication(store)
+	ums, err := NewUMS(store)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create ums, %w", err)
+	}
+	tokenStore, err := NewTokenStore(cfg, store, credentialAccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create token store, %w", err)
+	}
+	ticketStore, err := NewTokenStore(cfg, store, credentialJsapiTicket)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create jsapi ticket store, %w", err)
+	}
+	tm := NewTokenManager(cfg, tokenStore)
+	api := newApiClient(cfg, tm)
+	ticket := newTicketManager(api, ticketStore)
+
+	notifier, err := newNotifier(cfg.Notify, api, ums)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create notifier, %w", err)
+	}
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load time zone, %w", err)
+	}
+	dailyQuota := newQuota(ums, loc)
+	svc, err := NewDeduplication(store, notifier, dailyQuota)
 	if err != nil {
 		return nil, fmt.Errorf("fail to create deduplication service, %w", err)
 	}
-	ums, err := NewUMS(store)
+	ips, err := newCallbackIPs(cfg.Portal, api)
 	if err != nil {
-		return nil, fmt.Errorf("fail to create ums, %w", err)
+		return nil, fmt.Errorf("fail to create callback ip allowlist, %w", err)
+	}
+	registrar := newRegistrar(store, ums, api)
+	h5, err := NewH5Pages(store, registrar)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create h5 pages, %w", err)
 	}
+	oauth, err := NewOAuth(cfg, ums)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create oauth, %w", err)
+	}
+
 	c := &Coordinator{
-		tm:  NewTokenManager(cfg),
-		svc: svc,
-		ums: ums,
+		store:       store,
+		tm:          tm,
+		ticket:      ticket,
+		api:         api,
+		js:          newJsSDK(cfg.AppID, ticket),
+		oauth:       oauth,
+		h5:          h5,
+		menu:        newMenuManager(api),
+		notify:      notifier,
+		review:      NewReviewer(store, notifier),
+		reg:         registrar,
+		follow:      newFollowerSync(api, ums, time.Duration(cfg.FollowerSyncHours)*time.Hour),
+		ips:         ips,
+		limit:       newRateLimiter(),
+		quota:       dailyQuota,
+		pipe:        newPipeline(cfg.Pipeline),
+		dead:        newDeadLetters(cfg.DeadLetter, store, api, svc, loc),
+		arch:        newArchive(cfg.Archive, store),
+		svc:         svc,
+		ums:         ums,
+		tokenServer: cfg.TokenServer,
 	}
+	if err := c.CheckRuntime(cfg.Runtime); err != nil {
+		return nil, err
+	}
+	c.ApplyRuntime(cfg.Runtime)
 	return c, nil
 }
 
+// CheckRuntime validates the reloadable settings before any of them is applied.
+func (c *Coordinator) CheckRuntime(rt src.RuntimeConfig) error {
+	if rt.DedupWindowDays < 0 {
+		return fmt.Errorf("dedup window of %d days is negative", rt.DedupWindowDays)
+	}
+	return CheckReplies(rt.Replies)
+}
+
+func (c *Coordinator) ApplyRuntime(rt src.RuntimeConfig) {
+	ApplyReplies(rt.Replies)
+	c.limit.apply(rt.RateLimit)
+	c.quota.apply(rt.Quota)
+	c.svc.applyWindow(rt.DedupWindowDays)
+}
+
 func (c *Coordinator) Handler() gin.HandlerFunc {
 	return func(context *gin.Context) {
 		ctx := context.Request.Context()
 		tracer := cTracer(ctx)
 
+		body, err := io.ReadAll(context.Request.Body)
+		_ = context.Request.Body.Close()
+		if err != nil {
+			tracer.Errorf("fail to read request body, %s", err.Error())
+			context.Writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		var msg Message
-		if err := xml.NewDecoder(context.Request.Body).Decode(&msg); err != nil {
+		if err := xml.Unmarshal(body, &msg); err != nil {
 			tracer.Errorf("fail to decode request body, %s", err.Error())
 			context.Writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		_ = context.Request.Body.Close()
 		tracer.Infof("new message from %s", msg.FromUserName)
 
-		tracer.Info("checking the existence of user")
-		if _, ok := c.ums.GetUserById(ctx, msg.FromUserName); !ok {
-			tracer.Warningf("message rejected, user %s not register", msg.FromUserName)
-			_, _ = context.Writer.WriteString(msg.TextResponse(userNotRegistered))
-			return
-		}
+		outcome := &messageOutcome{}
+		ret := c.handle(withOutcome(ctx, outcome), msg, outcome)
+		_, _ = context.Writer.WriteString(ret)
+		c.arch.add(ctx, context.Request.Header, body, msg, ret, outcome.get())
+	}
+}
 
-		ret, err := c.svc.Handle(ctx, msg)
-		if err != nil {
-			tracer.Errorf("fail to process message, %s", err.Error())
-			ret = msg.TextResponse(fmt.Sprintf("%s, trace_id=%s", serverInternalError, src.GetTraceId(ctx)))
+// handle checks the message on the request goroutine, so a message rejected or throttled
+// never waits for a worker, only the registration and the service run on the pipeline.
+func (c *Coordinator) handle(ctx context.Context, msg Message, outcome *messageOutcome) string {
+	ctx, span := src.StartSpan(ctx, "coordinator.handle")
+	defer span.End()
+	span.SetAttr("wechat.msg_type", msg.MsgType)
+	tracer := cTracer(ctx)
+
+	// registration messages come from users not registered yet
+	tracer.Info("checking the existence of user")
+	if _, ok := c.ums.GetUserById(ctx, msg.FromUserName); !ok && !c.reg.matches(msg) {
+		// the user may be one of those not cached yet
+		if !c.ums.Loaded() {
+			tracer.Warningf("message of %s shed, users not cached yet", msg.FromUserName)
+			countMessage(ctx, msg.MsgType, outcomeShed)
+			return msg.TextResponse(replyText(replyBusy))
 		}
+		tracer.Warningf("message rejected, user %s not register", msg.FromUserName)
+		countMessage(ctx, msg.MsgType, outcomeNotRegistered)
+		return msg.TextResponse(replyText(replyUserNotRegistered))
+	}
 
-		tracer.Debug("message processed successfully")
-		_, _ = context.Writer.WriteString(ret)
+	if limit, ok := c.limit.allow(msg.FromUserName, c.roleOf(ctx, msg.FromUserName), time.Now()); !ok {
+		tracer.Warningf("message of %s rejected by the %s rate limit", msg.FromUserName, limit)
+		rateLimited.Inc(limit)
+		countMessage(ctx, msg.MsgType, outcomeRateLimited)
+		return msg.TextResponse(replyText(replyRateLimited))
+	}
+
+	ret, err := c.pipe.run(ctx, msg, c.recording(outcome))
+	if err != nil {
+		tracer.Warningf("message of %s shed, %s", msg.FromUserName, err.Error())
+		countMessage(ctx, msg.MsgType, outcomeShed)
+		return msg.TextResponse(replyText(replyBusy))
+	}
+	return ret
+}
+
+// recording processes the message with its outcome recorded, the pipeline does not pass
+// the values of the request ctx on.
+func (c *Coordinator) recording(outcome *messageOutcome) func(ctx context.Context, msg Message) string {
+	return func(ctx context.Context, msg Message) string {
+		return c.process(withOutcome(ctx, outcome), msg)
+	}
+}
+
+// process runs the registration or the service on a worker, and returns the reply.
+func (c *Coordinator) process(ctx context.Context, msg Message) string {
+	ctx, span := src.StartSpan(ctx, "coordinator.process")
+	defer span.End()
+	tracer := cTracer(ctx)
+
+	if reply, ok := c.reg.Handle(ctx, msg); ok {
+		countMessage(ctx, msg.MsgType, outcomeRegistration)
+		return msg.TextResponse(reply)
+	}
+
+	ret, err := c.svc.Handle(ctx, msg)
+	if err != nil {
+		tracer.Errorf("fail to process message, %s", err.Error())
+		span.SetError(err)
+		// a message failing by itself fails on a retry too
+		if isTransient(err) {
+			letter, dlErr := c.dead.Add(ctx, msg, err)
+			if dlErr == nil {
+				tracer.Infof("message of %s kept as dead letter %d", msg.FromUserName, letter.ID)
+				countMessage(ctx, msg.MsgType, outcomeDeadLettered)
+				return msg.TextResponse(replyText(replyDeadLettered))
+			}
+			tracer.Errorf("fail to keep dead letter, %s", dlErr.Error())
+		}
+		countMessage(ctx, msg.MsgType, outcomeError)
+		ret = msg.TextResponse(fmt.Sprintf("%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx)))
 	}
+
+	tracer.Debug("message processed successfully")
+	return ret
 }
 
 func (c *Coordinator) RegisterEndpoints(group *gin.RouterGroup) {
+	group.Use(InternalAuth())
 	c.ums.RegisterEndpoints(group.Group("/ums"))
+	c.js.RegisterEndpoints(group.Group("/jssdk"))
+	c.menu.RegisterEndpoints(group.Group("/menu"))
+	c.review.RegisterEndpoints(group.Group("/records"))
+	c.reg.RegisterEndpoints(group.Group("/registrations"))
+	c.follow.RegisterEndpoints(group.Group("/followers"))
+	c.ips.RegisterEndpoints(group.Group("/callback_ips"))
+	c.dead.RegisterEndpoints(group.Group("/dead_letters"))
+	c.arch.RegisterEndpoints(group.Group("/archive"))
+
+	tokenG := group.Group("/token")
+	c.tm.RegisterEndpoints(tokenG)
+	c.ticket.RegisterEndpoints(tokenG.Group("/" + credentialJsapiTicket))
+	if c.tokenServer {
+		c.tm.RegisterTokenServer(tokenG)
+		c.ticket.RegisterTokenServer(tokenG.Group("/" + credentialJsapiTicket))
+	}
+}
+
+// CallbackIPFilter rejects the portal requests not from wechat if the allowlist is enabled.
+func (c *Coordinator) CallbackIPFilter() gin.HandlerFunc {
+	return c.ips.Middleware()
+}
+
+func (c *Coordinator) RegisterOAuthEndpoints(group *gin.RouterGroup) {
+	c.oauth.RegisterEndpoints(group)
+}
+
+// RegisterH5Endpoints registers the pages opened inside wechat,
+// every handler can get the authenticated user by UserFromContext.
+func (c *Coordinator) RegisterH5Endpoints(group *gin.RouterGroup) {
+	group.Use(c.oauth.RequireSession())
+	group.GET("/me", func(context *gin.Context) {
+		user, _ := UserFromContext(context)
+		context.JSON(http.StatusOK, user)
+	})
+	// mute=true opts the user out of notifications
+	group.POST("/notify", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		current, _ := UserFromContext(context)
+
+		user, err := c.ums.SetNotify(ctx, current.WechatID, context.PostForm("mute") == "true")
+		if err != nil {
+			cTracer(ctx).Errorf("fail to set notify, %s", err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, user)
+	})
+	c.h5.RegisterEndpoints(group)
+}
+
+// Close stops the background workers owned by the coordinator.
+func (c *Coordinator) Close() {
+	c.pipe.stop()
+	c.dead.Stop()
+	c.arch.Stop()
+	c.follow.Stop()
+	c.ips.Stop()
+	c.notify.Stop()
+	c.ticket.Stop()
+	c.tm.Stop()
+	c.ums.Stop()
 }
@@ -0,0 +1,305 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+const (
+	deadLetterBatch      = 20
+	deadLetterTimeout    = 3 * time.Second
+	deadLetterRetryLimit = time.Minute
+	maxDeadLetterBackoff = 6 * time.Hour
+	defaultListLimit     = 100
+
+	retrySucceeded = "succeeded"
+	retryFailed    = "failed"
+	retryGaveUp    = "gave_up"
+)
+
+var deadLetterTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "dead_letter").WithContext(ctx)
+}
+
+var deadLetterRetries = metrics.NewCounterVec("wechat_dead_letter_retries_total",
+	"Retries of dead letters by result, succeeded, failed or gave_up.", "result")
+
+// DeadLetters keeps the messages failed to process, with the error and the trace id, and
+// retries them with backoff. The user is told the outcome by a customer service message.
+type DeadLetters struct {
+	store       datastore.DataStore
+	api         *apiClient
+	svc         *Deduplication
+	loc         *time.Location
+	maxAttempts int
+	backoff     time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newDeadLetters(cfg src.DeadLetterConfig, store datastore.DataStore, api *apiClient, svc *Deduplication, loc *time.Location) *DeadLetters {
+	ctx, cancel := context.WithCancel(context.Background())
+	dl := &DeadLetters{
+		store:       store,
+		api:         api,
+		svc:         svc,
+		loc:         loc,
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     time.Duration(cfg.BackoffSeconds) * time.Second,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	if cfg.PollSeconds > 0 {
+		go dl.daemon(ctx, time.Duration(cfg.PollSeconds)*time.Second)
+	} else {
+		close(dl.done)
+	}
+	return dl
+}
+
+func (dl *DeadLetters) daemon(ctx context.Context, interval time.Duration) {
+	defer close(dl.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dl.retryDue(ctx)
+		}
+	}
+}
+
+// Stop cancels the retries and waits for the one running.
+func (dl *DeadLetters) Stop() {
+	dl.cancel()
+	<-dl.done
+}
+
+// Add keeps the message failed by cause, it is first retried after the backoff.
+// The ctx of the message may be done already, the letter is saved within its own timeout.
+func (dl *DeadLetters) Add(ctx context.Context, msg Message, cause error) (datastore.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(src.DetachContext(ctx), deadLetterTimeout)
+	defer cancel()
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return datastore.DeadLetter{}, fmt.Errorf("fail to encode message, %w", err)
+	}
+	return dl.store.CreateDeadLetter(ctx, datastore.DeadLetter{
+		WechatID:    msg.FromUserName,
+		MsgType:     msg.MsgType,
+		Message:     string(raw),
+		Error:       cause.Error(),
+		TraceID:     src.GetTraceId(ctx),
+		NextRetryAt: time.Now().Add(dl.backoff),
+	})
+}
+
+func (dl *DeadLetters) retryDue(ctx context.Context) {
+	letters, err := dl.store.GetDueDeadLetters(ctx, time.Now(), deadLetterBatch)
+	if err != nil {
+		deadLetterTracer(ctx).Errorf("fail to get dead letters due, %s", err.Error())
+		return
+	}
+	for _, letter := range letters {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, _, err := dl.Retry(ctx, letter); err != nil {
+			deadLetterTracer(ctx).Errorf("fail to retry dead letter %d, %s", letter.ID, err.Error())
+		}
+	}
+}
+
+// backoffOf is the wait after the given attempt, doubled from the configured backoff.
+func (dl *DeadLetters) backoffOf(attempt int) time.Duration {
+	interval := dl.backoff
+	for i := 1; i < attempt && interval < maxDeadLetterBackoff; i++ {
+		interval *= 2
+	}
+	if interval > maxDeadLetterBackoff {
+		interval = maxDeadLetterBackoff
+	}
+	return interval
+}
+
+// Retry processes the letter again if it can be claimed, false is returned if another replica
+// claimed it first or it is not pending. A failure of processing is not an error, it is kept
+// in the letter, which is given up after the max attempts.
+func (dl *DeadLetters) Retry(ctx context.Context, letter datastore.DeadLetter) (datastore.DeadLetter, bool, error) {
+	attempt := letter.Attempts + 1
+	claimed, err := dl.store.ClaimDeadLetter(ctx, letter.ID, letter.Attempts, time.Now().Add(dl.backoffOf(attempt)))
+	if err != nil || !claimed {
+		return letter, false, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal([]byte(letter.Message), &msg); err != nil {
+		return letter, true, fmt.Errorf("fail to decode message of dead letter %d, %w", letter.ID, err)
+	}
+
+	ctx, span := src.StartSpan(ctx, "dead_letter.retry")
+	defer span.End()
+	span.SetAttr("dead_letter.id", strconv.Itoa(letter.ID))
+	span.SetAttr("dead_letter.trace_id", letter.TraceID)
+	tracer := deadLetterTracer(ctx).WithField("origin_trace_id", letter.TraceID)
+
+	// counted on the quota of the day it came, it was not when it failed
+	retryCtx, cancel := context.WithTimeout(ctx, deadLetterRetryLimit)
+	ret, cause := dl.svc.handleAt(retryCtx, msg, letter.CreateAt)
+	cancel()
+	span.SetError(cause)
+
+	status, lastError := datastore.DeadLetterSucceeded, ""
+	switch {
+	case cause == nil:
+		deadLetterRetries.Inc(retrySucceeded)
+		tracer.Infof("dead letter %d of %s succeeded at attempt %d", letter.ID, letter.WechatID, attempt)
+	case attempt >= dl.maxAttempts || !isTransient(cause):
+		status, lastError = datastore.DeadLetterFailed, cause.Error()
+		deadLetterRetries.Inc(retryGaveUp)
+		tracer.Errorf("dead letter %d of %s given up after %d attempts, %s", letter.ID, letter.WechatID, attempt, lastError)
+	default:
+		status, lastError = datastore.DeadLetterPending, cause.Error()
+		deadLetterRetries.Inc(retryFailed)
+		tracer.Warningf("dead letter %d of %s failed at attempt %d, %s", letter.ID, letter.WechatID, attempt, lastError)
+	}
+	if _, err := dl.store.UpdateDeadLetter(ctx, letter.ID, []string{datastore.DeadLetterPending}, status, lastError); err != nil {
+		return letter, true, err
+	}
+	letter.Attempts, letter.Status = attempt, status
+	if lastError != "" {
+		letter.Error = lastError
+	}
+
+	if status != datastore.DeadLetterPending {
+		dl.tell(ctx, letter, ret)
+	}
+	return letter, true, nil
+}
+
+// tell sends the outcome to the user, ret is the reply the message would have got.
+func (dl *DeadLetters) tell(ctx context.Context, letter datastore.DeadLetter, ret string) {
+	sentAt := letter.CreateAt.In(dl.loc).Format("01-02 15:04")
+	text := fmt.Sprintf(replyText(replyDeadLetterFailed), sentAt)
+	if letter.Status == datastore.DeadLetterSucceeded {
+		text = fmt.Sprintf(replyText(replyDeadLetterSucceeded), sentAt, replyContent(ret))
+	}
+	if err := dl.api.sendText(ctx, letter.WechatID, text); err != nil {
+		deadLetterTracer(ctx).Errorf("fail to tell %s the outcome of dead letter %d, %s", letter.WechatID, letter.ID, err.Error())
+	}
+}
+
+func (dl *DeadLetters) RegisterEndpoints(group *gin.RouterGroup) {
+	// status defaults to pending, limit to 100
+	group.GET("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		limit, err := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		letters, err := dl.store.GetDeadLetters(ctx, context.DefaultQuery("status", datastore.DeadLetterPending), limit)
+		if err != nil {
+			deadLetterTracer(ctx).Errorf("fail to get dead letters, %s", err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if letters == nil {
+			letters = []datastore.DeadLetter{}
+		}
+		context.JSON(http.StatusOK, letters)
+	})
+
+	group.GET("/:id", func(context *gin.Context) {
+		if letter, ok := dl.find(context); ok {
+			context.JSON(http.StatusOK, letter)
+		}
+	})
+
+	// retry now, a letter given up is retried once more
+	group.POST("/:id/retry", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		letter, ok := dl.find(context)
+		if !ok {
+			return
+		}
+		if letter.Status == datastore.DeadLetterFailed {
+			if _, err := dl.store.UpdateDeadLetter(ctx, letter.ID, []string{datastore.DeadLetterFailed}, datastore.DeadLetterPending, ""); err != nil {
+				deadLetterTracer(ctx).Errorf("fail to reopen dead letter %d, %s", letter.ID, err.Error())
+				context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			letter.Status = datastore.DeadLetterPending
+		}
+
+		letter, claimed, err := dl.Retry(ctx, letter)
+		switch {
+		case err != nil:
+			deadLetterTracer(ctx).Errorf("fail to retry dead letter %d, %s", letter.ID, err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case !claimed:
+			context.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("dead letter %d is %s or being retried", letter.ID, letter.Status)})
+		default:
+			context.JSON(http.StatusOK, letter)
+		}
+	})
+
+	group.POST("/:id/discard", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		letter, ok := dl.find(context)
+		if !ok {
+			return
+		}
+		ok, err := dl.store.UpdateDeadLetter(ctx, letter.ID,
+			[]string{datastore.DeadLetterPending, datastore.DeadLetterFailed}, datastore.DeadLetterDiscarded, "")
+		switch {
+		case err != nil:
+			deadLetterTracer(ctx).Errorf("fail to discard dead letter %d, %s", letter.ID, err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case !ok:
+			context.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("dead letter %d is %s", letter.ID, letter.Status)})
+		default:
+			deadLetterTracer(ctx).Infof("dead letter %d discarded", letter.ID)
+			letter.Status = datastore.DeadLetterDiscarded
+			context.JSON(http.StatusOK, letter)
+		}
+	})
+}
+
+// find responds 400 or 404 itself, if the letter of the path can not be got.
+func (dl *DeadLetters) find(context *gin.Context) (datastore.DeadLetter, bool) {
+	ctx := context.Request.Context()
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return datastore.DeadLetter{}, false
+	}
+	letter, ok, err := dl.store.GetDeadLetter(ctx, id)
+	switch {
+	case err != nil:
+		deadLetterTracer(ctx).Errorf("fail to get dead letter %d, %s", id, err.Error())
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return letter, false
+	case !ok:
+		context.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("dead letter %d not found", id)})
+		return letter, false
+	}
+	return letter, true
+}
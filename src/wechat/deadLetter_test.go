@@ -0,0 +1,18 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterBackoff(t *testing.T) {
+	rq := require.New(t)
+
+	dl := &DeadLetters{backoff: time.Minute}
+	rq.Equal(time.Minute, dl.backoffOf(1))
+	rq.Equal(2*time.Minute, dl.backoffOf(2))
+	rq.Equal(8*time.Minute, dl.backoffOf(4))
+	rq.Equal(maxDeadLetterBackoff, dl.backoffOf(30))
+}
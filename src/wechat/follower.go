@@ -0,0 +1,265 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	batchGetLimit   = 100
+	maxReportedIDs  = 1000
+	followerTimeout = 10 * time.Minute
+)
+
+var followerTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "follower_sync").WithContext(ctx)
+}
+
+type followerListResp struct {
+	Total int `json:"total"`
+	Count int `json:"count"`
+	Data  struct {
+		OpenID []string `json:"openid"`
+	} `json:"data"`
+	NextOpenID string `json:"next_openid"`
+}
+
+type followerInfo struct {
+	Subscribe int    `json:"subscribe"`
+	OpenID    string `json:"openid"`
+	Nickname  string `json:"nickname"`
+}
+
+type batchGetResp struct {
+	UserInfoList []followerInfo `json:"user_info_list"`
+}
+
+// SyncReport is the outcome of a follower sync, the id lists are cut at 1000 entries.
+type SyncReport struct {
+	StartAt    time.Time `json:"start_at"`
+	Duration   string    `json:"duration"`
+	Followers  int       `json:"followers"`
+	Registered int       `json:"registered"`
+	Updated    int       `json:"updated"`
+
+	// registered users who do not follow the account
+	UnfollowedCount int      `json:"unfollowed_count"`
+	Unfollowed      []string `json:"unfollowed"`
+	// followers who are not registered
+	UnregisteredCount int      `json:"unregistered_count"`
+	Unregistered      []string `json:"unregistered"`
+}
+
+// FollowerSync refreshes nickname and subscribe status of the registered users from wechat,
+// periodically if an interval is given, or on demand by the endpoint.
+type FollowerSync struct {
+	api *apiClient
+	ums *UserMngr
+
+	running sync.Mutex // one sync at a time
+	mutex   sync.RWMutex
+	last    *SyncReport
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newFollowerSync(api *apiClient, ums *UserMngr, interval time.Duration) *FollowerSync {
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &FollowerSync{
+		api:    api,
+		ums:    ums,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if interval > 0 {
+		go fs.daemon(ctx, interval)
+	} else {
+		close(fs.done)
+	}
+	return fs
+}
+
+func (fs *FollowerSync) daemon(ctx context.Context, interval time.Duration) {
+	defer close(fs.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			syncCtx, cancel := context.WithTimeout(ctx, followerTimeout)
+			if _, err := fs.Sync(syncCtx); err != nil {
+				followerTracer(ctx).Errorf("fail to sync followers, %s", err.Error())
+			}
+			cancel()
+		}
+	}
+}
+
+// Stop cancels the periodic sync and waits for it.
+func (fs *FollowerSync) Stop() {
+	fs.cancel()
+	<-fs.done
+}
+
+// Sync pages through the followers, then refreshes the registered ones by batchget.
+func (fs *FollowerSync) Sync(ctx context.Context) (SyncReport, error) {
+	fs.running.Lock()
+	defer fs.running.Unlock()
+
+	tracer := followerTracer(ctx)
+	report := SyncReport{StartAt: time.Now()}
+
+	followers, err := fs.followers(ctx)
+	if err != nil {
+		return report, err
+	}
+	users := fs.ums.Users(ctx)
+	report.Followers = len(followers)
+	report.Registered = len(users)
+
+	var following []string
+	registered := make(map[string]bool, len(users))
+	for _, user := range users {
+		registered[user.WechatID] = true
+		if followers[user.WechatID] {
+			following = append(following, user.WechatID)
+		}
+	}
+	infos, err := fs.infos(ctx, following)
+	if err != nil {
+		return report, err
+	}
+
+	for _, user := range users {
+		nickname, subscribed := user.Nickname, followers[user.WechatID]
+		if info, ok := infos[user.WechatID]; ok {
+			subscribed = info.Subscribe == 1
+			// wechat stopped returning nicknames, an empty one keeps what we have
+			if info.Nickname != "" {
+				nickname = info.Nickname
+			}
+		}
+		if !subscribed {
+			report.Unfollowed = append(report.Unfollowed, user.WechatID)
+		}
+		if nickname == user.Nickname && subscribed == user.Subscribed {
+			continue
+		}
+		if _, err := fs.ums.SetFollower(ctx, user.WechatID, nickname, subscribed); err != nil {
+			return report, err
+		}
+		report.Updated++
+	}
+	for openID := range followers {
+		if !registered[openID] {
+			report.Unregistered = append(report.Unregistered, openID)
+		}
+	}
+
+	report.UnfollowedCount, report.Unfollowed = cutIDs(report.Unfollowed)
+	report.UnregisteredCount, report.Unregistered = cutIDs(report.Unregistered)
+	report.Duration = time.Since(report.StartAt).String()
+
+	fs.mutex.Lock()
+	fs.last = &report
+	fs.mutex.Unlock()
+
+	tracer.Infof("followers synced, followers=%d, registered=%d, updated=%d, unfollowed=%d, unregistered=%d",
+		report.Followers, report.Registered, report.Updated, report.UnfollowedCount, report.UnregisteredCount)
+	return report, nil
+}
+
+// followers pages through user/get, next_openid is empty after the last page.
+func (fs *FollowerSync) followers(ctx context.Context) (map[string]bool, error) {
+	followers := make(map[string]bool)
+
+	next := ""
+	for {
+		query := url.Values{}
+		if next != "" {
+			query.Set("next_openid", next)
+		}
+		var resp followerListResp
+		if err := fs.api.get(ctx, "/cgi-bin/user/get", query, &resp); err != nil {
+			return nil, fmt.Errorf("fail to get followers after %s, %w", next, err)
+		}
+		for _, openID := range resp.Data.OpenID {
+			followers[openID] = true
+		}
+		if resp.Count == 0 || resp.NextOpenID == "" || resp.NextOpenID == next {
+			return followers, nil
+		}
+		next = resp.NextOpenID
+	}
+}
+
+// infos calls user/info/batchget, at most 100 users a call.
+func (fs *FollowerSync) infos(ctx context.Context, openIDs []string) (map[string]followerInfo, error) {
+	infos := make(map[string]followerInfo, len(openIDs))
+
+	for start := 0; start < len(openIDs); start += batchGetLimit {
+		end := start + batchGetLimit
+		if end > len(openIDs) {
+			end = len(openIDs)
+		}
+
+		var list []map[string]string
+		for _, openID := range openIDs[start:end] {
+			list = append(list, map[string]string{"openid": openID, "lang": "zh_CN"})
+		}
+		var resp batchGetResp
+		if err := fs.api.post(ctx, "/cgi-bin/user/info/batchget", map[string]interface{}{"user_list": list}, &resp); err != nil {
+			return nil, fmt.Errorf("fail to batch get user info, %w", err)
+		}
+		for _, info := range resp.UserInfoList {
+			infos[info.OpenID] = info
+		}
+	}
+	return infos, nil
+}
+
+func cutIDs(ids []string) (int, []string) {
+	sort.Strings(ids)
+	if len(ids) > maxReportedIDs {
+		return len(ids), ids[:maxReportedIDs]
+	}
+	return len(ids), ids
+}
+
+func (fs *FollowerSync) RegisterEndpoints(group *gin.RouterGroup) {
+	group.POST("/sync", func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		report, err := fs.Sync(ctx)
+		if err != nil {
+			followerTracer(ctx).Errorf("fail to sync followers, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, report)
+	})
+
+	group.GET("/report", func(context *gin.Context) {
+		fs.mutex.RLock()
+		last := fs.last
+		fs.mutex.RUnlock()
+
+		if last == nil {
+			context.JSON(http.StatusNotFound, gin.H{"error": "followers never synced"})
+			return
+		}
+		context.JSON(http.StatusOK, last)
+	})
+}
@@ -0,0 +1,314 @@
+package wechat
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	defaultRecordsDays = 30
+	maxRecordsOnPage   = 200
+)
+
+//go:embed h5/templates h5/static
+var h5Assets embed.FS
+
+var h5Tracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "h5").WithContext(ctx)
+}
+
+var statusLabels = map[string]string{
+	"":                          "全部状态",
+	datastore.WaitingForConfirm: "待审核",
+	datastore.Confirmed:         "已通过",
+	datastore.Denied:            "已驳回",
+	datastore.AutoDenied:        "重复上传",
+}
+
+var statusOrder = []string{"", datastore.WaitingForConfirm, datastore.Confirmed, datastore.Denied, datastore.AutoDenied}
+
+// H5Pages renders the pages users open from the menu inside wechat.
+type H5Pages struct {
+	store     datastore.DataStore
+	registrar *Registrar
+	templates *template.Template
+	static    fs.FS
+}
+
+func NewH5Pages(store datastore.DataStore, registrar *Registrar) (*H5Pages, error) {
+	templates, err := template.ParseFS(h5Assets, "h5/templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse h5 templates, %w", err)
+	}
+	static, err := fs.Sub(h5Assets, "h5/static")
+	if err != nil {
+		return nil, fmt.Errorf("fail to load h5 static assets, %w", err)
+	}
+	return &H5Pages{store: store, registrar: registrar, templates: templates, static: static}, nil
+}
+
+func (h5 *H5Pages) RegisterEndpoints(group *gin.RouterGroup) {
+	staticPath := group.BasePath() + "/static"
+	registrationsPath := group.BasePath() + "/registrations"
+	group.StaticFS("/static", http.FS(h5.static))
+	group.GET("/records", func(context *gin.Context) {
+		h5.records(context, staticPath)
+	})
+	group.GET("/registrations", func(context *gin.Context) {
+		h5.registrations(context, staticPath)
+	})
+	group.POST("/registrations/:id", func(context *gin.Context) {
+		h5.reviewRegistration(context, registrationsPath)
+	})
+}
+
+type statusOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+type recordView struct {
+	ID          int
+	GraphUrl    string
+	Status      string
+	StatusLabel string
+	CreateAt    string
+	DenyReason  string
+	Original    *recordView
+}
+
+type recordsPage struct {
+	StaticPath string
+	UserName   string
+	From, To   string
+	Statuses   []statusOption
+	Records    []recordView
+	Truncated  bool
+}
+
+func (h5 *H5Pages) records(context *gin.Context, staticPath string) {
+	ctx := context.Request.Context()
+	tracer := h5Tracer(ctx)
+
+	user, ok := UserFromContext(context)
+	if !ok {
+		context.Status(http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	from := parseDate(context.Query("from"), now.AddDate(0, 0, -defaultRecordsDays))
+	to := parseDate(context.Query("to"), now)
+	status := context.Query("status")
+	if _, ok := statusLabels[status]; !ok {
+		status = ""
+	}
+
+	minStatus, maxStatus := datastore.AutoDenied, datastore.Confirmed
+	if status != "" {
+		minStatus, maxStatus = status, status
+	}
+	option, err := datastore.NewRecordQueryOption(from, to.AddDate(0, 0, 1), minStatus, maxStatus)
+	if err != nil {
+		context.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := h5.store.GetRecords(ctx, option.WithOwner(user.WechatID).WithLimit(maxRecordsOnPage))
+	if err != nil {
+		tracer.Errorf("fail to get records of %s, %s", user.WechatID, err.Error())
+		context.String(http.StatusInternalServerError, "%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx))
+		return
+	}
+
+	originals, err := h5.originals(ctx, records)
+	if err != nil {
+		// the page is still useful without the originals
+		tracer.Errorf("fail to get original records, %s", err.Error())
+	}
+
+	page := recordsPage{
+		StaticPath: staticPath,
+		UserName:   user.Name,
+		From:       from.Format(dateLayout),
+		To:         to.Format(dateLayout),
+		Truncated:  len(records) >= maxRecordsOnPage,
+	}
+	for _, value := range statusOrder {
+		page.Statuses = append(page.Statuses, statusOption{Value: value, Label: statusLabels[value], Selected: value == status})
+	}
+	for _, record := range records {
+		view := newRecordView(record)
+		if original, ok := originals[record.DuplicateOf]; ok {
+			originalView := newRecordView(original)
+			// the original may belong to someone else, do not leak the picture
+			if original.OwnerID != user.WechatID {
+				originalView.GraphUrl = ""
+			}
+			view.Original = &originalView
+		}
+		page.Records = append(page.Records, view)
+	}
+
+	context.Render(http.StatusOK, render.HTML{
+		Template: h5.templates,
+		Name:     "records.tmpl",
+		Data:     page,
+	})
+}
+
+func (h5 *H5Pages) originals(ctx context.Context, records []datastore.RecordInfo) (map[int]datastore.RecordInfo, error) {
+	var ids []int
+	for _, record := range records {
+		if record.DuplicateOf != 0 {
+			ids = append(ids, record.DuplicateOf)
+		}
+	}
+
+	originals := make(map[int]datastore.RecordInfo, len(ids))
+	if len(ids) == 0 {
+		return originals, nil
+	}
+	found, err := h5.store.GetRecordsByIds(ctx, ids)
+	if err != nil {
+		return originals, err
+	}
+	for _, record := range found {
+		originals[record.ID] = record
+	}
+	return originals, nil
+}
+
+func newRecordView(record datastore.RecordInfo) recordView {
+	status := record.Status.String()
+	return recordView{
+		ID:          record.ID,
+		GraphUrl:    record.GraphUrl,
+		Status:      status,
+		StatusLabel: statusLabels[status],
+		CreateAt:    record.CreateAt.Format("2006-01-02 15:04"),
+		DenyReason:  record.DenyReason,
+	}
+}
+
+func parseDate(value string, fallback time.Time) time.Time {
+	day, err := time.ParseInLocation(dateLayout, value, time.Local)
+	if err != nil {
+		day = fallback
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+}
+
+type registrationView struct {
+	ID       int
+	WechatID string
+	Name     string
+	Source   string
+	CreateAt string
+}
+
+type registrationsPage struct {
+	StaticPath    string
+	UserName      string
+	Registrations []registrationView
+}
+
+// registrations lists the registrations waiting for the leader.
+func (h5 *H5Pages) registrations(context *gin.Context, staticPath string) {
+	ctx := context.Request.Context()
+
+	user, ok := UserFromContext(context)
+	if !ok {
+		context.Status(http.StatusUnauthorized)
+		return
+	}
+
+	registrations, err := h5.store.GetRegistrations(ctx, datastore.RegistrationPending, user.WechatID)
+	if err != nil {
+		h5Tracer(ctx).Errorf("fail to get registrations of %s, %s", user.WechatID, err.Error())
+		context.String(http.StatusInternalServerError, "%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx))
+		return
+	}
+
+	page := registrationsPage{StaticPath: staticPath, UserName: user.Name}
+	for _, registration := range registrations {
+		page.Registrations = append(page.Registrations, registrationView{
+			ID:       registration.ID,
+			WechatID: registration.WechatID,
+			Name:     registration.Name,
+			Source:   registration.Source,
+			CreateAt: registration.CreateAt.Format("2006-01-02 15:04"),
+		})
+	}
+
+	context.Render(http.StatusOK, render.HTML{
+		Template: h5.templates,
+		Name:     "registrations.tmpl",
+		Data:     page,
+	})
+}
+
+// reviewRegistration handles the approve and reject buttons, only the leader
+// the registration applied to can review it.
+func (h5 *H5Pages) reviewRegistration(context *gin.Context, registrationsPath string) {
+	ctx := context.Request.Context()
+	tracer := h5Tracer(ctx)
+
+	user, ok := UserFromContext(context)
+	if !ok {
+		context.Status(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil {
+		context.String(http.StatusBadRequest, "invalid registration id")
+		return
+	}
+
+	registration, ok, err := h5.store.GetRegistration(ctx, id)
+	switch {
+	case err != nil:
+		tracer.Errorf("fail to get registration %d, %s", id, err.Error())
+		context.String(http.StatusInternalServerError, "%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx))
+		return
+	case !ok || registration.LeaderID != user.WechatID:
+		context.String(http.StatusNotFound, "registration not found")
+		return
+	}
+
+	switch context.PostForm("action") {
+	case "approve":
+		_, ok, err = h5.registrar.Approve(ctx, id, ApproveReq{Reviewer: user.WechatID, Name: context.PostForm("name")})
+	case "reject":
+		_, ok, err = h5.registrar.Reject(ctx, id, RejectReq{Reviewer: user.WechatID})
+	default:
+		context.String(http.StatusBadRequest, "unknown action")
+		return
+	}
+	if err != nil {
+		tracer.Errorf("fail to review registration %d, %s", id, err.Error())
+		context.String(http.StatusInternalServerError, "%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx))
+		return
+	}
+	if ok {
+		tracer.Infof("registration %d %sd by %s", id, context.PostForm("action"), user.WechatID)
+	}
+	// back to the list, reviewed twice is not an error for the leader
+	context.Redirect(http.StatusSeeOther, registrationsPath)
+}
@@ -0,0 +1,87 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	pingTimeout = 2 * time.Second
+)
+
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness tells whether the replica can take traffic, with the state of every dependency.
+type Readiness struct {
+	Status string                      `json:"status"`
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+// Readiness fails while the db does not answer the ping, the users are not cached,
+// or there is no valid access token to call wechat with.
+func (c *Coordinator) Readiness(ctx context.Context) Readiness {
+	ready := Readiness{Status: healthOK, Checks: make(map[string]DependencyStatus)}
+	check := func(name string, err error, detail string) {
+		result := DependencyStatus{Status: healthOK, Detail: detail}
+		if err != nil {
+			result.Status, result.Error = healthFail, err.Error()
+			ready.Status = healthFail
+		}
+		ready.Checks[name] = result
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	check("datastore", c.store.Ping(pingCtx), "")
+
+	var err error
+	if !c.ums.Loaded() {
+		err = fmt.Errorf("users not cached yet")
+	}
+	check("users", err, strconv.Itoa(len(c.ums.Users(ctx)))+" cached")
+
+	status := c.tm.Status()
+	err = nil
+	switch {
+	case !status.Ready:
+		err = fmt.Errorf("no access token yet, %s", status.LastError)
+	case !status.Valid:
+		err = fmt.Errorf("access token expired at %s, %s", status.ExpireAt.Format(time.RFC3339), status.LastError)
+	}
+	detail := ""
+	if status.Age != "" {
+		detail = "age " + status.Age
+	}
+	check("access_token", err, detail)
+	return ready
+}
+
+// RegisterHealthEndpoints registers /healthz and /readyz, both without auth for the orchestrator.
+// Liveness only tells the process serves, a broken dependency is not fixed by a restart.
+func (c *Coordinator) RegisterHealthEndpoints(r gin.IRoutes) {
+	r.GET("/healthz", func(context *gin.Context) {
+		context.JSON(http.StatusOK, gin.H{"status": healthOK})
+	})
+
+	r.GET("/readyz", func(context *gin.Context) {
+		ready := c.Readiness(context.Request.Context())
+		code := http.StatusOK
+		if ready.Status != healthOK {
+			cTracer(context.Request.Context()).Warningf("not ready, %v", ready.Checks)
+			code = http.StatusServiceUnavailable
+		}
+		context.JSON(code, ready)
+	})
+}
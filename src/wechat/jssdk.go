@@ -0,0 +1,108 @@
+package wechat
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const nonceLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+var jsTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "jssdk").WithContext(ctx)
+}
+
+type TicketResp struct {
+	Ticket  string `json:"ticket"`
+	Expires int    `json:"expires_in"`
+}
+
+// newTicketManager keeps the jsapi_ticket fresh, it follows the same caching,
+// persistence and refresh rules as the access token it is fetched with.
+func newTicketManager(api *apiClient, store TokenStore) *tokenManager {
+	return newCredentialManager(credentialJsapiTicket, store, func(ctx context.Context) (Token, error) {
+		var resp TicketResp
+		if err := api.get(ctx, "/cgi-bin/ticket/getticket", url.Values{"type": []string{"jsapi"}}, &resp); err != nil {
+			return Token{}, fmt.Errorf("fail to get jsapi ticket, %w", err)
+		}
+		return newToken(resp.Ticket, resp.Expires), nil
+	})
+}
+
+// JsConfig is what the H5 page passes to wx.config.
+type JsConfig struct {
+	AppID     string `json:"appId"`
+	Timestamp int64  `json:"timestamp"`
+	NonceStr  string `json:"nonceStr"`
+	Signature string `json:"signature"`
+}
+
+type jsSDK struct {
+	appID  string
+	ticket *tokenManager
+}
+
+func newJsSDK(appID string, ticket *tokenManager) *jsSDK {
+	return &jsSDK{appID: appID, ticket: ticket}
+}
+
+func (js *jsSDK) Config(ctx context.Context, pageUrl string) (JsConfig, error) {
+	ticket, err := js.ticket.Token(ctx)
+	if err != nil {
+		return JsConfig{}, fmt.Errorf("fail to get jsapi ticket, %w", err)
+	}
+
+	cfg := JsConfig{
+		AppID:     js.appID,
+		Timestamp: time.Now().Unix(),
+		NonceStr:  nonceStr(16),
+	}
+	cfg.Signature = JsSignature(ticket, cfg.NonceStr, cfg.Timestamp, pageUrl)
+	return cfg, nil
+}
+
+// JsSignature signs the page url for wx.config, the fragment is not part of the signed url.
+func JsSignature(ticket, nonceStr string, timestamp int64, pageUrl string) string {
+	if idx := strings.Index(pageUrl, "#"); idx >= 0 {
+		pageUrl = pageUrl[:idx]
+	}
+	plain := fmt.Sprintf("jsapi_ticket=%s&noncestr=%s&timestamp=%d&url=%s", ticket, nonceStr, timestamp, pageUrl)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(plain)))
+}
+
+func nonceStr(n int) string {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = nonceLetters[rand.Intn(len(nonceLetters))]
+	}
+	return string(buf)
+}
+
+func (js *jsSDK) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("/signature", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		tracer := jsTracer(ctx)
+
+		pageUrl := context.Query("url")
+		if pageUrl == "" {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+			return
+		}
+
+		cfg, err := js.Config(ctx, pageUrl)
+		if err != nil {
+			tracer.Errorf("fail to sign page %s, %s", pageUrl, err.Error())
+			context.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, cfg)
+	})
+}
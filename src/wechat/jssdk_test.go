@@ -0,0 +1,19 @@
+package wechat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsSignature(t *testing.T) {
+	rq := require.New(t)
+
+	// example from the official js-sdk document
+	ticket := "sM4AOVdWfPE4DxkXGEs8VMCPGGVi4C3VM0P37wVUCFvkVAy_90u5h9nbSlYy3-Sl-HhTdfl2fzFy1AOcHKP7qg"
+	signature := JsSignature(ticket, "Wm3WZYTPz0wzccnW", 1414587457, "http://mp.weixin.qq.com?params=value")
+	rq.Equal("0f9de62fce790f9a083d5c99e95740ceb90c27ed", signature)
+
+	// fragment must be dropped
+	rq.Equal(signature, JsSignature(ticket, "Wm3WZYTPz0wzccnW", 1414587457, "http://mp.weixin.qq.com?params=value#top"))
+}
@@ -0,0 +1,457 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	maxTopButtons    = 3
+	maxSubButtons    = 5
+	maxTopNameBytes  = 16
+	maxSubNameBytes  = 60
+	maxKeyBytes      = 128
+	maxUrlBytes      = 1024
+	defaultMenuLabel = "default"
+)
+
+var menuTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "menu").WithContext(ctx)
+}
+
+type MenuButton struct {
+	Type      string       `json:"type,omitempty"`
+	Name      string       `json:"name"`
+	Key       string       `json:"key,omitempty"`
+	Url       string       `json:"url,omitempty"`
+	MediaID   string       `json:"media_id,omitempty"`
+	ArticleID string       `json:"article_id,omitempty"`
+	AppID     string       `json:"appid,omitempty"`
+	PagePath  string       `json:"pagepath,omitempty"`
+	SubButton []MenuButton `json:"sub_button,omitempty"`
+}
+
+// MatchRule selects the users a conditional menu is shown to.
+type MatchRule struct {
+	TagID              string `json:"tag_id,omitempty"`
+	ClientPlatformType string `json:"client_platform_type,omitempty"`
+}
+
+func (rule MatchRule) String() string {
+	var parts []string
+	if rule.TagID != "" {
+		parts = append(parts, "tag_id="+rule.TagID)
+	}
+	if rule.ClientPlatformType != "" {
+		parts = append(parts, "client_platform_type="+rule.ClientPlatformType)
+	}
+	return strings.Join(parts, ",")
+}
+
+type Menu struct {
+	Button    []MenuButton `json:"button"`
+	MatchRule *MatchRule   `json:"matchrule,omitempty"`
+	MenuID    int64        `json:"menuid,omitempty"`
+}
+
+func (menu Menu) label() string {
+	if menu.MatchRule == nil {
+		return defaultMenuLabel
+	}
+	return "conditional(" + menu.MatchRule.String() + ")"
+}
+
+// MenuDefinition is the versioned menu kept in the repo, see deploy/menu.yaml.
+type MenuDefinition struct {
+	Version     string `json:"version"`
+	Default     Menu   `json:"default"`
+	Conditional []Menu `json:"conditional,omitempty"`
+}
+
+// LiveMenu is what menu/get returns.
+type LiveMenu struct {
+	Menu            Menu   `json:"menu"`
+	ConditionalMenu []Menu `json:"conditionalmenu,omitempty"`
+}
+
+// ParseMenuDefinition accepts json or yaml, json being a subset of yaml.
+func ParseMenuDefinition(raw []byte) (MenuDefinition, error) {
+	var def MenuDefinition
+
+	var generic interface{}
+	if err := yaml.Unmarshal(raw, &generic); err != nil {
+		return def, fmt.Errorf("fail to parse menu definition, %w", err)
+	}
+	converted, err := json.Marshal(generic)
+	if err != nil {
+		return def, fmt.Errorf("fail to convert menu definition, %w", err)
+	}
+	if err := json.Unmarshal(converted, &def); err != nil {
+		return def, fmt.Errorf("fail to decode menu definition, %w", err)
+	}
+	return def, nil
+}
+
+// Validate checks the limits wechat enforces, so that a bad definition is rejected
+// before the live menu is touched.
+func (def MenuDefinition) Validate() error {
+	var errs []string
+
+	if def.Default.MatchRule != nil {
+		errs = append(errs, "default menu must not have a matchrule")
+	}
+	errs = append(errs, validateMenu(def.Default)...)
+
+	rules := make(map[string]bool)
+	for _, menu := range def.Conditional {
+		if menu.MatchRule == nil || menu.MatchRule.String() == "" {
+			errs = append(errs, "conditional menu must have a non empty matchrule")
+			continue
+		}
+		rule := menu.MatchRule.String()
+		if rules[rule] {
+			errs = append(errs, fmt.Sprintf("duplicated matchrule %s", rule))
+		}
+		rules[rule] = true
+		errs = append(errs, validateMenu(menu)...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid menu definition: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateMenu(menu Menu) []string {
+	var errs []string
+	label := menu.label()
+
+	if len(menu.Button) == 0 || len(menu.Button) > maxTopButtons {
+		errs = append(errs, fmt.Sprintf("%s: expect 1-%d buttons, got %d", label, maxTopButtons, len(menu.Button)))
+	}
+
+	keys := make(map[string]string)
+	checkKey := func(path string, button MenuButton) {
+		if button.Key == "" {
+			return
+		}
+		if other, ok := keys[button.Key]; ok {
+			errs = append(errs, fmt.Sprintf("%s: key %s used by both %s and %s", label, button.Key, other, path))
+		}
+		keys[button.Key] = path
+	}
+	// the diff tells the buttons apart by path
+	paths := make(map[string]bool)
+	checkPath := func(path string) {
+		if paths[path] {
+			errs = append(errs, fmt.Sprintf("%s: %q used by more than one button", label, path))
+		}
+		paths[path] = true
+	}
+
+	for _, button := range menu.Button {
+		path := button.Name
+		checkPath(path)
+		if len(button.Name) == 0 || len(button.Name) > maxTopNameBytes {
+			errs = append(errs, fmt.Sprintf("%s: name of %q must be 1-%d bytes", label, path, maxTopNameBytes))
+		}
+
+		if len(button.SubButton) == 0 {
+			errs = append(errs, validateAction(label, path, button)...)
+			checkKey(path, button)
+			continue
+		}
+
+		if button.Type != "" {
+			errs = append(errs, fmt.Sprintf("%s: %q has sub buttons, must not have a type", label, path))
+		}
+		if len(button.SubButton) > maxSubButtons {
+			errs = append(errs, fmt.Sprintf("%s: %q expect at most %d sub buttons, got %d", label, path, maxSubButtons, len(button.SubButton)))
+		}
+		for _, sub := range button.SubButton {
+			subPath := path + "/" + sub.Name
+			checkPath(subPath)
+			if len(sub.Name) == 0 || len(sub.Name) > maxSubNameBytes {
+				errs = append(errs, fmt.Sprintf("%s: name of %q must be 1-%d bytes", label, subPath, maxSubNameBytes))
+			}
+			if len(sub.SubButton) > 0 {
+				errs = append(errs, fmt.Sprintf("%s: %q sub buttons can not be nested", label, subPath))
+			}
+			errs = append(errs, validateAction(label, subPath, sub)...)
+			checkKey(subPath, sub)
+		}
+	}
+	return errs
+}
+
+func validateAction(label, path string, button MenuButton) []string {
+	var errs []string
+	require := func(field, value string, max int) {
+		if value == "" {
+			errs = append(errs, fmt.Sprintf("%s: %q of type %s requires %s", label, path, button.Type, field))
+		} else if max > 0 && len(value) > max {
+			errs = append(errs, fmt.Sprintf("%s: %s of %q exceeds %d bytes", label, field, path, max))
+		}
+	}
+
+	switch button.Type {
+	case "click", "scancode_push", "scancode_waitmsg", "pic_sysphoto", "pic_photo_or_album", "pic_weixin", "location_select":
+		require("key", button.Key, maxKeyBytes)
+	case "view":
+		require("url", button.Url, maxUrlBytes)
+	case "miniprogram":
+		require("url", button.Url, maxUrlBytes)
+		require("appid", button.AppID, 0)
+		require("pagepath", button.PagePath, 0)
+	case "media_id", "view_limited":
+		require("media_id", button.MediaID, 0)
+	case "article_id", "article_view_limited":
+		require("article_id", button.ArticleID, 0)
+	case "":
+		errs = append(errs, fmt.Sprintf("%s: %q requires a type or sub buttons", label, path))
+	default:
+		errs = append(errs, fmt.Sprintf("%s: %q has unknown type %s", label, path, button.Type))
+	}
+	return errs
+}
+
+/*
+ * diff between the definition and the live menu
+ */
+
+type MenuChange struct {
+	Menu   string `json:"menu"`
+	Op     string `json:"op"` // add, remove, change
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DiffMenu lists what applying the definition would change on the live menu.
+func DiffMenu(def MenuDefinition, live LiveMenu) []MenuChange {
+	var changes []MenuChange
+
+	if len(live.Menu.Button) == 0 {
+		changes = append(changes, MenuChange{Menu: defaultMenuLabel, Op: "add"})
+	} else {
+		changes = append(changes, diffButtons(defaultMenuLabel, def.Default.Button, live.Menu.Button)...)
+	}
+
+	liveByRule := make(map[string]Menu)
+	for _, menu := range live.ConditionalMenu {
+		if menu.MatchRule != nil {
+			liveByRule[menu.MatchRule.String()] = menu
+		}
+	}
+	for _, menu := range def.Conditional {
+		rule := menu.MatchRule.String()
+		liveMenu, ok := liveByRule[rule]
+		if !ok {
+			changes = append(changes, MenuChange{Menu: menu.label(), Op: "add"})
+			continue
+		}
+		delete(liveByRule, rule)
+		changes = append(changes, diffButtons(menu.label(), menu.Button, liveMenu.Button)...)
+	}
+
+	var removed []string
+	for rule := range liveByRule {
+		removed = append(removed, rule)
+	}
+	sort.Strings(removed)
+	for _, rule := range removed {
+		changes = append(changes, MenuChange{Menu: liveByRule[rule].label(), Op: "remove"})
+	}
+	return changes
+}
+
+type flatButton struct {
+	index  string
+	action string
+}
+
+// flatten keys the buttons by path. The live menu is not validated, a path used twice
+// there is told apart by the position, so no button is lost to another.
+func flatten(buttons []MenuButton) (map[string]flatButton, []string) {
+	flat := make(map[string]flatButton)
+	var order []string
+	add := func(path, index string, button MenuButton) {
+		if _, ok := flat[path]; ok {
+			path += "@" + index
+		}
+		flat[path] = flatButton{index: index, action: describeAction(button)}
+		order = append(order, path)
+	}
+	for i, button := range buttons {
+		add(button.Name, fmt.Sprint(i), button)
+		for j, sub := range button.SubButton {
+			add(button.Name+"/"+sub.Name, fmt.Sprintf("%d.%d", i, j), sub)
+		}
+	}
+	return flat, order
+}
+
+func describeAction(button MenuButton) string {
+	if len(button.SubButton) > 0 {
+		return "sub_buttons"
+	}
+	parts := []string{"type=" + button.Type}
+	for _, field := range []struct{ name, value string }{
+		{"key", button.Key}, {"url", button.Url}, {"media_id", button.MediaID},
+		{"article_id", button.ArticleID}, {"appid", button.AppID}, {"pagepath", button.PagePath},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+"="+field.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func diffButtons(label string, want, have []MenuButton) []MenuChange {
+	var changes []MenuChange
+
+	wantFlat, wantOrder := flatten(want)
+	haveFlat, haveOrder := flatten(have)
+
+	for _, path := range wantOrder {
+		w := wantFlat[path]
+		h, ok := haveFlat[path]
+		switch {
+		case !ok:
+			changes = append(changes, MenuChange{Menu: label, Op: "add", Path: path, Detail: w.action})
+		case w.action != h.action:
+			changes = append(changes, MenuChange{Menu: label, Op: "change", Path: path, Detail: h.action + " -> " + w.action})
+		case w.index != h.index:
+			changes = append(changes, MenuChange{Menu: label, Op: "change", Path: path, Detail: "position " + h.index + " -> " + w.index})
+		}
+	}
+	for _, path := range haveOrder {
+		if _, ok := wantFlat[path]; !ok {
+			changes = append(changes, MenuChange{Menu: label, Op: "remove", Path: path, Detail: haveFlat[path].action})
+		}
+	}
+	return changes
+}
+
+/*
+ * wechat menu apis
+ */
+
+type MenuManager struct {
+	api *apiClient
+}
+
+func newMenuManager(api *apiClient) *MenuManager {
+	return &MenuManager{api: api}
+}
+
+func (mm *MenuManager) Live(ctx context.Context) (LiveMenu, error) {
+	var live LiveMenu
+	err := mm.api.get(ctx, "/cgi-bin/menu/get", nil, &live)
+	if apiErr, ok := err.(ApiError); ok && apiErr.ErrCode == errCodeMenuNotExist {
+		return live, nil
+	}
+	return live, err
+}
+
+// Apply replaces the live menu by the definition, conditional menus are recreated
+// because wechat can not update them in place.
+func (mm *MenuManager) Apply(ctx context.Context, def MenuDefinition, live LiveMenu) error {
+	tracer := menuTracer(ctx)
+
+	if err := mm.api.post(ctx, "/cgi-bin/menu/create", Menu{Button: def.Default.Button}, nil); err != nil {
+		return fmt.Errorf("fail to create default menu, %w", err)
+	}
+	tracer.Infof("default menu created, version=%s", def.Version)
+
+	for _, menu := range live.ConditionalMenu {
+		if err := mm.api.post(ctx, "/cgi-bin/menu/delconditional", map[string]int64{"menuid": menu.MenuID}, nil); err != nil {
+			return fmt.Errorf("fail to delete conditional menu %d, %w", menu.MenuID, err)
+		}
+	}
+	for _, menu := range def.Conditional {
+		if err := mm.api.post(ctx, "/cgi-bin/menu/addconditional", Menu{Button: menu.Button, MatchRule: menu.MatchRule}, nil); err != nil {
+			return fmt.Errorf("fail to add %s, %w", menu.label(), err)
+		}
+		tracer.Infof("%s created, version=%s", menu.label(), def.Version)
+	}
+	return nil
+}
+
+func (mm *MenuManager) Delete(ctx context.Context) error {
+	return mm.api.get(ctx, "/cgi-bin/menu/delete", nil, nil)
+}
+
+func (mm *MenuManager) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		live, err := mm.Live(ctx)
+		if err != nil {
+			menuTracer(ctx).Errorf("fail to get live menu, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, live)
+	})
+
+	// the definition is posted as json or yaml, dry_run=true only reports the diff
+	group.POST("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		tracer := menuTracer(ctx)
+
+		raw, err := io.ReadAll(context.Request.Body)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		def, err := ParseMenuDefinition(raw)
+		if err == nil {
+			err = def.Validate()
+		}
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		live, err := mm.Live(ctx)
+		if err != nil {
+			tracer.Errorf("fail to get live menu, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		changes := DiffMenu(def, live)
+		dryRun := context.Query("dry_run") == "true"
+		if dryRun || len(changes) == 0 {
+			context.JSON(http.StatusOK, gin.H{"version": def.Version, "applied": false, "changes": changes})
+			return
+		}
+
+		if err := mm.Apply(ctx, def, live); err != nil {
+			tracer.Errorf("fail to apply menu version %s, %s", def.Version, err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "changes": changes})
+			return
+		}
+		tracer.Infof("menu version %s applied, %d changes", def.Version, len(changes))
+		context.JSON(http.StatusOK, gin.H{"version": def.Version, "applied": true, "changes": changes})
+	})
+
+	group.DELETE("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		if err := mm.Delete(ctx); err != nil {
+			menuTracer(ctx).Errorf("fail to delete menu, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		menuTracer(ctx).Info("menu deleted")
+		context.Status(http.StatusOK)
+	})
+}
@@ -0,0 +1,152 @@
+package wechat
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMenuDefinition(t *testing.T) {
+	t.Run("deploy menu", func(t *testing.T) {
+		rq := require.New(t)
+
+		raw, err := os.ReadFile("../../deploy/menu.yaml")
+		rq.NoError(err)
+		def, err := ParseMenuDefinition(raw)
+		rq.NoError(err)
+		rq.NoError(def.Validate())
+		rq.NotEmpty(def.Version)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		rq := require.New(t)
+
+		def, err := ParseMenuDefinition([]byte(`{"version":"1","default":{"button":[{"type":"click","name":"a","key":"A"}]}}`))
+		rq.NoError(err)
+		rq.NoError(def.Validate())
+		rq.Equal("A", def.Default.Button[0].Key)
+	})
+
+	invalid := map[string]string{
+		"too many buttons": `
+default:
+  button:
+    - {type: click, name: a, key: A}
+    - {type: click, name: b, key: B}
+    - {type: click, name: c, key: C}
+    - {type: click, name: d, key: D}`,
+		"name too long": `
+default:
+  button:
+    - {type: click, name: 一二三四五六, key: A}`,
+		"missing url": `
+default:
+  button:
+    - {type: view, name: a}`,
+		"duplicated key": `
+default:
+  button:
+    - {type: click, name: a, key: A}
+    - name: b
+      sub_button:
+        - {type: click, name: c, key: A}`,
+		"nested sub buttons": `
+default:
+  button:
+    - name: a
+      sub_button:
+        - name: b
+          sub_button:
+            - {type: click, name: c, key: C}`,
+		"duplicated sub button": `
+default:
+  button:
+    - name: m
+      sub_button:
+        - {type: click, name: a, key: A}
+        - {type: click, name: a, key: B}`,
+		"duplicated matchrule": `
+default:
+  button:
+    - {type: click, name: a, key: A}
+conditional:
+  - matchrule: {tag_id: "1"}
+    button:
+      - {type: click, name: a, key: A}
+  - matchrule: {tag_id: "1"}
+    button:
+      - {type: click, name: b, key: B}`,
+	}
+	for name, raw := range invalid {
+		t.Run(name, func(t *testing.T) {
+			rq := require.New(t)
+
+			def, err := ParseMenuDefinition([]byte(raw))
+			rq.NoError(err)
+			rq.Error(def.Validate())
+		})
+	}
+}
+
+func TestDiffMenu(t *testing.T) {
+	rq := require.New(t)
+
+	def := MenuDefinition{
+		Default: Menu{Button: []MenuButton{
+			{Type: "click", Name: "a", Key: "A2"},
+			{Type: "click", Name: "c", Key: "C"},
+			{Type: "click", Name: "b", Key: "B"},
+		}},
+		Conditional: []Menu{
+			{MatchRule: &MatchRule{TagID: "1"}, Button: []MenuButton{{Type: "click", Name: "a", Key: "A"}}},
+		},
+	}
+
+	t.Run("empty live menu", func(t *testing.T) {
+		changes := DiffMenu(def, LiveMenu{})
+		rq.Equal([]MenuChange{
+			{Menu: defaultMenuLabel, Op: "add"},
+			{Menu: "conditional(tag_id=1)", Op: "add"},
+		}, changes)
+	})
+
+	t.Run("live menu", func(t *testing.T) {
+		live := LiveMenu{
+			Menu: Menu{Button: []MenuButton{
+				{Type: "click", Name: "a", Key: "A"},
+				{Type: "click", Name: "b", Key: "B"},
+				{Type: "click", Name: "d", Key: "D"},
+			}},
+			ConditionalMenu: []Menu{
+				{MatchRule: &MatchRule{TagID: "1"}, MenuID: 1, Button: []MenuButton{{Type: "click", Name: "a", Key: "A"}}},
+				{MatchRule: &MatchRule{TagID: "2"}, MenuID: 2, Button: []MenuButton{{Type: "click", Name: "a", Key: "A"}}},
+			},
+		}
+
+		changes := DiffMenu(def, live)
+		rq.Equal([]MenuChange{
+			{Menu: defaultMenuLabel, Op: "change", Path: "a", Detail: "type=click key=A -> type=click key=A2"},
+			{Menu: defaultMenuLabel, Op: "add", Path: "c", Detail: "type=click key=C"},
+			{Menu: defaultMenuLabel, Op: "change", Path: "b", Detail: "position 1 -> 2"},
+			{Menu: defaultMenuLabel, Op: "remove", Path: "d", Detail: "type=click key=D"},
+			{Menu: "conditional(tag_id=2)", Op: "remove"},
+		}, changes)
+	})
+
+	t.Run("no change", func(t *testing.T) {
+		live := LiveMenu{Menu: def.Default, ConditionalMenu: def.Conditional}
+		rq.Empty(DiffMenu(def, live))
+	})
+	t.Run("name used twice in the live menu", func(t *testing.T) {
+		want := MenuDefinition{Default: Menu{Button: []MenuButton{
+			{Name: "m", SubButton: []MenuButton{{Type: "click", Name: "x", Key: "X"}}},
+		}}}
+		live := LiveMenu{Menu: Menu{Button: []MenuButton{
+			{Name: "m", SubButton: []MenuButton{{Type: "click", Name: "x", Key: "X"}, {Type: "click", Name: "x", Key: "Y"}}},
+		}}}
+		rq.Equal([]MenuChange{
+			{Menu: defaultMenuLabel, Op: "remove", Path: "m/x@0.1", Detail: "type=click key=Y"},
+		}, DiffMenu(want, live))
+	})
+}
@@ -1,22 +1,62 @@
 package wechat
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
+
+	"github.com/hanzezhenalex/wechat/src/metrics"
 )
 
 const (
 	msgText  = "text"
 	msgImage = "image"
+	msgEvent = "event"
+)
 
-	notSupportYet       = "尚不支持当前消息类型"
-	serverInternalError = "服务器出现故障，请联系管理员"
-	userNotRegistered   = "当前用户并未注册，不能使用本服务"
-
-	duplicated   = "请勿重复上传"
-	deduplicated = "成功"
+// outcomes of the messages, counted by wechat_messages_total
+const (
+	outcomeRegistration  = "registration"
+	outcomeNotRegistered = "not_registered"
+	outcomeError         = "error"
+	outcomeDuplicated    = "duplicated"
+	outcomeDeduplicated  = "deduplicated"
+	outcomeNotSupported  = "not_supported"
+	outcomeRateLimited   = "rate_limited"
+	outcomeQuotaExceeded = "quota_exceeded"
+	outcomeShed          = "shed"
+	outcomeDeadLettered  = "dead_lettered"
 )
 
+var messagesTotal = metrics.NewCounterVec("wechat_messages_total",
+	"Messages pushed to the portal by type and outcome.", "msg_type", "outcome")
+
+type outcomeKey struct{}
+
+// messageOutcome holds the outcome counted while a message is processed, e.g. for the archive.
+// It is set on a worker of the pipeline, so it is atomic.
+type messageOutcome struct {
+	value atomic.Value
+}
+
+func withOutcome(ctx context.Context, outcome *messageOutcome) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, outcome)
+}
+
+func (o *messageOutcome) get() string {
+	outcome, _ := o.value.Load().(string)
+	return outcome
+}
+
+// countMessage counts the outcome of the message, and records it if ctx is withOutcome.
+func countMessage(ctx context.Context, msgType, outcome string) {
+	messagesTotal.Inc(msgType, outcome)
+	if o, ok := ctx.Value(outcomeKey{}).(*messageOutcome); ok {
+		o.value.Store(outcome)
+	}
+}
+
 type Message struct {
 	ToUserName   string `xml:"ToUserName"`
 	FromUserName string `xml:"FromUserName"`
@@ -26,6 +66,9 @@ type Message struct {
 	Content      string `xml:"Content"`
 	PicUrl       string `xml:"PicUrl"`
 	MediaId      string `xml:"MediaId"`
+	Event        string `xml:"Event"`
+	EventKey     string `xml:"EventKey"`
+	Ticket       string `xml:"Ticket"`
 	// TODO: not work, why?
 	Others map[string]interface{} `xml:",innerxml"`
 }
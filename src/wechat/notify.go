@@ -0,0 +1,321 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	notifyQueueSize        = 256
+	notifyWorkers          = 2
+	notifyRetryInterval    = time.Second
+	maxNotifyRetryInterval = time.Minute
+	// notifyDrainTimeout bounds the sending of the notifications queued when stopped
+	notifyDrainTimeout = 5 * time.Second
+
+	notifyReview = "review"
+	notifyResult = "result"
+
+	errCodeSystemBusy   = -1
+	errCodeApiFreqLimit = 45009
+)
+
+var notifyTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "notifier").WithContext(ctx)
+}
+
+// TemplateMessage is the body of message/template/send.
+type TemplateMessage struct {
+	ToUser     string                   `json:"touser"`
+	TemplateID string                   `json:"template_id"`
+	Url        string                   `json:"url,omitempty"`
+	Data       map[string]TemplateValue `json:"data"`
+}
+
+type TemplateValue struct {
+	Value string `json:"value"`
+}
+
+// Notification is what the url and data of a template are rendered with.
+type Notification struct {
+	Record datastore.RecordInfo
+	Owner  datastore.UserInfo
+	Status string // label of the record status, e.g. 已驳回
+	Time   string
+}
+
+type notifyTemplate struct {
+	id   string
+	url  *template.Template
+	data map[string]*template.Template
+}
+
+// newNotifyTemplate returns nil when the template is not configured.
+func newNotifyTemplate(name string, cfg src.NotifyTemplate) (*notifyTemplate, error) {
+	if cfg.TemplateID == "" {
+		return nil, nil
+	}
+
+	parse := func(key, text string) (*template.Template, error) {
+		tmpl, err := template.New(name + "." + key).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse %s of %s template, %w", key, name, err)
+		}
+		// unknown fields are only reported on execution
+		if err := tmpl.Execute(io.Discard, Notification{}); err != nil {
+			return nil, fmt.Errorf("invalid %s of %s template, %w", key, name, err)
+		}
+		return tmpl, nil
+	}
+
+	nt := &notifyTemplate{id: cfg.TemplateID, data: make(map[string]*template.Template, len(cfg.Data))}
+	var err error
+	if nt.url, err = parse("url", cfg.Url); err != nil {
+		return nil, err
+	}
+	for key, text := range cfg.Data {
+		if nt.data[key], err = parse(key, text); err != nil {
+			return nil, err
+		}
+	}
+	return nt, nil
+}
+
+func (nt *notifyTemplate) render(to string, n Notification) (TemplateMessage, error) {
+	msg := TemplateMessage{
+		ToUser:     to,
+		TemplateID: nt.id,
+		Data:       make(map[string]TemplateValue, len(nt.data)),
+	}
+	execute := func(tmpl *template.Template) (string, error) {
+		var buf strings.Builder
+		err := tmpl.Execute(&buf, n)
+		return buf.String(), err
+	}
+
+	var err error
+	if msg.Url, err = execute(nt.url); err != nil {
+		return msg, fmt.Errorf("fail to render url, %w", err)
+	}
+	for key, tmpl := range nt.data {
+		value, err := execute(tmpl)
+		if err != nil {
+			return msg, fmt.Errorf("fail to render %s, %w", key, err)
+		}
+		msg.Data[key] = TemplateValue{Value: value}
+	}
+	return msg, nil
+}
+
+type notifyJob struct {
+	ctx  context.Context
+	kind string
+	msg  TemplateMessage
+}
+
+// Notifier tells leaders about records to review and submitters about the review result
+// by template messages. Messages are sent in the background, failures are retried with backoff.
+type Notifier struct {
+	api         *apiClient
+	ums         *UserMngr
+	review      *notifyTemplate
+	result      *notifyTemplate
+	maxAttempts int
+
+	queue    chan notifyJob
+	stopping chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newNotifier(cfg src.NotifyConfig, api *apiClient, ums *UserMngr) (*Notifier, error) {
+	review, err := newNotifyTemplate(notifyReview, cfg.Review)
+	if err != nil {
+		return nil, err
+	}
+	result, err := newNotifyTemplate(notifyResult, cfg.Result)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		api:         api,
+		ums:         ums,
+		review:      review,
+		result:      result,
+		maxAttempts: cfg.MaxAttempts,
+		queue:       make(chan notifyJob, notifyQueueSize),
+		stopping:    make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	if n.maxAttempts <= 0 {
+		n.maxAttempts = 1
+	}
+
+	for i := 0; i < notifyWorkers; i++ {
+		n.wg.Add(1)
+		go n.worker()
+	}
+	return n, nil
+}
+
+// RecordSubmitted tells the leader of the owner that a record is waiting for confirm.
+func (n *Notifier) RecordSubmitted(ctx context.Context, record datastore.RecordInfo) {
+	tracer := notifyTracer(ctx)
+
+	owner, ok := n.ums.GetUserById(ctx, record.OwnerID)
+	if !ok || owner.LeaderID == "" {
+		tracer.Debugf("no leader to notify for user %s", record.OwnerID)
+		return
+	}
+	// leaders who are not registered can not opt out
+	if leader, ok := n.ums.GetUserById(ctx, owner.LeaderID); ok && leader.MuteNotify {
+		tracer.Debugf("leader %s opted out of notifications", leader.WechatID)
+		return
+	}
+	n.enqueue(ctx, notifyReview, n.review, owner.LeaderID, owner, record)
+}
+
+// RecordReviewed tells the owner that the record is confirmed or denied.
+func (n *Notifier) RecordReviewed(ctx context.Context, record datastore.RecordInfo) {
+	owner, ok := n.ums.GetUserById(ctx, record.OwnerID)
+	if !ok {
+		owner = datastore.UserInfo{WechatID: record.OwnerID}
+	}
+	if owner.MuteNotify {
+		notifyTracer(ctx).Debugf("user %s opted out of notifications", owner.WechatID)
+		return
+	}
+	n.enqueue(ctx, notifyResult, n.result, owner.WechatID, owner, record)
+}
+
+func (n *Notifier) enqueue(ctx context.Context, kind string, nt *notifyTemplate, to string, owner datastore.UserInfo, record datastore.RecordInfo) {
+	tracer := notifyTracer(ctx)
+	if nt == nil {
+		tracer.Debugf("%s notification not configured", kind)
+		return
+	}
+
+	msg, err := nt.render(to, Notification{
+		Record: record,
+		Owner:  owner,
+		Status: statusLabels[record.Status.String()],
+		Time:   time.Now().Format("2006-01-02 15:04"),
+	})
+	if err != nil {
+		tracer.Errorf("fail to render %s notification, %s", kind, err.Error())
+		return
+	}
+
+	select {
+	case n.queue <- notifyJob{ctx: src.DetachContext(ctx), kind: kind, msg: msg}:
+	default:
+		tracer.Errorf("notify queue is full, %s notification to %s dropped", kind, to)
+	}
+}
+
+func (n *Notifier) worker() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case job := <-n.queue:
+			n.send(job)
+		case <-n.stopping:
+			// the queue is drained before exit
+			select {
+			case job := <-n.queue:
+				n.send(job)
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (n *Notifier) send(job notifyJob) {
+	tracer := notifyTracer(job.ctx)
+
+	for attempt := 1; ; attempt++ {
+		err := n.api.post(job.ctx, "/cgi-bin/message/template/send", job.msg, nil)
+		if err == nil {
+			tracer.Infof("%s notification sent to %s", job.kind, job.msg.ToUser)
+			return
+		}
+		if attempt >= n.maxAttempts || !retriable(err) {
+			tracer.Errorf("fail to send %s notification to %s after %d attempts, %s",
+				job.kind, job.msg.ToUser, attempt, err.Error())
+			return
+		}
+
+		interval := notifyBackoff(attempt)
+		tracer.Warningf("fail to send %s notification to %s, retry in %s, %s",
+			job.kind, job.msg.ToUser, interval.String(), err.Error())
+		select {
+		case <-n.ctx.Done():
+			tracer.Warningf("notifier stopped, %s notification to %s dropped", job.kind, job.msg.ToUser)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// retriable tells whether sending again may succeed, errors like an unsubscribed
+// user or a bad template are not going away.
+func retriable(err error) bool {
+	var apiErr ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrCode == errCodeSystemBusy || apiErr.ErrCode == errCodeApiFreqLimit
+	}
+	return true
+}
+
+func notifyBackoff(attempt int) time.Duration {
+	interval := notifyRetryInterval
+	for i := 1; i < attempt && interval < maxNotifyRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxNotifyRetryInterval {
+		interval = maxNotifyRetryInterval
+	}
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// Stop sends the pending notifications within notifyDrainTimeout and waits for the workers,
+// the ones left then are dropped.
+func (n *Notifier) Stop() {
+	close(n.stopping)
+	drained := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(notifyDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	}
+	n.cancel()
+	<-drained
+	if left := len(n.queue); left > 0 {
+		notifyTracer(n.ctx).Warningf("notifier stopped, %d notifications dropped", left)
+	}
+}
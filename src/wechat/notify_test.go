@@ -0,0 +1,52 @@
+package wechat
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+func TestNotifyTemplate(t *testing.T) {
+	rq := require.New(t)
+
+	nt, err := newNotifyTemplate(notifyResult, src.NotifyTemplate{})
+	rq.NoError(err)
+	rq.Nil(nt, "template without id is disabled")
+
+	_, err = newNotifyTemplate(notifyResult, src.NotifyTemplate{
+		TemplateID: "id",
+		Data:       map[string]string{"first": "{{.Record.Unknown}}"},
+	})
+	rq.Error(err)
+
+	nt, err = newNotifyTemplate(notifyResult, src.NotifyTemplate{
+		TemplateID: "id",
+		Url:        "https://wx.example.com/h5/records?id={{.Record.ID}}",
+		Data:       map[string]string{"first": "{{.Owner.Name}}，图片{{.Status}}", "remark": "{{.Record.DenyReason}}"},
+	})
+	rq.NoError(err)
+
+	msg, err := nt.render("user_1", Notification{
+		Record: datastore.RecordInfo{ID: 7, DenyReason: "图片模糊"},
+		Owner:  datastore.UserInfo{Name: "张三"},
+		Status: "已驳回",
+	})
+	rq.NoError(err)
+	rq.Equal("user_1", msg.ToUser)
+	rq.Equal("https://wx.example.com/h5/records?id=7", msg.Url)
+	rq.Equal("张三，图片已驳回", msg.Data["first"].Value)
+	rq.Equal("图片模糊", msg.Data["remark"].Value)
+}
+
+func TestRetriable(t *testing.T) {
+	rq := require.New(t)
+
+	rq.True(retriable(ApiError{ErrCode: errCodeSystemBusy}))
+	rq.False(retriable(ApiError{ErrCode: 43004})) // user unsubscribed
+	rq.True(retriable(fmt.Errorf("fail to send req, %w", io.ErrUnexpectedEOF)))
+}
@@ -0,0 +1,314 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	ScopeBase     = "snsapi_base"
+	ScopeUserInfo = "snsapi_userinfo"
+
+	sessionCookie = "wechat_session"
+	stateCookie   = "wechat_oauth_state"
+
+	sessionTTL = 7 * 24 * time.Hour
+	stateTTL   = 10 * time.Minute
+
+	// gin context keys set by RequireSession
+	ctxSessionKey = "wechat_session"
+	ctxUserKey    = "wechat_user"
+)
+
+var oauthTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "oauth").WithContext(ctx)
+}
+
+type OAuthTokenResp struct {
+	AccessToken  string `json:"access_token"`
+	Expires      int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	OpenID       string `json:"openid"`
+	Scope        string `json:"scope"`
+}
+
+type OAuthUserInfo struct {
+	OpenID     string `json:"openid"`
+	Nickname   string `json:"nickname"`
+	HeadImgUrl string `json:"headimgurl"`
+}
+
+// OAuth implements the web authorization flow for H5 pages opened inside wechat,
+// the authorized browser gets a signed session cookie bound to a registered user.
+type OAuth struct {
+	appID         string
+	appSecret     string
+	apiBaseUrl    string
+	authorizeUrl  string
+	publicBaseUrl string
+
+	// set when the endpoints are registered
+	authorizePath string
+	callbackPath  string
+
+	client   *http.Client
+	sessions *sessionCodec
+	ums      *UserMngr
+}
+
+func NewOAuth(cfg src.Config, ums *UserMngr) (*OAuth, error) {
+	sessions, err := newSessionCodec(cfg.SessionSecret, cfg.AppSecret)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create session codec, %w", err)
+	}
+	return &OAuth{
+		appID:         cfg.AppID,
+		appSecret:     cfg.AppSecret,
+		apiBaseUrl:    cfg.ApiBaseUrl,
+		authorizeUrl:  cfg.OAuthAuthorizeUrl,
+		publicBaseUrl: strings.TrimSuffix(cfg.PublicBaseUrl, "/"),
+		client:        &http.Client{Timeout: fetchTimeout},
+		sessions:      sessions,
+		ums:           ums,
+	}, nil
+}
+
+func (o *OAuth) RegisterEndpoints(group *gin.RouterGroup) {
+	o.authorizePath = group.BasePath() + "/authorize"
+	o.callbackPath = group.BasePath() + "/callback"
+	group.GET("/authorize", o.authorize)
+	group.GET("/callback", o.callback)
+}
+
+// authorize redirects the browser to wechat, the page to come back to is kept in a signed cookie.
+func (o *OAuth) authorize(context *gin.Context) {
+	ctx := context.Request.Context()
+
+	scope := context.DefaultQuery("scope", ScopeBase)
+	if scope != ScopeBase && scope != ScopeUserInfo {
+		context.String(http.StatusBadRequest, "unknown scope %s", scope)
+		return
+	}
+
+	state := oauthState{
+		Nonce:    nonceStr(16),
+		Redirect: safeRedirect(context.Query("redirect")),
+		ExpireAt: time.Now().Add(stateTTL).Unix(),
+	}
+	value, err := o.sessions.encodeState(state)
+	if err != nil {
+		oauthTracer(ctx).Errorf("fail to encode oauth state, %s", err.Error())
+		context.Status(http.StatusInternalServerError)
+		return
+	}
+	o.setCookie(context, stateCookie, value, stateTTL)
+
+	query := url.Values{}
+	query.Set("appid", o.appID)
+	query.Set("redirect_uri", o.publicBaseUrl+o.callbackPath)
+	query.Set("response_type", "code")
+	query.Set("scope", scope)
+	query.Set("state", state.Nonce)
+	context.Redirect(http.StatusFound, o.authorizeUrl+"?"+query.Encode()+"#wechat_redirect")
+}
+
+func (o *OAuth) callback(context *gin.Context) {
+	ctx := context.Request.Context()
+	tracer := oauthTracer(ctx)
+
+	raw, err := context.Cookie(stateCookie)
+	if err != nil {
+		context.String(http.StatusBadRequest, "oauth state missing, please open the page again")
+		return
+	}
+	state, err := o.sessions.decodeState(raw)
+	if err != nil || state.Nonce != context.Query("state") {
+		tracer.Warningf("oauth state mismatch, err=%v", err)
+		context.String(http.StatusBadRequest, "oauth state mismatch, please open the page again")
+		return
+	}
+	o.setCookie(context, stateCookie, "", -1)
+
+	code := context.Query("code")
+	if code == "" {
+		// user refused the authorization
+		context.String(http.StatusForbidden, "authorization refused")
+		return
+	}
+
+	token, err := o.exchange(ctx, code)
+	if err != nil {
+		tracer.Errorf("fail to exchange oauth code, %s", err.Error())
+		context.String(http.StatusBadGateway, "fail to authorize, trace_id=%s", src.GetTraceId(ctx))
+		return
+	}
+
+	session := Session{
+		WechatID: token.OpenID,
+		ExpireAt: time.Now().Add(sessionTTL).Unix(),
+	}
+	if token.Scope == ScopeUserInfo {
+		if info, err := o.userInfo(ctx, token); err != nil {
+			tracer.Warningf("fail to get oauth user info, %s", err.Error())
+		} else {
+			session.Nickname = info.Nickname
+		}
+	}
+
+	if _, ok := o.ums.GetUserById(ctx, session.WechatID); !ok {
+		tracer.Warningf("oauth rejected, user %s not register", session.WechatID)
+		context.String(http.StatusForbidden, replyText(replyUserNotRegistered))
+		return
+	}
+
+	value, err := o.sessions.EncodeSession(session)
+	if err != nil {
+		tracer.Errorf("fail to encode session, %s", err.Error())
+		context.Status(http.StatusInternalServerError)
+		return
+	}
+	o.setCookie(context, sessionCookie, value, sessionTTL)
+
+	tracer.Infof("user %s authorized by oauth", session.WechatID)
+	context.Redirect(http.StatusFound, state.Redirect)
+}
+
+func (o *OAuth) exchange(ctx context.Context, code string) (OAuthTokenResp, error) {
+	var resp OAuthTokenResp
+
+	query := url.Values{}
+	query.Set("appid", o.appID)
+	query.Set("secret", o.appSecret)
+	query.Set("code", code)
+	query.Set("grant_type", "authorization_code")
+
+	err := o.snsGet(ctx, "/sns/oauth2/access_token", query, &resp)
+	return resp, err
+}
+
+func (o *OAuth) userInfo(ctx context.Context, token OAuthTokenResp) (OAuthUserInfo, error) {
+	var info OAuthUserInfo
+
+	query := url.Values{}
+	query.Set("access_token", token.AccessToken)
+	query.Set("openid", token.OpenID)
+	query.Set("lang", "zh_CN")
+
+	err := o.snsGet(ctx, "/sns/userinfo", query, &info)
+	return info, err
+}
+
+// snsGet calls the sns apis, they are authorized by the user's oauth token,
+// not by the access token of the official account.
+func (o *OAuth) snsGet(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.apiBaseUrl+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("fail to create req for %s, %w", path, err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to send req to %s, %w", path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read resp of %s, %w", path, err)
+	}
+	var apiErr ApiError
+	if err := json.Unmarshal(raw, &apiErr); err != nil {
+		return fmt.Errorf("fail to decode resp of %s, %w", path, err)
+	}
+	if apiErr.ErrCode != 0 {
+		return apiErr
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("fail to decode resp of %s, %w", path, err)
+	}
+	return nil
+}
+
+func (o *OAuth) setCookie(context *gin.Context, name, value string, ttl time.Duration) {
+	maxAge := int(ttl / time.Second)
+	if ttl < 0 {
+		maxAge = -1
+	}
+	context.SetSameSite(http.SameSiteLaxMode)
+	context.SetCookie(name, value, maxAge, "/", "", strings.HasPrefix(o.publicBaseUrl, "https://"), true)
+}
+
+// RequireSession authenticates the browser by its session cookie, the user is put into
+// the gin context. Pages are redirected to the authorization, other requests are rejected.
+func (o *OAuth) RequireSession() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		session, err := o.session(context)
+		if err == nil {
+			user, ok := o.ums.GetUserById(ctx, session.WechatID)
+			if ok {
+				context.Set(ctxSessionKey, session)
+				context.Set(ctxUserKey, user)
+				context.Next()
+				return
+			}
+			err = fmt.Errorf("user %s not register", session.WechatID)
+		}
+		oauthTracer(ctx).Debugf("session rejected, %s", err.Error())
+
+		if context.Request.Method == http.MethodGet {
+			context.Redirect(http.StatusFound, o.authorizePath+"?redirect="+url.QueryEscape(context.Request.URL.RequestURI()))
+		} else {
+			context.Status(http.StatusUnauthorized)
+		}
+		context.Abort()
+	}
+}
+
+func (o *OAuth) session(context *gin.Context) (Session, error) {
+	raw, err := context.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, fmt.Errorf("no session cookie")
+	}
+	return o.sessions.DecodeSession(raw)
+}
+
+// UserFromContext returns the user authenticated by RequireSession.
+func UserFromContext(context *gin.Context) (datastore.UserInfo, bool) {
+	val, ok := context.Get(ctxUserKey)
+	if !ok {
+		return datastore.UserInfo{}, false
+	}
+	user, ok := val.(datastore.UserInfo)
+	return user, ok
+}
+
+// SessionFromContext returns the session authenticated by RequireSession.
+func SessionFromContext(context *gin.Context) (Session, bool) {
+	val, ok := context.Get(ctxSessionKey)
+	if !ok {
+		return Session{}, false
+	}
+	session, ok := val.(Session)
+	return session, ok
+}
+
+// safeRedirect only allows local paths, so the flow can not be used as an open redirect.
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
@@ -0,0 +1,143 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+const (
+	shedQueueFull = "queue_full"
+	shedDeadline  = "deadline"
+	shedTimeout   = "timeout"
+)
+
+// replyMargin is left of wechat's timeout to write the reply back.
+const replyMargin = 500 * time.Millisecond
+
+var (
+	errQueueFull = errors.New("pipeline queue is full")
+	errDeadline  = errors.New("message not processed before the deadline")
+	errTimeout   = errors.New("message not done before wechat gives up")
+)
+
+var (
+	pipelineQueueDepth = metrics.NewGaugeFunc("wechat_pipeline_queue_depth",
+		"Messages waiting for a worker.")
+	pipelineBusyWorkers = metrics.NewGaugeFunc("wechat_pipeline_busy_workers",
+		"Workers processing a message.")
+	pipelineWait = metrics.NewHistogramVec("wechat_pipeline_wait_seconds",
+		"Time messages waited for a worker.", nil)
+	pipelineShed = metrics.NewCounterVec("wechat_pipeline_shed_total",
+		"Messages shed by reason, queue_full, deadline or timeout.", "reason")
+)
+
+const (
+	jobQueued int32 = iota
+	jobStarted
+	jobShed
+)
+
+type pipelineJob struct {
+	ctx      context.Context
+	enqueued time.Time
+	msg      Message
+	process  func(ctx context.Context, msg Message) string
+	state    *int32      // queued till a worker starts it or the caller sheds it, atomic
+	reply    chan string // buffered, the worker never blocks on a caller gone
+}
+
+// pipeline runs the messages on a fixed set of workers behind a bounded queue, so a spike
+// can not take more db connections than the workers, and a message waiting too long is shed
+// with a reply before wechat gives up on it.
+type pipeline struct {
+	queue    chan pipelineJob
+	deadline time.Duration
+	// budget bounds a message from queued to done, within wechat's timeout
+	budget time.Duration
+	busy   int32
+
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newPipeline(cfg src.PipelineConfig) *pipeline {
+	p := &pipeline{
+		queue:    make(chan pipelineJob, cfg.QueueSize),
+		deadline: time.Duration(cfg.DeadlineMillis) * time.Millisecond,
+		budget:   time.Duration(src.WechatTimeoutMillis)*time.Millisecond - replyMargin,
+	}
+	pipelineQueueDepth.Set(func() (float64, bool) { return float64(len(p.queue)), true })
+	pipelineBusyWorkers.Set(func() (float64, bool) { return float64(atomic.LoadInt32(&p.busy)), true })
+
+	p.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *pipeline) worker() {
+	defer p.wg.Done()
+	for job := range p.queue {
+		pipelineWait.Observe(time.Since(job.enqueued).Seconds())
+		// the caller has replied busy already
+		if !atomic.CompareAndSwapInt32(job.state, jobQueued, jobStarted) {
+			continue
+		}
+		atomic.AddInt32(&p.busy, 1)
+		job.reply <- job.process(job.ctx, job.msg)
+		atomic.AddInt32(&p.busy, -1)
+	}
+}
+
+// run processes the message on a worker, errQueueFull and errDeadline tell the message is shed
+// as no worker starts it before the deadline. Once started it is waited for, so the reply tells
+// what is done, not to resend what may be saved, but only within the budget: errTimeout tells
+// the processing is cancelled as wechat is about to give up on the message.
+func (p *pipeline) run(ctx context.Context, msg Message, process func(ctx context.Context, msg Message) string) (string, error) {
+	// the processing keeps the trace, not the cancellation of the request
+	jobCtx, cancel := context.WithTimeout(src.DetachContext(ctx), p.budget)
+	defer cancel()
+	job := pipelineJob{ctx: jobCtx, enqueued: time.Now(), msg: msg, process: process,
+		state: new(int32), reply: make(chan string, 1)}
+	select {
+	case p.queue <- job:
+	default:
+		pipelineShed.Inc(shedQueueFull)
+		return "", errQueueFull
+	}
+
+	timer := time.NewTimer(p.deadline)
+	defer timer.Stop()
+	select {
+	case reply := <-job.reply:
+		return reply, nil
+	case <-timer.C:
+	case <-jobCtx.Done():
+	}
+	if atomic.CompareAndSwapInt32(job.state, jobQueued, jobShed) {
+		pipelineShed.Inc(shedDeadline)
+		return "", errDeadline
+	}
+	select {
+	case reply := <-job.reply:
+		return reply, nil
+	case <-jobCtx.Done():
+		pipelineShed.Inc(shedTimeout)
+		return "", errTimeout
+	}
+}
+
+// stop waits for the messages queued, run must not be called any more.
+func (p *pipeline) stop() {
+	p.stopOnce.Do(func() {
+		close(p.queue)
+		p.wg.Wait()
+	})
+}
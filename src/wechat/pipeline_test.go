@@ -0,0 +1,82 @@
+package wechat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hanzezhenalex/wechat/src"
+)
+
+func TestPipeline(t *testing.T) {
+	rq := require.New(t)
+	ctx := context.Background()
+
+	p := newPipeline(src.PipelineConfig{Workers: 1, QueueSize: 1, DeadlineMillis: 200})
+	defer p.stop()
+
+	reply, err := p.run(ctx, Message{Content: "hi"}, func(_ context.Context, msg Message) string {
+		return msg.Content
+	})
+	rq.NoError(err)
+	rq.Equal("hi", reply)
+
+	// the worker is held, one message waits in the queue, the next is shed
+	release := make(chan struct{})
+	started := make(chan struct{})
+	blocked := func(context.Context, Message) string {
+		close(started)
+		<-release
+		return "late"
+	}
+	type result struct {
+		reply string
+		err   error
+	}
+	running := make(chan result, 1)
+	go func() {
+		reply, err := p.run(ctx, Message{}, blocked)
+		running <- result{reply: reply, err: err}
+	}()
+	<-started
+	queued := make(chan error, 1)
+	go func() {
+		_, err := p.run(ctx, Message{}, func(context.Context, Message) string { return "queued" })
+		queued <- err
+	}()
+	rq.Eventually(func() bool { return len(p.queue) == 1 }, time.Second, time.Millisecond)
+
+	_, err = p.run(ctx, Message{}, func(context.Context, Message) string { return "shed" })
+	rq.ErrorIs(err, errQueueFull)
+
+	// the queued one gets no worker before the deadline, the running one is waited for
+	rq.ErrorIs(<-queued, errDeadline)
+	select {
+	case <-running:
+		rq.Fail("the running one replied before it is done")
+	default:
+	}
+	close(release)
+	rq.Equal(result{reply: "late"}, <-running)
+	// the shed one is skipped by the worker
+	rq.Eventually(func() bool { return len(p.queue) == 0 }, time.Second, time.Millisecond)
+
+	reply, err = p.run(ctx, Message{Content: "again"}, func(_ context.Context, msg Message) string {
+		return msg.Content
+	})
+	rq.NoError(err)
+	rq.Equal("again", reply)
+
+	// a message out of the budget is cancelled, not waited for
+	p.budget = 100 * time.Millisecond
+	cancelled := make(chan error, 1)
+	_, err = p.run(ctx, Message{}, func(ctx context.Context, _ Message) string {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return "cancelled"
+	})
+	rq.ErrorIs(err, errTimeout)
+	rq.ErrorIs(<-cancelled, context.DeadlineExceeded)
+}
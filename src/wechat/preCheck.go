@@ -1,13 +1,21 @@
 package wechat
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -15,27 +23,133 @@ import (
 
 var authTracer = logrus.WithField("comp", "wechat_auth")
 
+const (
+	rejectSignature = "signature"
+	rejectTimestamp = "timestamp"
+	rejectNonce     = "nonce"
+)
+
+var portalRejected = metrics.NewCounterVec("wechat_portal_rejected_total",
+	"Portal requests rejected by reason, ip, signature, timestamp or nonce.", "reason")
+
+// encryptedBody is the envelope wechat pushes in the safe mode, msg_signature signs Encrypt.
+type encryptedBody struct {
+	Encrypt string `xml:"Encrypt"`
+}
+
+// IsWechat accepts a request only if it is signed by the token, its timestamp is within
+// the skew window and its nonce is not seen in the window, so a captured url can not be replayed.
+// Both the plain signature and the msg_signature of the safe mode are checked when present.
 func IsWechat(cfg src.Config) gin.HandlerFunc {
+	maxSkew := time.Duration(cfg.Portal.MaxSkewSeconds) * time.Second
+	nonces := newNonceCache(cfg.Portal.NonceCacheSize)
+	rejected := map[string]*int64{rejectSignature: new(int64), rejectTimestamp: new(int64), rejectNonce: new(int64)}
+
+	reject := func(context *gin.Context, reason, msg string) {
+		portalRejected.Inc(reason)
+		authTracer.WithContext(context.Request.Context()).
+			WithField("reason", reason).
+			WithField("rejected", atomic.AddInt64(rejected[reason], 1)).
+			Warningf("illegal request, %s, abort", msg)
+		context.AbortWithStatus(http.StatusBadRequest)
+	}
+
 	return func(context *gin.Context) {
 		signature := context.Query("signature")
+		msgSignature := context.Query("msg_signature")
 		nonce := context.Query("nonce")
 		timestamp := context.Query("timestamp")
 
-		tokens := []string{cfg.Token, timestamp, nonce}
+		if signature == "" && msgSignature == "" {
+			reject(context, rejectSignature, "no signature")
+			return
+		}
+		if signature != "" && Signature(cfg.Token, timestamp, nonce) != signature {
+			reject(context, rejectSignature, "signature mismatch")
+			return
+		}
+		if msgSignature != "" {
+			encrypt, err := encryptedPayload(context)
+			if err != nil {
+				reject(context, rejectSignature, err.Error())
+				return
+			}
+			if Signature(cfg.Token, timestamp, nonce, encrypt) != msgSignature {
+				reject(context, rejectSignature, "msg_signature mismatch")
+				return
+			}
+		}
+
+		// checked after the signature, a forged request must not fill the nonce cache
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			reject(context, rejectTimestamp, fmt.Sprintf("invalid timestamp %q", timestamp))
+			return
+		}
+		now, signedAt := time.Now(), time.Unix(unix, 0)
+		if skew := now.Sub(signedAt); skew > maxSkew || skew < -maxSkew {
+			reject(context, rejectTimestamp, fmt.Sprintf("timestamp skewed by %s", skew.Truncate(time.Second)))
+			return
+		}
+		if !nonces.add(timestamp+":"+nonce, signedAt.Add(maxSkew), now) {
+			reject(context, rejectNonce, fmt.Sprintf("nonce %s replayed", nonce))
+			return
+		}
+		context.Next()
+	}
+}
+
+// encryptedPayload is what msg_signature signs, the Encrypt of the body, or the echostr
+// of the verification. The body is put back for the handler.
+func encryptedPayload(context *gin.Context) (string, error) {
+	if context.Request.Method == http.MethodGet {
+		return context.Query("echostr"), nil
+	}
+	raw, err := io.ReadAll(context.Request.Body)
+	if err != nil {
+		return "", fmt.Errorf("fail to read body, %w", err)
+	}
+	context.Request.Body = io.NopCloser(bytes.NewReader(raw))
 
-		sort.Slice(tokens, func(i, j int) bool {
-			return tokens[i] < tokens[j]
-		})
+	var body encryptedBody
+	if err := xml.Unmarshal(raw, &body); err != nil {
+		return "", fmt.Errorf("fail to decode encrypted body, %w", err)
+	}
+	if body.Encrypt == "" {
+		return "", fmt.Errorf("msg_signature without Encrypt")
+	}
+	return body.Encrypt, nil
+}
 
-		hash := fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(tokens, ""))))
+// Signature computes the sha1 signature wechat attaches to every portal request.
+func Signature(parts ...string) string {
+	tokens := append([]string(nil), parts...)
+	sort.Strings(tokens)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(tokens, ""))))
+}
 
-		if hash == signature {
-			context.Next()
-		} else {
-			context.Writer.WriteHeader(http.StatusBadRequest)
-			context.Abort()
-			authTracer.Warning("illegal request, abort")
+// BearerAuth guards an endpoint scraped by standard tools, e.g. /metrics by prometheus.
+func BearerAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(context *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(context.Request.Header.Get("Authorization")), expected) != 1 {
+			authTracer.WithContext(context.Request.Context()).Warning("req rejected, invalid bearer token")
+			context.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		context.Next()
+	}
+}
+
+// InternalAuth guards the internal api with the shared api token.
+func InternalAuth() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if context.Request.Header.Get("x-alex-auth") != src.DefaultApiToken {
+			authTracer.WithContext(context.Request.Context()).Warning("req rejected, invalid auth token")
+			context.AbortWithStatus(http.StatusUnauthorized)
+			return
 		}
+		context.Next()
 	}
 }
 
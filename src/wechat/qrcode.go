@@ -0,0 +1,133 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventSubscribe = "subscribe"
+	eventScan      = "SCAN"
+
+	// the event key of a subscribe event is the scene prefixed by qrscene_
+	subscribeScenePrefix = "qrscene_"
+
+	invitationScenePrefix = "inv"
+	maxSceneBytes         = 64
+
+	defaultQRCodeExpire = 7 * 24 * time.Hour
+	maxQRCodeExpire     = 30 * 24 * time.Hour
+
+	showQRCodeUrl = "https://mp.weixin.qq.com/cgi-bin/showqrcode"
+)
+
+var (
+	errNotInvitation    = errors.New("not an invitation")
+	errInvalidQRCodeReq = errors.New("invalid qrcode request")
+)
+
+// Invitation is encoded into the scene of a parametric qrcode,
+// whoever scans it applies for joining the leader's team.
+type Invitation struct {
+	LeaderID string `json:"leader_id"`
+	ExpireAt int64  `json:"expire_at"` // 0 never expires
+}
+
+func (inv Invitation) Scene() string {
+	return fmt.Sprintf("%s|%s|%d", invitationScenePrefix, inv.LeaderID, inv.ExpireAt)
+}
+
+func (inv Invitation) Expired(now time.Time) bool {
+	return inv.ExpireAt != 0 && now.Unix() > inv.ExpireAt
+}
+
+// ParseInvitation decodes the scene of an invitation qrcode, the prefix of
+// subscribe events is accepted, errNotInvitation is returned for other scenes.
+func ParseInvitation(scene string) (Invitation, error) {
+	var inv Invitation
+
+	parts := strings.Split(strings.TrimPrefix(scene, subscribeScenePrefix), "|")
+	if len(parts) != 3 || parts[0] != invitationScenePrefix || parts[1] == "" {
+		return inv, errNotInvitation
+	}
+	expireAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return inv, fmt.Errorf("%w, invalid expire_at %s", errNotInvitation, parts[2])
+	}
+	inv.LeaderID = parts[1]
+	inv.ExpireAt = expireAt
+	return inv, nil
+}
+
+type QRCodeReq struct {
+	LeaderID string `json:"leader_id"`
+	// Permanent qrcodes never expire on wechat, the invitation still expires after ExpireIn if set
+	Permanent bool `json:"permanent"`
+	ExpireIn  int  `json:"expire_in"` // seconds
+}
+
+type QRCode struct {
+	Ticket   string `json:"ticket"`
+	Url      string `json:"url"` // what the qrcode image encodes
+	ImageUrl string `json:"image_url"`
+	Scene    string `json:"scene"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+type qrcodeResp struct {
+	Ticket        string `json:"ticket"`
+	ExpireSeconds int    `json:"expire_seconds"`
+	Url           string `json:"url"`
+}
+
+// createInvitationQRCode creates a parametric qrcode by qrcode/create, the scene is the invitation.
+func createInvitationQRCode(ctx context.Context, api *apiClient, req QRCodeReq) (QRCode, error) {
+	var qrcode QRCode
+
+	expireIn := time.Duration(req.ExpireIn) * time.Second
+	if !req.Permanent {
+		if expireIn <= 0 {
+			expireIn = defaultQRCodeExpire
+		}
+		if expireIn > maxQRCodeExpire {
+			return qrcode, fmt.Errorf("%w, temporary qrcode expires in %s at most", errInvalidQRCodeReq, maxQRCodeExpire)
+		}
+	}
+
+	inv := Invitation{LeaderID: req.LeaderID}
+	if expireIn > 0 {
+		inv.ExpireAt = time.Now().Add(expireIn).Unix()
+	}
+	scene := inv.Scene()
+	if len(scene) > maxSceneBytes {
+		return qrcode, fmt.Errorf("%w, scene %s is longer than %d bytes", errInvalidQRCodeReq, scene, maxSceneBytes)
+	}
+
+	body := map[string]interface{}{
+		"action_info": map[string]interface{}{"scene": map[string]string{"scene_str": scene}},
+	}
+	if req.Permanent {
+		body["action_name"] = "QR_LIMIT_STR_SCENE"
+	} else {
+		body["action_name"] = "QR_STR_SCENE"
+		body["expire_seconds"] = int(expireIn / time.Second)
+	}
+
+	var resp qrcodeResp
+	if err := api.post(ctx, "/cgi-bin/qrcode/create", body, &resp); err != nil {
+		return qrcode, fmt.Errorf("fail to create qrcode, %w", err)
+	}
+
+	return QRCode{
+		Ticket:   resp.Ticket,
+		Url:      resp.Url,
+		ImageUrl: showQRCodeUrl + "?ticket=" + url.QueryEscape(resp.Ticket),
+		Scene:    scene,
+		ExpireAt: inv.ExpireAt,
+	}, nil
+}
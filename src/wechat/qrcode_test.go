@@ -0,0 +1,31 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvitation(t *testing.T) {
+	rq := require.New(t)
+
+	inv := Invitation{LeaderID: "oLVPpjqs9BhvzwPj5A-vTYAX3GLc", ExpireAt: time.Now().Add(time.Hour).Unix()}
+	rq.LessOrEqual(len(inv.Scene()), maxSceneBytes)
+
+	// SCAN carries the scene, subscribe prefixes it
+	for _, key := range []string{inv.Scene(), subscribeScenePrefix + inv.Scene()} {
+		parsed, err := ParseInvitation(key)
+		rq.NoError(err)
+		rq.Equal(inv, parsed)
+		rq.False(parsed.Expired(time.Now()))
+		rq.True(parsed.Expired(time.Now().Add(2 * time.Hour)))
+	}
+
+	rq.False(Invitation{LeaderID: "leader"}.Expired(time.Now()), "permanent invitation")
+
+	for _, key := range []string{"", "qrscene_123", "inv|leader", "inv||0", "inv|leader|abc"} {
+		_, err := ParseInvitation(key)
+		rq.ErrorIs(err, errNotInvitation, key)
+	}
+}
@@ -0,0 +1,139 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	quotaGlobal = "global"
+	quotaTeam   = "team"
+	quotaUser   = "user"
+
+	// noQuota is the remaining when no quota applies to the user
+	noQuota = -1
+)
+
+// QuotaExceeded tells the quota of the day used up.
+type QuotaExceeded struct {
+	Scope string
+	Limit int
+	Used  int
+}
+
+func (e QuotaExceeded) Error() string {
+	return fmt.Sprintf("%s quota of %d a day exceeded, %d used", e.Scope, e.Limit, e.Used)
+}
+
+// quota caps the records of the business day. The usage is counted by the datastore in the
+// transaction creating the record, so a restart keeps it and the uploads at the same time
+// can not go beyond a quota together.
+type quota struct {
+	ums *UserMngr
+	loc *time.Location
+
+	mutex sync.RWMutex
+	cfg   src.QuotaConfig
+}
+
+func newQuota(ums *UserMngr, loc *time.Location) *quota {
+	return &quota{ums: ums, loc: loc}
+}
+
+func (q *quota) apply(cfg src.QuotaConfig) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.cfg = cfg
+}
+
+// today is the business day of now, [from, to).
+func (q *quota) today(now time.Time) (time.Time, time.Time) {
+	now = now.In(q.loc)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+	return from, from.AddDate(0, 0, 1)
+}
+
+type quotaScope struct {
+	name  string
+	quota *datastore.Quota
+}
+
+// scopes returns the quotas of the owner, from the narrowest, the order they are locked in.
+func (q *quota) scopes(ctx context.Context, owner string) []quotaScope {
+	q.mutex.RLock()
+	cfg := q.cfg
+	q.mutex.RUnlock()
+
+	var scopes []quotaScope
+	limit, ok := cfg.Users[owner]
+	if !ok {
+		limit = cfg.User
+	}
+	if limit > 0 {
+		scopes = append(scopes, quotaScope{name: quotaUser, quota: &datastore.Quota{
+			Key: quotaUser + ":" + owner, Limit: limit, Owners: []string{owner}}})
+	}
+
+	// a leader submits as one of the team
+	leader := owner
+	if user, ok := q.ums.GetUserById(ctx, owner); ok && user.LeaderID != "" {
+		leader = user.LeaderID
+	}
+	if leader != owner || q.ums.IsLeader(ctx, owner) {
+		limit, ok := cfg.Teams[leader]
+		if !ok {
+			limit = cfg.Team
+		}
+		if limit > 0 {
+			owners := append(q.ums.Members(ctx, leader), leader)
+			scopes = append(scopes, quotaScope{name: quotaTeam, quota: &datastore.Quota{
+				Key: quotaTeam + ":" + leader, Limit: limit, Owners: owners}})
+		}
+	}
+
+	if cfg.Global > 0 {
+		scopes = append(scopes, quotaScope{name: quotaGlobal, quota: &datastore.Quota{
+			Key: quotaGlobal, Limit: cfg.Global}})
+	}
+	return scopes
+}
+
+// withQuotas creates the record of now within the quotas of the scopes.
+func (q *quota) withQuotas(option datastore.CreateRecordOption, scopes []quotaScope, now time.Time) datastore.CreateRecordOption {
+	if len(scopes) == 0 {
+		return option
+	}
+	quotas := make([]*datastore.Quota, 0, len(scopes))
+	for _, scope := range scopes {
+		quotas = append(quotas, scope.quota)
+	}
+	from, to := q.today(now)
+	return option.WithQuotas(from, to, quotas...)
+}
+
+// exceeded returns the scope used up, once CreateRecord fails with datastore.ErrQuotaExceeded.
+func exceeded(scopes []quotaScope) QuotaExceeded {
+	for _, scope := range scopes {
+		if scope.quota.Used >= scope.quota.Limit {
+			return QuotaExceeded{Scope: scope.name, Limit: scope.quota.Limit, Used: scope.quota.Used}
+		}
+	}
+	return QuotaExceeded{}
+}
+
+// remaining returns how many the owner can still submit today after the record created,
+// noQuota if unlimited.
+func remaining(scopes []quotaScope) int {
+	left := noQuota
+	for _, scope := range scopes {
+		if n := scope.quota.Limit - scope.quota.Used - 1; left == noQuota || n < left {
+			left = n
+		}
+	}
+	return left
+}
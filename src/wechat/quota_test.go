@@ -0,0 +1,70 @@
+package wechat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+
+	"github.com/golang/mock/gomock"
+	mock "github.com/hanzezhenalex/wechat/src/datastore/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	rq := require.New(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	store := mock.NewMockDataStore(ctrl)
+	store.EXPECT().GetAllUsers(gomock.Any()).Return([]datastore.UserInfo{
+		{WechatID: "user_1", LeaderID: "leader_1"},
+		{WechatID: "user_2", LeaderID: "leader_1"},
+		{WechatID: "leader_1"},
+	}, nil)
+	ums, err := NewUMS(store)
+	rq.NoError(err)
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	rq.NoError(err)
+	q := newQuota(ums, loc)
+
+	// 2023-05-01 00:30 in Shanghai is still 2023-04-30 in utc
+	from, to := q.today(time.Date(2023, 4, 30, 16, 30, 0, 0, time.UTC))
+	rq.Equal(time.Date(2023, 5, 1, 0, 0, 0, 0, loc), from)
+	rq.Equal(24*time.Hour, to.Sub(from))
+
+	rq.Empty(q.scopes(ctx, "user_1"))
+	rq.Equal(noQuota, remaining(nil))
+
+	q.apply(src.QuotaConfig{User: 5, Team: 8, Global: 100, Users: map[string]int{"user_2": 0}})
+
+	// user, team, then global
+	scopes := q.scopes(ctx, "user_1")
+	rq.Equal(3, len(scopes))
+	rq.Equal("user:user_1", scopes[0].quota.Key)
+	rq.Equal("team:leader_1", scopes[1].quota.Key)
+	rq.ElementsMatch([]string{"user_1", "user_2", "leader_1"}, scopes[1].quota.Owners)
+	rq.Equal("global", scopes[2].quota.Key)
+	rq.Nil(scopes[2].quota.Owners)
+
+	scopes[0].quota.Used, scopes[1].quota.Used, scopes[2].quota.Used = 2, 6, 10
+	rq.Equal(1, remaining(scopes))
+
+	// user_2 is exempt from the user quota, not from the team one
+	scopes = q.scopes(ctx, "user_2")
+	rq.Equal(2, len(scopes))
+	scopes[0].quota.Used = 8
+	rq.Equal(QuotaExceeded{Scope: quotaTeam, Limit: 8, Used: 8}, exceeded(scopes))
+
+	// the leader submits as one of the team
+	scopes = q.scopes(ctx, "leader_1")
+	rq.Equal(3, len(scopes))
+	rq.Equal("team:leader_1", scopes[1].quota.Key)
+
+	option := q.withQuotas(datastore.NewCreateRecordOption(), scopes, time.Now())
+	rq.Equal(3, len(option.Quotas()))
+	rq.Same(scopes[0].quota, option.Quotas()[0])
+}
@@ -0,0 +1,137 @@
+package wechat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
+)
+
+const (
+	roleMember = "member"
+	roleLeader = "leader"
+
+	limitUser   = "user"
+	limitGlobal = "global"
+
+	// bucketSweepInterval drops the buckets refilled, a new bucket is full anyway
+	bucketSweepInterval = time.Minute
+)
+
+var rateLimited = metrics.NewCounterVec("wechat_rate_limited_messages_total",
+	"Messages rejected by the rate limit, by the limit hit, user or global.", "limit")
+
+// tokenBucket holds up to burst tokens refilled at rate a second, a message takes one.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit src.RateLimit, now time.Time) *tokenBucket {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.PerMinute
+	}
+	return &tokenBucket{rate: float64(limit.PerMinute) / 60, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter keeps a bucket per user and the global one, the config is replaced on reload
+// and the buckets start over full.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	cfg       src.RateLimitConfig
+	global    *tokenBucket
+	users     map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{users: make(map[string]*tokenBucket)}
+}
+
+func (rl *rateLimiter) apply(cfg src.RateLimitConfig) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.cfg == cfg {
+		return
+	}
+	rl.cfg, rl.global, rl.users = cfg, nil, make(map[string]*tokenBucket)
+}
+
+// allow returns the limit hit, user or global, if the message of the user must be rejected.
+func (rl *rateLimiter) allow(user, role string, now time.Time) (string, bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	limit := rl.cfg.Member
+	if role == roleLeader {
+		limit = rl.cfg.Leader
+	}
+	if limit.PerMinute <= 0 {
+		return "", true
+	}
+	rl.sweep(now)
+
+	bucket, ok := rl.users[user]
+	if !ok {
+		bucket = newTokenBucket(limit, now)
+		rl.users[user] = bucket
+	}
+	if !bucket.allow(now) {
+		return limitUser, false
+	}
+
+	if rl.cfg.Global.PerMinute <= 0 {
+		return "", true
+	}
+	if rl.global == nil {
+		rl.global = newTokenBucket(rl.cfg.Global, now)
+	}
+	if !rl.global.allow(now) {
+		return limitGlobal, false
+	}
+	return "", true
+}
+
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < bucketSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for user, bucket := range rl.users {
+		if bucket.refill(now); bucket.tokens >= bucket.burst {
+			delete(rl.users, user)
+		}
+	}
+}
+
+// roleOf is leader if anyone is led by the user.
+func (c *Coordinator) roleOf(ctx context.Context, id string) string {
+	if c.ums.IsLeader(ctx, id) {
+		return roleLeader
+	}
+	return roleMember
+}
@@ -0,0 +1,54 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hanzezhenalex/wechat/src"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rq := require.New(t)
+	now := time.Now()
+	rl := newRateLimiter()
+
+	// nothing configured, unlimited
+	for i := 0; i < 100; i++ {
+		_, ok := rl.allow("user_1", roleMember, now)
+		rq.True(ok)
+	}
+
+	rl.apply(src.RateLimitConfig{
+		Global: src.RateLimit{PerMinute: 1, Burst: 3},
+		Member: src.RateLimit{PerMinute: 6, Burst: 2},
+	})
+	for i := 0; i < 2; i++ {
+		_, ok := rl.allow("user_1", roleMember, now)
+		rq.True(ok)
+	}
+	limit, ok := rl.allow("user_1", roleMember, now)
+	rq.False(ok)
+	rq.Equal(limitUser, limit)
+
+	// refilled at 6 a minute
+	_, ok = rl.allow("user_1", roleMember, now.Add(10*time.Second))
+	rq.True(ok)
+
+	// the global bucket of 3 is drained by user_1
+	limit, ok = rl.allow("user_2", roleMember, now.Add(10*time.Second))
+	rq.False(ok)
+	rq.Equal(limitGlobal, limit)
+
+	// leaders are exempt from both
+	for i := 0; i < 10; i++ {
+		_, ok := rl.allow("leader_1", roleLeader, now.Add(10*time.Second))
+		rq.True(ok)
+	}
+
+	// the buckets refilled are swept
+	_, ok = rl.allow("user_2", roleMember, now.Add(time.Hour))
+	rq.True(ok)
+	rq.Len(rl.users, 1)
+}
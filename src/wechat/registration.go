@@ -0,0 +1,317 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	registrationCommand = "注册"
+	maxRegistrationName = 32
+)
+
+var registrationTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "registration").WithContext(ctx)
+}
+
+// Registrar onboards users without calling the ums api, a registration
+// is created for the applicant and turns into a user once approved.
+type Registrar struct {
+	store datastore.DataStore
+	ums   *UserMngr
+	api   *apiClient
+}
+
+func newRegistrar(store datastore.DataStore, ums *UserMngr, api *apiClient) *Registrar {
+	return &Registrar{store: store, ums: ums, api: api}
+}
+
+// Handle takes the messages belonging to the registration flow, they come from users
+// not registered yet. False is returned for the other messages.
+func (r *Registrar) Handle(ctx context.Context, msg Message) (string, bool) {
+	switch {
+	case msg.MsgType == msgText:
+		return r.handleText(ctx, msg)
+	case msg.MsgType == msgEvent && (msg.Event == eventSubscribe || msg.Event == eventScan):
+		return r.handleScan(ctx, msg)
+	}
+	return "", false
+}
+
+// matches tells if Handle takes the message, without anything applied for yet.
+func (r *Registrar) matches(msg Message) bool {
+	switch {
+	case msg.MsgType == msgText:
+		_, ok := parseRegistrationText(msg.Content)
+		return ok
+	case msg.MsgType == msgEvent && (msg.Event == eventSubscribe || msg.Event == eventScan):
+		_, err := ParseInvitation(msg.EventKey)
+		return err == nil
+	}
+	return false
+}
+
+// handleText takes "注册 张三", the applicant waits for an admin to approve.
+func (r *Registrar) handleText(ctx context.Context, msg Message) (string, bool) {
+	name, ok := parseRegistrationText(msg.Content)
+	if !ok {
+		return "", false
+	}
+	if name == "" || utf8.RuneCountInString(name) > maxRegistrationName {
+		return replyText(replyRegistrationUsage), true
+	}
+	registrationTracer(ctx).Infof("%s applies for registration by text, name=%s", msg.FromUserName, name)
+
+	reply, err := r.Apply(ctx, datastore.Registration{
+		WechatID: msg.FromUserName,
+		Name:     name,
+		Source:   datastore.RegistrationByText,
+	})
+	if err != nil {
+		registrationTracer(ctx).Errorf("fail to apply for registration, %s", err.Error())
+		return fmt.Sprintf("%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx)), true
+	}
+	return reply, true
+}
+
+// parseRegistrationText returns false if the text is not a registration command at all.
+func parseRegistrationText(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, registrationCommand) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(content, registrationCommand)
+	if rest != "" && !unicode.IsSpace([]rune(rest)[0]) {
+		// e.g. 注册表, not a command
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+func (r *Registrar) handleScan(ctx context.Context, msg Message) (string, bool) {
+	inv, err := ParseInvitation(msg.EventKey)
+	if err != nil {
+		return "", false
+	}
+	tracer := registrationTracer(ctx)
+	tracer.Infof("invitation of leader %s scanned by %s", inv.LeaderID, msg.FromUserName)
+
+	if inv.Expired(time.Now()) {
+		return replyText(replyInvitationExpired), true
+	}
+	reply, err := r.Apply(ctx, datastore.Registration{
+		WechatID: msg.FromUserName,
+		LeaderID: inv.LeaderID,
+		Source:   datastore.RegistrationByQRCode,
+	})
+	if err != nil {
+		tracer.Errorf("fail to apply for registration, %s", err.Error())
+		return fmt.Sprintf("%s, trace_id=%s", replyText(replyServerInternalError), src.GetTraceId(ctx)), true
+	}
+	return reply, true
+}
+
+// Apply creates a pending registration, the reply tells the applicant what happened.
+func (r *Registrar) Apply(ctx context.Context, registration datastore.Registration) (string, error) {
+	if _, ok := r.ums.GetUserById(ctx, registration.WechatID); ok {
+		return replyText(replyAlreadyRegistered), nil
+	}
+	registration, created, err := r.store.CreateRegistration(ctx, registration)
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return replyText(replyRegistrationPending), nil
+	}
+	registrationTracer(ctx).Infof("registration %d created for %s, leader=%s",
+		registration.ID, registration.WechatID, registration.LeaderID)
+
+	if registration.LeaderID != "" {
+		applicant := registration.Name
+		if applicant == "" {
+			applicant = "新用户"
+		}
+		r.notify(ctx, registration.LeaderID, fmt.Sprintf(replyText(replyNewRegistration), applicant))
+	}
+	return replyText(replyRegistrationSubmitted), nil
+}
+
+type ApproveReq struct {
+	Reviewer string `json:"reviewer"`
+	// Name and LeaderID override the ones applied with
+	Name     string `json:"name"`
+	LeaderID string `json:"leader_id"`
+}
+
+type RejectReq struct {
+	Reviewer string `json:"reviewer"`
+	Reason   string `json:"reason"`
+}
+
+// Approve creates the user of a pending registration.
+// False is returned when the registration is not pending.
+func (r *Registrar) Approve(ctx context.Context, id int, req ApproveReq) (datastore.Registration, bool, error) {
+	registration, ok, err := r.pending(ctx, id)
+	if err != nil || !ok {
+		return registration, ok, err
+	}
+
+	// the applicant talked to the account, a follower for sure
+	user := datastore.UserInfo{WechatID: registration.WechatID, Name: req.Name, LeaderID: req.LeaderID, Active: true, Subscribed: true}
+	if user.Name == "" {
+		user.Name = registration.Name
+	}
+	if user.LeaderID == "" {
+		user.LeaderID = registration.LeaderID
+	}
+	if err := r.ums.CreateNewUser(ctx, user); err != nil {
+		return registration, false, fmt.Errorf("fail to create user of registration %d, %w", id, err)
+	}
+
+	registration, ok, err = r.store.ReviewRegistration(ctx, id, datastore.RegistrationApproved, req.Reviewer)
+	if err != nil || !ok {
+		// the user is created anyway, the registration is left for the record
+		registrationTracer(ctx).Warningf("user %s created, but fail to mark registration %d approved, err=%v",
+			user.WechatID, id, err)
+		return registration, ok, err
+	}
+	r.notify(ctx, registration.WechatID, replyText(replyRegistrationApproved))
+	return registration, true, nil
+}
+
+// Reject returns false when the registration is not pending, the reason is told to the applicant.
+func (r *Registrar) Reject(ctx context.Context, id int, req RejectReq) (datastore.Registration, bool, error) {
+	registration, ok, err := r.store.ReviewRegistration(ctx, id, datastore.RegistrationRejected, req.Reviewer)
+	if err != nil || !ok {
+		return registration, ok, err
+	}
+
+	content := replyText(replyRegistrationRejected)
+	if req.Reason != "" {
+		content = fmt.Sprintf("%s，原因：%s", replyText(replyRegistrationRejected), req.Reason)
+	}
+	r.notify(ctx, registration.WechatID, content)
+	return registration, true, nil
+}
+
+func (r *Registrar) pending(ctx context.Context, id int) (datastore.Registration, bool, error) {
+	registration, ok, err := r.store.GetRegistration(ctx, id)
+	if err != nil {
+		return registration, false, fmt.Errorf("fail to get registration %d, %w", id, err)
+	}
+	return registration, ok && registration.Status == datastore.RegistrationPending, nil
+}
+
+// notify is best effort and does not hold the caller, wechat expects the portal to reply in 5s.
+func (r *Registrar) notify(ctx context.Context, to, content string) {
+	ctx = src.DetachContext(ctx)
+	go func() {
+		if err := r.api.sendText(ctx, to, content); err != nil {
+			registrationTracer(ctx).Warningf("fail to notify %s, %s", to, err.Error())
+		}
+	}()
+}
+
+func (r *Registrar) RegisterEndpoints(group *gin.RouterGroup) {
+	// status defaults to pending, leader_id filters the registrations applied to a leader
+	group.GET("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		status := context.DefaultQuery("status", datastore.RegistrationPending)
+		registrations, err := r.store.GetRegistrations(ctx, status, context.Query("leader_id"))
+		if err != nil {
+			registrationTracer(ctx).Errorf("fail to get registrations, %s", err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if registrations == nil {
+			registrations = []datastore.Registration{}
+		}
+		context.JSON(http.StatusOK, registrations)
+	})
+
+	group.POST("/:id/approve", func(context *gin.Context) {
+		var req ApproveReq
+		if id, ok := decodeReview(context, &req); ok {
+			registration, ok, err := r.Approve(context.Request.Context(), id, req)
+			respondReview(context, id, registration, ok, err)
+		}
+	})
+
+	group.POST("/:id/reject", func(context *gin.Context) {
+		var req RejectReq
+		if id, ok := decodeReview(context, &req); ok {
+			registration, ok, err := r.Reject(context.Request.Context(), id, req)
+			respondReview(context, id, registration, ok, err)
+		}
+	})
+
+	group.POST("/qrcode", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		tracer := registrationTracer(ctx)
+
+		var req QRCodeReq
+		if err := json.NewDecoder(context.Request.Body).Decode(&req); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := r.ums.GetUserById(ctx, req.LeaderID); !ok {
+			context.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("leader %s not register", req.LeaderID)})
+			return
+		}
+
+		qrcode, err := createInvitationQRCode(ctx, r.api, req)
+		switch {
+		case errors.Is(err, errInvalidQRCodeReq):
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err != nil:
+			tracer.Errorf("fail to create invitation qrcode, %s", err.Error())
+			context.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		default:
+			tracer.Infof("invitation qrcode created for leader %s, scene=%s", req.LeaderID, qrcode.Scene)
+			context.JSON(http.StatusOK, qrcode)
+		}
+	})
+}
+
+// decodeReview gets the registration id in the path and decodes the body into req.
+func decodeReview(context *gin.Context, req interface{}) (int, bool) {
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid registration id"})
+		return 0, false
+	}
+	if err := json.NewDecoder(context.Request.Body).Decode(req); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return id, true
+}
+
+func respondReview(context *gin.Context, id int, registration datastore.Registration, ok bool, err error) {
+	tracer := registrationTracer(context.Request.Context())
+	switch {
+	case err != nil:
+		tracer.Errorf("fail to review registration %d, %s", id, err.Error())
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case !ok:
+		context.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("registration %d is not pending", id)})
+	default:
+		tracer.Infof("registration %d of %s %s by %s", id, registration.WechatID, registration.Status, registration.ReviewedBy)
+		context.JSON(http.StatusOK, registration)
+	}
+}
@@ -0,0 +1,26 @@
+package wechat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegistrationText(t *testing.T) {
+	rq := require.New(t)
+
+	for content, expected := range map[string]string{
+		"注册 张三":    "张三",
+		" 注册　 张三 ": "张三",
+		"注册":       "",
+	} {
+		name, ok := parseRegistrationText(content)
+		rq.True(ok, content)
+		rq.Equal(expected, name, content)
+	}
+
+	for _, content := range []string{"", "你好", "注册表", "我要注册 张三"} {
+		_, ok := parseRegistrationText(content)
+		rq.False(ok, content)
+	}
+}
@@ -0,0 +1,58 @@
+package wechat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// nonceCache remembers the nonces seen within the skew window, a request beyond the window
+// is rejected by its timestamp, so a nonce is forgotten once its timestamp falls out.
+// When full the oldest nonce is forgotten first, the size should cover the peak traffic of a window.
+type nonceCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *nonceEntry, oldest first
+}
+
+type nonceEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+func newNonceCache(size int) *nonceCache {
+	return &nonceCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// add returns false if the key is seen and not expired yet.
+func (nc *nonceCache) add(key string, expireAt, now time.Time) bool {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	if elem, ok := nc.entries[key]; ok {
+		if now.Before(elem.Value.(*nonceEntry).expireAt) {
+			return false
+		}
+		nc.order.Remove(elem)
+		delete(nc.entries, key)
+	}
+
+	for front := nc.order.Front(); front != nil; front = nc.order.Front() {
+		entry := front.Value.(*nonceEntry)
+		if now.Before(entry.expireAt) && nc.order.Len() < nc.size {
+			break
+		}
+		nc.order.Remove(front)
+		delete(nc.entries, entry.key)
+	}
+
+	nc.entries[key] = nc.order.PushBack(&nonceEntry{key: key, expireAt: expireAt})
+	return true
+}
+
+func (nc *nonceCache) len() int {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	return nc.order.Len()
+}
@@ -0,0 +1,66 @@
+package wechat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hanzezhenalex/wechat/src"
+)
+
+func TestNonceCache(t *testing.T) {
+	rq := require.New(t)
+	now := time.Now()
+	nc := newNonceCache(2)
+
+	rq.True(nc.add("a", now.Add(time.Minute), now))
+	rq.False(nc.add("a", now.Add(time.Minute), now))
+
+	// expired, accepted again
+	rq.True(nc.add("a", now.Add(3*time.Minute), now.Add(2*time.Minute)))
+
+	// full, the oldest is forgotten
+	rq.True(nc.add("b", now.Add(time.Hour), now))
+	rq.True(nc.add("c", now.Add(time.Hour), now))
+	rq.Equal(2, nc.len())
+	rq.True(nc.add("a", now.Add(time.Hour), now))
+	rq.False(nc.add("c", now.Add(time.Hour), now))
+}
+
+func TestIsWechatMsgSignature(t *testing.T) {
+	rq := require.New(t)
+	gin.SetMode(gin.TestMode)
+
+	cfg := src.Config{Token: "portal_token", Portal: src.PortalConfig{MaxSkewSeconds: 60, NonceCacheSize: 10}}
+	eng := gin.New()
+	eng.POST("/portal", IsWechat(cfg), func(context *gin.Context) {
+		context.Status(http.StatusOK)
+	})
+
+	send := func(timestamp, nonce, msgSignature, body string) int {
+		query := url.Values{"timestamp": {timestamp}, "nonce": {nonce}, "msg_signature": {msgSignature},
+			"signature": {Signature(cfg.Token, timestamp, nonce)}, "encrypt_type": {"aes"}}
+		req := httptest.NewRequest(http.MethodPost, "/portal?"+query.Encode(), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		eng.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := "<xml><ToUserName><![CDATA[official]]></ToUserName><Encrypt><![CDATA[cipher]]></Encrypt></xml>"
+	rq.Equal(http.StatusOK, send(timestamp, "1", Signature(cfg.Token, timestamp, "1", "cipher"), body))
+	rq.Equal(http.StatusBadRequest, send(timestamp, "1", Signature(cfg.Token, timestamp, "1", "cipher"), body))
+
+	// the body is replaced
+	rq.Equal(http.StatusBadRequest, send(timestamp, "2", Signature(cfg.Token, timestamp, "2", "other"), body))
+
+	stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	rq.Equal(http.StatusBadRequest, send(stale, "3", Signature(cfg.Token, stale, "3", "cipher"), body))
+}
@@ -0,0 +1,132 @@
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+// outcomes of the service, the others are decided before the service runs and are not replayed
+var serviceOutcomes = map[string]bool{
+	outcomeDuplicated:    true,
+	outcomeDeduplicated:  true,
+	outcomeNotSupported:  true,
+	outcomeQuotaExceeded: true,
+}
+
+var replayedOutcomes = map[string]bool{
+	outcomeError:        true,
+	outcomeShed:         true,
+	outcomeDeadLettered: true,
+}
+
+// ReplayResult is what an archived message gets from the service now, next to what it got.
+type ReplayResult struct {
+	ID       int    `json:"id"`
+	WechatID string `json:"wechat_id"`
+	TraceID  string `json:"trace_id"`
+
+	Archived      string `json:"archived"`
+	ArchivedReply string `json:"archived_reply"`
+	Replayed      string `json:"replayed,omitempty"`
+	Reply         string `json:"reply,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// Skipped is not replayed as the service did not run on it, e.g. not_registered
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// Changed tells if the service decides otherwise now. Only the outcomes of the service are
+// compared, a message failed or shed has nothing to compare with.
+func (r ReplayResult) Changed() bool {
+	return !r.Skipped && r.Error == "" && serviceOutcomes[r.Archived] && r.Archived != r.Replayed
+}
+
+// Replayer pushes archived messages through the Service as the portal builds it, against
+// the given store. The quota counts the records of today, not of the day archived, and
+// no notification is sent.
+type Replayer struct {
+	svc      Service
+	notifier *Notifier
+}
+
+func NewReplayer(cfg src.Config, store datastore.DataStore) (*Replayer, error) {
+	ums, err := NewUMS(store)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create ums, %w", err)
+	}
+	// a replay is short, it does not wait for the users in the background
+	if !ums.Loaded() {
+		ums.Stop()
+		return nil, fmt.Errorf("fail to cache users")
+	}
+	// without templates nothing is sent, so no api is needed
+	notifier, err := newNotifier(src.NotifyConfig{}, nil, ums)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create notifier, %w", err)
+	}
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load time zone, %w", err)
+	}
+	dailyQuota := newQuota(ums, loc)
+	dailyQuota.apply(cfg.Runtime.Quota)
+	svc, err := NewDeduplication(store, notifier, dailyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create deduplication service, %w", err)
+	}
+	svc.applyWindow(cfg.Runtime.DedupWindowDays)
+	return &Replayer{svc: svc, notifier: notifier}, nil
+}
+
+func (r *Replayer) Replay(ctx context.Context, archived datastore.InboundMessage) ReplayResult {
+	result := ReplayResult{
+		ID:            archived.ID,
+		WechatID:      archived.WechatID,
+		TraceID:       archived.TraceID,
+		Archived:      archived.Outcome,
+		ArchivedReply: replyContent(archived.Reply),
+	}
+	if !serviceOutcomes[archived.Outcome] && !replayedOutcomes[archived.Outcome] {
+		result.Skipped = true
+		return result
+	}
+
+	var msg Message
+	if err := xml.Unmarshal([]byte(archived.Body), &msg); err != nil {
+		result.Error = fmt.Sprintf("fail to decode archived body, %s", err.Error())
+		return result
+	}
+
+	ctx, span := src.StartSpan(ctx, "replayer.replay")
+	defer span.End()
+	span.SetAttr("archive.id", strconv.Itoa(archived.ID))
+	span.SetAttr("archive.trace_id", archived.TraceID)
+
+	outcome := &messageOutcome{}
+	ret, err := r.svc.Handle(withOutcome(ctx, outcome), msg)
+	span.SetError(err)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Replayed = outcome.get()
+	result.Reply = replyContent(ret)
+	return result
+}
+
+func (r *Replayer) Close() {
+	r.notifier.Stop()
+}
+
+// replyContent is the text of a reply, or the reply itself if it is not a text message.
+func replyContent(reply string) string {
+	var msg Message
+	if err := xml.Unmarshal([]byte(reply), &msg); err != nil || msg.Content == "" {
+		return reply
+	}
+	return msg.Content
+}
@@ -0,0 +1,55 @@
+package wechat
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+	mock "github.com/hanzezhenalex/wechat/src/datastore/mocks"
+)
+
+func TestReplayer(t *testing.T) {
+	rq := require.New(t)
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	store := mock.NewMockDataStore(ctrl)
+	store.EXPECT().GetAllUsers(gomock.Any()).Return([]datastore.UserInfo{{WechatID: "user_1"}}, nil)
+
+	r, err := NewReplayer(src.Config{TimeZone: "Asia/Shanghai"}, store)
+	rq.NoError(err)
+	defer r.Close()
+
+	image := Message{ToUserName: "official", FromUserName: "user_1", MsgType: msgImage,
+		PicUrl: "https://mmbiz.qpic.cn/sz_mmbiz_jpg/md5_r/0"}
+	archived := datastore.InboundMessage{
+		ID:       1,
+		WechatID: "user_1",
+		Body:     "<xml><FromUserName>user_1</FromUserName><MsgType>image</MsgType><PicUrl>" + image.PicUrl + "</PicUrl></xml>",
+		Reply:    image.TextResponse("成功"),
+		Outcome:  outcomeDeduplicated,
+	}
+
+	gomock.InOrder(
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_r", gomock.Any()).Return(false, nil),
+		store.EXPECT().CreateRecord(gomock.Any(), gomock.Any(), "md5_r", gomock.Any()).Return(true, nil),
+	)
+	result := r.Replay(ctx, archived)
+	rq.Equal(outcomeDeduplicated, result.Replayed)
+	rq.Equal("成功", result.ArchivedReply)
+	rq.Equal("成功", result.Reply)
+	rq.False(result.Changed())
+
+	archived.ID = 2
+	result = r.Replay(ctx, archived)
+	rq.Equal(outcomeDuplicated, result.Replayed)
+	rq.True(result.Changed())
+
+	result = r.Replay(ctx, datastore.InboundMessage{ID: 3, WechatID: "stranger", Outcome: outcomeNotRegistered})
+	rq.True(result.Skipped)
+	rq.False(result.Changed())
+}
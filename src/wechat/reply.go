@@ -0,0 +1,102 @@
+package wechat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// keys of the reply texts, the texts can be overridden by runtime.replies of the config
+const (
+	replyNotSupportYet       = "not_support_yet"
+	replyServerInternalError = "server_internal_error"
+	replyUserNotRegistered   = "user_not_registered"
+	replyDuplicated          = "duplicated"
+	replyDeduplicated        = "deduplicated"
+	replyRateLimited         = "rate_limited"
+	replyBusy                = "busy"
+	replyQuotaRemaining      = "quota_remaining" // %d is the remaining of today
+	replyQuotaExceeded       = "quota_exceeded"  // %d is the quota
+	replyDeadLettered        = "dead_lettered"
+	replyDeadLetterSucceeded = "dead_letter_succeeded" // %s is when it was sent, %s the reply
+	replyDeadLetterFailed    = "dead_letter_failed"    // %s is when it was sent
+
+	replyRegistrationSubmitted = "registration_submitted"
+	replyRegistrationPending   = "registration_pending"
+	replyAlreadyRegistered     = "already_registered"
+	replyInvitationExpired     = "invitation_expired"
+	replyRegistrationApproved  = "registration_approved"
+	replyRegistrationRejected  = "registration_rejected"
+	replyNewRegistration       = "new_registration" // %s is the applicant
+	replyRegistrationUsage     = "registration_usage"
+)
+
+var defaultReplies = map[string]string{
+	replyNotSupportYet:       "尚不支持当前消息类型",
+	replyServerInternalError: "服务器出现故障，请联系管理员",
+	replyUserNotRegistered:   "当前用户并未注册，不能使用本服务",
+	replyDuplicated:          "请勿重复上传",
+	replyDeduplicated:        "成功",
+	replyRateLimited:         "发送太频繁了，请稍后再试",
+	replyBusy:                "系统繁忙，请稍后重新发送",
+	replyQuotaRemaining:      "成功，今天还可以提交%d张",
+	replyQuotaExceeded:       "今日提交已达上限（%d张），请明天再来",
+	replyDeadLettered:        "图片暂时没有处理成功，稍后会自动重试并通知您结果",
+	replyDeadLetterSucceeded: "您在%s发送的图片已重新处理：%s",
+	replyDeadLetterFailed:    "您在%s发送的图片多次处理失败，请重新发送或联系管理员",
+
+	replyRegistrationSubmitted: "已提交注册申请，请等待审批",
+	replyRegistrationPending:   "注册申请正在审批中，请耐心等待",
+	replyAlreadyRegistered:     "您已注册，无需重复申请",
+	replyInvitationExpired:     "邀请二维码已过期，请联系管理员重新获取",
+	replyRegistrationApproved:  "注册申请已通过，欢迎使用",
+	replyRegistrationRejected:  "注册申请未通过，如有疑问请联系管理员",
+	replyNewRegistration:       "%s申请加入，请在菜单「注册审批」中处理",
+	replyRegistrationUsage:     "请发送「注册 姓名」申请注册，例如：注册 张三",
+}
+
+// replies holds the effective texts, swapped as a whole on reload.
+var replies atomic.Value
+
+func init() {
+	replies.Store(defaultReplies)
+}
+
+func replyText(key string) string {
+	return replies.Load().(map[string]string)[key]
+}
+
+// CheckReplies rejects unknown keys and empty texts, and overrides of a
+// format which do not keep its verbs, e.g. new_registration needs one %s.
+func CheckReplies(overrides map[string]string) error {
+	var problems []string
+	for key, text := range overrides {
+		origin, ok := defaultReplies[key]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unknown reply %s", key))
+		case strings.TrimSpace(text) == "":
+			problems = append(problems, fmt.Sprintf("reply %s is empty", key))
+		case strings.Count(text, "%") != strings.Count(origin, "%"):
+			problems = append(problems, fmt.Sprintf("reply %s must keep the verbs of %q", key, origin))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid replies, %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ApplyReplies overrides the default texts, the keys not given are reset to the defaults.
+func ApplyReplies(overrides map[string]string) {
+	texts := make(map[string]string, len(defaultReplies))
+	for key, text := range defaultReplies {
+		texts[key] = text
+	}
+	for key, text := range overrides {
+		texts[key] = text
+	}
+	replies.Store(texts)
+}
@@ -0,0 +1,29 @@
+package wechat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplies(t *testing.T) {
+	rq := require.New(t)
+	defer ApplyReplies(nil)
+
+	rq.NoError(CheckReplies(map[string]string{replyDuplicated: "重复了", replyNewRegistration: "新申请：%s"}))
+	for _, overrides := range []map[string]string{
+		{"unknown": "text"},
+		{replyDuplicated: " "},
+		{replyNewRegistration: "有新申请"},
+	} {
+		rq.Error(CheckReplies(overrides), overrides)
+	}
+
+	ApplyReplies(map[string]string{replyDuplicated: "重复了"})
+	rq.Equal("重复了", replyText(replyDuplicated))
+	rq.Equal(defaultReplies[replyDeduplicated], replyText(replyDeduplicated))
+
+	// keys not given fall back to the defaults
+	ApplyReplies(map[string]string{replyDeduplicated: "收到"})
+	rq.Equal(defaultReplies[replyDuplicated], replyText(replyDuplicated))
+}
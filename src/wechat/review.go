@@ -0,0 +1,88 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+var errInvalidReview = errors.New("invalid review")
+
+var reviewTracer = func(ctx context.Context) *logrus.Entry {
+	return logrus.WithField("comp", "review").WithContext(ctx)
+}
+
+type ReviewReq struct {
+	Status   string `json:"status"` // confirmed or denied
+	Reviewer string `json:"reviewer"`
+	Reason   string `json:"reason"`
+}
+
+// Reviewer confirms or denies the records waiting for confirm, the owner is notified of the result.
+type Reviewer struct {
+	store    datastore.DataStore
+	notifier *Notifier
+}
+
+func NewReviewer(store datastore.DataStore, notifier *Notifier) *Reviewer {
+	return &Reviewer{store: store, notifier: notifier}
+}
+
+// Review returns false when the record is not waiting for confirm.
+func (r *Reviewer) Review(ctx context.Context, id int, req ReviewReq) (datastore.RecordInfo, bool, error) {
+	switch {
+	case req.Status != datastore.Confirmed && req.Status != datastore.Denied:
+		return datastore.RecordInfo{}, false, fmt.Errorf("%w, status must be %s or %s", errInvalidReview, datastore.Confirmed, datastore.Denied)
+	case req.Status == datastore.Denied && req.Reason == "":
+		return datastore.RecordInfo{}, false, fmt.Errorf("%w, reason is required to deny a record", errInvalidReview)
+	case req.Status == datastore.Confirmed:
+		req.Reason = ""
+	}
+
+	record, ok, err := r.store.ReviewRecord(ctx, id, req.Status, req.Reviewer, req.Reason)
+	if err != nil || !ok {
+		return record, ok, err
+	}
+	r.notifier.RecordReviewed(ctx, record)
+	return record, true, nil
+}
+
+func (r *Reviewer) RegisterEndpoints(group *gin.RouterGroup) {
+	group.POST("/:id/review", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		tracer := reviewTracer(ctx)
+
+		id, err := strconv.Atoi(context.Param("id"))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": "invalid record id"})
+			return
+		}
+		var req ReviewReq
+		if err := json.NewDecoder(context.Request.Body).Decode(&req); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		record, ok, err := r.Review(ctx, id, req)
+		switch {
+		case errors.Is(err, errInvalidReview):
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err != nil:
+			tracer.Errorf("fail to review record %d, %s", id, err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case !ok:
+			context.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("record %d is not waiting for confirm", id)})
+		default:
+			tracer.Infof("record %d %s by %s", id, req.Status, req.Reviewer)
+			context.JSON(http.StatusOK, record)
+		}
+	})
+}
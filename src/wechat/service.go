@@ -2,11 +2,15 @@ package wechat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/hanzezhenalex/wechat/src"
 	"github.com/hanzezhenalex/wechat/src/datastore"
 )
 
@@ -18,22 +22,72 @@ type Service interface {
 	Handle(ctx context.Context, message Message) (string, error)
 }
 
+// storageError is a failure of the datastore, unlike a malformed message the same message
+// may succeed when retried.
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return e.err.Error()
+}
+
+func (e storageError) Unwrap() error {
+	return e.err
+}
+
+// isTransient tells if the message failed by err may succeed when retried.
+func isTransient(err error) bool {
+	var storageErr storageError
+	return errors.As(err, &storageErr)
+}
+
 type Deduplication struct {
-	store datastore.DataStore
+	store    datastore.DataStore
+	notifier *Notifier
+	quota    *quota
+	// window is the dedup window in days, zero is forever
+	window int64
 }
 
-func NewDeduplication(store datastore.DataStore) (*Deduplication, error) {
+func NewDeduplication(store datastore.DataStore, notifier *Notifier, quota *quota) (*Deduplication, error) {
 	dd := &Deduplication{
-		store: store,
+		store:    store,
+		notifier: notifier,
+		quota:    quota,
 	}
 	return dd, nil
 }
 
-func (dd *Deduplication) Handle(ctx context.Context, message Message) (ret string, err error) {
+// applyWindow takes effect from the next record.
+func (dd *Deduplication) applyWindow(days int) {
+	atomic.StoreInt64(&dd.window, int64(days))
+}
+
+func (dd *Deduplication) createOption(now time.Time) datastore.CreateRecordOption {
+	option := datastore.NewCreateRecordOption()
+	if days := atomic.LoadInt64(&dd.window); days > 0 {
+		option = option.WithDedupSince(now.AddDate(0, 0, -int(days)))
+	}
+	return option
+}
+
+func (dd *Deduplication) Handle(ctx context.Context, message Message) (string, error) {
+	return dd.handleAt(ctx, message, time.Now())
+}
+
+// handleAt handles the message submitted at the given time, which picks the business day
+// of the quota, e.g. the day a dead letter came.
+func (dd *Deduplication) handleAt(ctx context.Context, message Message, submittedAt time.Time) (ret string, err error) {
 	defer func() {
 		ret = message.TextResponse(ret)
 	}()
 
+	ctx, span := src.StartSpan(ctx, "dedup.handle")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	tracer := deduplicationTracer(ctx)
 	tracer.Info("message processed by deduplication service")
 
@@ -41,35 +95,47 @@ func (dd *Deduplication) Handle(ctx context.Context, message Message) (ret strin
 	case msgImage:
 		url, err := message.GetPicUrl()
 		if err != nil {
-			return serverInternalError, fmt.Errorf("fail to get PicUrl, %w", err)
+			return replyText(replyServerInternalError), fmt.Errorf("fail to get PicUrl, %w", err)
 		}
 		tracer.Debugf("pic url %s", url)
 
 		md5, err := getMd5FromUrl(url)
 		if err != nil {
 			// TODO: fallback to download pic and cal md5
-			return serverInternalError, fmt.Errorf("fail to get md5, %w", err)
+			return replyText(replyServerInternalError), fmt.Errorf("fail to get md5, %w", err)
 		}
 		tracer.Debugf("md5 %s", md5)
 
-		existed, err := dd.exist(ctx, md5, url, message.FromUserName)
+		scopes := dd.quota.scopes(ctx, message.FromUserName)
+		existed, err := dd.exist(ctx, md5, url, message.FromUserName, scopes, submittedAt)
 
 		switch {
+		case errors.Is(err, datastore.ErrQuotaExceeded):
+			quotaErr := exceeded(scopes)
+			tracer.Warningf("record of %s rejected, %s", message.FromUserName, quotaErr.Error())
+			countMessage(ctx, message.MsgType, outcomeQuotaExceeded)
+			return fmt.Sprintf(replyText(replyQuotaExceeded), quotaErr.Limit), nil
 		case err != nil:
-			return serverInternalError, fmt.Errorf("fail to check record, %w", err)
+			return replyText(replyServerInternalError), fmt.Errorf("fail to check record, %w", err)
 		case existed:
 			tracer.Info("duplicated pic")
-			return duplicated, nil
+			countMessage(ctx, message.MsgType, outcomeDuplicated)
+			return replyText(replyDuplicated), nil
 		default:
 			tracer.Info("inserted successfully")
-			return deduplicated, nil
+			countMessage(ctx, message.MsgType, outcomeDeduplicated)
+			if remaining := remaining(scopes); remaining != noQuota {
+				return fmt.Sprintf(replyText(replyQuotaRemaining), remaining), nil
+			}
+			return replyText(replyDeduplicated), nil
 		}
 	default:
-		return notSupportYet, nil
+		countMessage(ctx, message.MsgType, outcomeNotSupported)
+		return replyText(replyNotSupportYet), nil
 	}
 }
 
-func (dd *Deduplication) exist(ctx context.Context, md5 string, url string, username string) (bool, error) {
+func (dd *Deduplication) exist(ctx context.Context, md5 string, url string, username string, scopes []quotaScope, submittedAt time.Time) (bool, error) {
 	tracer := deduplicationTracer(ctx)
 
 	record, err := datastore.NewRecordInfo(username, datastore.WaitingForConfirm, url)
@@ -77,12 +143,16 @@ func (dd *Deduplication) exist(ctx context.Context, md5 string, url string, user
 		return false, fmt.Errorf("fail to create reocrd info, %w", err)
 	}
 
-	exist, err := dd.store.CreateRecord(ctx, record, md5, true)
+	option := dd.quota.withQuotas(dd.createOption(time.Now()), scopes, submittedAt)
+	exist, err := dd.store.CreateRecord(ctx, &record, md5, option)
 	if err != nil {
-		return false, fmt.Errorf("fail to create reocrd, %w", err)
+		return false, storageError{err: fmt.Errorf("fail to create reocrd, %w", err)}
 	}
 	tracer.Debugf("exsitence in store: %t", exist)
 
+	if !exist {
+		dd.notifier.RecordSubmitted(ctx, record)
+	}
 	return exist, nil
 }
 
@@ -0,0 +1,115 @@
+package wechat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errSessionMalformed = errors.New("malformed session")
+	errSessionSignature = errors.New("invalid session signature")
+	errSessionExpired   = errors.New("session expired")
+)
+
+// Session binds a browser to a wechat user, it is kept in a signed cookie.
+type Session struct {
+	WechatID string `json:"id"`
+	Nickname string `json:"nick,omitempty"`
+	ExpireAt int64  `json:"exp"`
+}
+
+// oauthState survives the round trip to wechat's authorize page.
+type oauthState struct {
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	ExpireAt int64  `json:"exp"`
+}
+
+// sessionCodec signs cookie values with hmac-sha256, the payload is not encrypted.
+type sessionCodec struct {
+	secret []byte
+}
+
+// newSessionCodec falls back to a key derived from the app secret,
+// so that sessions survive restarts and are valid on every replica.
+// Without either of them anyone could sign a session.
+func newSessionCodec(secret, appSecret string) (*sessionCodec, error) {
+	if secret == "" {
+		if appSecret == "" {
+			return nil, errors.New("neither session secret nor app secret is set")
+		}
+		sum := sha256.Sum256([]byte("session:" + appSecret))
+		secret = string(sum[:])
+	}
+	return &sessionCodec{secret: []byte(secret)}, nil
+}
+
+func (sc *sessionCodec) EncodeSession(session Session) (string, error) {
+	return sc.encode(session)
+}
+
+func (sc *sessionCodec) DecodeSession(value string) (Session, error) {
+	var session Session
+	if err := sc.decode(value, &session); err != nil {
+		return session, err
+	}
+	if time.Now().Unix() > session.ExpireAt {
+		return session, errSessionExpired
+	}
+	return session, nil
+}
+
+func (sc *sessionCodec) encodeState(state oauthState) (string, error) {
+	return sc.encode(state)
+}
+
+func (sc *sessionCodec) decodeState(value string) (oauthState, error) {
+	var state oauthState
+	if err := sc.decode(value, &state); err != nil {
+		return state, err
+	}
+	if time.Now().Unix() > state.ExpireAt {
+		return state, errSessionExpired
+	}
+	return state, nil
+}
+
+func (sc *sessionCodec) encode(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("fail to encode session, %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + sc.sign(payload), nil
+}
+
+func (sc *sessionCodec) decode(value string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return errSessionMalformed
+	}
+	if !hmac.Equal([]byte(sc.sign(parts[0])), []byte(parts[1])) {
+		return errSessionSignature
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errSessionMalformed
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errSessionMalformed
+	}
+	return nil
+}
+
+func (sc *sessionCodec) sign(payload string) string {
+	mac := hmac.New(sha256.New, sc.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
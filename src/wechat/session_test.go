@@ -0,0 +1,55 @@
+package wechat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession(t *testing.T) {
+	rq := require.New(t)
+	codec, err := newSessionCodec("", "app_secret")
+	rq.NoError(err)
+
+	_, err = newSessionCodec("", "")
+	rq.Error(err)
+
+	value, err := codec.EncodeSession(Session{WechatID: "id1", ExpireAt: time.Now().Add(time.Hour).Unix()})
+	rq.NoError(err)
+
+	session, err := codec.DecodeSession(value)
+	rq.NoError(err)
+	rq.Equal("id1", session.WechatID)
+
+	// signed by another secret
+	other, err := newSessionCodec("other", "app_secret")
+	rq.NoError(err)
+	_, err = other.DecodeSession(value)
+	rq.ErrorIs(err, errSessionSignature)
+
+	// payload replaced
+	forged, err := codec.EncodeSession(Session{WechatID: "id2", ExpireAt: time.Now().Add(time.Hour).Unix()})
+	rq.NoError(err)
+	_, err = codec.DecodeSession(strings.Split(forged, ".")[0] + "." + strings.Split(value, ".")[1])
+	rq.ErrorIs(err, errSessionSignature)
+
+	expired, err := codec.EncodeSession(Session{WechatID: "id1", ExpireAt: time.Now().Add(-time.Second).Unix()})
+	rq.NoError(err)
+	_, err = codec.DecodeSession(expired)
+	rq.ErrorIs(err, errSessionExpired)
+
+	_, err = codec.DecodeSession("garbage")
+	rq.ErrorIs(err, errSessionMalformed)
+}
+
+func TestSafeRedirect(t *testing.T) {
+	rq := require.New(t)
+
+	rq.Equal("/h5/records?page=1", safeRedirect("/h5/records?page=1"))
+	rq.Equal("/", safeRedirect("https://evil.com"))
+	rq.Equal("/", safeRedirect("//evil.com"))
+	rq.Equal("/", safeRedirect("/\\evil.com"))
+	rq.Equal("/", safeRedirect(""))
+}
@@ -1,35 +1,74 @@
 package wechat
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"os"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 
 	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/metrics"
 )
 
 const (
-	failInterval = 5 * time.Second
+	failInterval    = 5 * time.Second
+	maxFailInterval = 5 * time.Minute
+	minRefreshAhead = time.Minute
+	// minRefreshInterval keeps a follower whose leader is late from polling the store in a loop
+	minRefreshInterval = 2 * time.Second
+	fetchTimeout       = 10 * time.Second
 )
 
+var errTokenManagerStopped = errors.New("token manager stopped")
+
 var tracer = logrus.WithField("comp", "token_mngr")
 
+// fetchFunc obtains a fresh credential from wechat.
+type fetchFunc func(ctx context.Context) (Token, error)
+
+// tokenManager keeps a wechat credential (access token, jsapi ticket) fresh.
 type tokenManager struct {
-	token atomic.Value // string
+	name   string
+	fetch  fetchFunc
+	store  TokenStore
+	holder string // identifies this replica when leasing the refresh
+	tracer *logrus.Entry
 
-	client *http.Client
-	url    string
-	path   string
+	mutex     sync.RWMutex
+	current   Token
+	lastErr   error
+	lastTry   time.Time
+	failures  int
+	inflight  *refreshCall
+	ready     chan struct{} // closed once the first valid token is available
+	readyOnce sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func NewTokenManager(cfg src.Config) *tokenManager {
-	tm := &tokenManager{
+// refreshCall collapses concurrent Refresh callers into a single fetch.
+type refreshCall struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+var tokenAge = metrics.NewGaugeFunc("wechat_token_age_seconds",
+	"Seconds since the credential was fetched from wechat.", "credential")
+
+func NewTokenManager(cfg src.Config, store TokenStore) *tokenManager {
+	fetcher := &accessTokenFetcher{
 		client: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{
@@ -38,75 +77,255 @@ func NewTokenManager(cfg src.Config) *tokenManager {
 			},
 		},
 		url: fmt.Sprintf(
-			"https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s",
-			cfg.AppID, cfg.AppSecret,
+			"%s/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s",
+			cfg.ApiBaseUrl, cfg.AppID, cfg.AppSecret,
 		),
-		path: cfg.TokenFilePath,
 	}
+	return newCredentialManager(credentialAccessToken, store, fetcher.fetchToken)
+}
+
+func newCredentialManager(name string, store TokenStore, fetch fetchFunc) *tokenManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	tm := &tokenManager{
+		name:   name,
+		fetch:  fetch,
+		store:  store,
+		holder: tokenHolder(),
+		tracer: tracer.WithField("credential", name),
+		ready:  make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	tokenAge.Set(func() (float64, bool) {
+		tm.mutex.RLock()
+		defer tm.mutex.RUnlock()
+		if tm.current.FetchedAt.IsZero() {
+			return 0, false
+		}
+		return time.Since(tm.current.FetchedAt).Seconds(), true
+	}, name)
 	tm.startLoop()
 	return tm
 }
 
 func (tm *tokenManager) startLoop() {
 	interval := time.Millisecond
-	token, err := tm.readTokenFile()
+	token, err := tm.store.Load(tm.ctx)
 
-	if err == nil && token.valid() {
+	if err != nil {
+		tm.tracer.Errorf("fail to load token, %s", err.Error())
+	} else if token.valid() {
 		interval = token.nextRefreshInterval()
-		tm.token.Store(token.token())
+		tm.setToken(token)
 	}
 
 	go tm.daemon(interval)
 }
 
+// Stop terminates the refresh daemon and waits for it and a refresh running to exit.
+// Callers blocked in Token or Refresh are released with an error.
+func (tm *tokenManager) Stop() {
+	// under the mutex no refresh can start after the cancel
+	tm.mutex.Lock()
+	tm.cancel()
+	call := tm.inflight
+	tm.mutex.Unlock()
+
+	<-tm.done
+	if call != nil {
+		<-call.done
+	}
+}
+
 func (tm *tokenManager) daemon(interval time.Duration) {
-	ticker := time.NewTimer(interval)
+	defer close(tm.done)
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
-		<-ticker.C
-		tracer.Info("start to fetch token")
+		select {
+		case <-tm.ctx.Done():
+			tm.tracer.Info("token daemon stopped")
+			return
+		case <-timer.C:
+		}
 
-		resp, err := tm.fetch()
-		tracer.Debugf("token resp: %#v", resp)
+		tm.tracer.Info("start to fetch token")
+		token, err := tm.Refresh(tm.ctx)
 
-		if err != nil {
-			interval = failInterval
-			tracer.Errorf("fail to fetch token, err=%s, waiting interval=%s",
+		switch {
+		case errors.Is(err, context.Canceled):
+			continue
+		case err != nil:
+			interval = tm.backoff()
+			tm.tracer.Errorf("fail to fetch token, err=%s, waiting interval=%s",
 				err.Error(), interval.String())
-		} else {
-			token := Token{
-				AccessToken:     resp.AccessToken,
-				ExpireTimestamp: time.Now().Add(time.Duration(resp.Expires)),
-			}
-			if token.valid() {
-				tm.token.Store(resp.AccessToken)
-				go func() {
-					if err := tm.writeTokenFile(token); err != nil {
-						tracer.Errorf("fail to write token file, %s", err.Error())
-					}
-				}()
-
-				interval = time.Duration(resp.Expires/2) * time.Second
-				tracer.Infof("fetch token successfully, next interval=%s", interval.String())
-			} else {
-				interval = failInterval
-				tracer.Errorf("invalid token fetched, %#v, next interval=%s", token, interval.String())
-			}
+		default:
+			interval = token.nextRefreshInterval()
+			tm.tracer.Infof("fetch token successfully, next interval=%s", interval.String())
+		}
+		timer.Reset(interval)
+	}
+}
 
+// backoff grows exponentially with the number of consecutive failures,
+// half of it is randomized to keep replicas from retrying in lockstep.
+func (tm *tokenManager) backoff() time.Duration {
+	tm.mutex.RLock()
+	failures := tm.failures
+	tm.mutex.RUnlock()
+
+	interval := failInterval
+	for i := 1; i < failures && interval < maxFailInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxFailInterval {
+		interval = maxFailInterval
+	}
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// Refresh fetches a new token from wechat. Concurrent callers share the same fetch,
+// cancelling ctx only stops waiting, the fetch itself goes on for the others.
+func (tm *tokenManager) Refresh(ctx context.Context) (Token, error) {
+	tm.mutex.Lock()
+	if tm.ctx.Err() != nil {
+		tm.mutex.Unlock()
+		return Token{}, errTokenManagerStopped
+	}
+	call := tm.inflight
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		tm.inflight = call
+		go tm.doRefresh(call)
+	}
+	tm.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	case <-call.done:
+		return call.token, call.err
+	}
+}
+
+func (tm *tokenManager) doRefresh(call *refreshCall) {
+	ctx, cancel := context.WithTimeout(tm.ctx, fetchTimeout)
+	defer cancel()
+
+	call.token, call.err = tm.obtain(ctx)
+
+	tm.mutex.Lock()
+	tm.inflight = nil
+	tm.lastTry = time.Now()
+	tm.lastErr = call.err
+	if call.err != nil {
+		tm.failures++
+	} else {
+		tm.failures = 0
+	}
+	tm.mutex.Unlock()
+
+	if call.err == nil {
+		tm.setToken(call.token)
+	}
+	close(call.done)
+}
+
+// obtain fetches a token from wechat, unless the store is shared and another
+// replica holds the refresh lease, then the shared token is used instead.
+func (tm *tokenManager) obtain(ctx context.Context) (Token, error) {
+	if leaser, ok := tm.store.(TokenLeaser); ok {
+		acquired, err := leaser.AcquireLease(ctx, tm.holder)
+		if err != nil {
+			return Token{}, fmt.Errorf("fail to acquire token lease, %w", err)
+		}
+		token, err := tm.store.Load(ctx)
+		if err != nil {
+			return Token{}, fmt.Errorf("fail to load shared token, %w", err)
+		}
+		if !acquired {
+			if !token.valid() {
+				return Token{}, fmt.Errorf("token is refreshed by another replica, no valid shared token yet")
+			}
+			tm.tracer.Debug("use token shared by another replica")
+			return token, nil
+		}
+		// the lease expires long before the token, the holder of an expired lease may have
+		// refreshed since ours was got, a fetch now would revoke the token it shares
+		if token.valid() && token.FetchedAt.After(tm.fetchedAt()) {
+			tm.tracer.Debug("use token refreshed by another replica")
+			return token, nil
 		}
-		ticker.Reset(interval)
 	}
+
+	token, err := tm.fetch(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	if !token.valid() {
+		return Token{}, fmt.Errorf("invalid %s fetched, expire at %s", tm.name, token.ExpireTimestamp)
+	}
+	if err := tm.store.Save(ctx, token); err != nil {
+		tm.tracer.Errorf("fail to save token, %s", err.Error())
+	}
+	return token, nil
+}
+
+func (tm *tokenManager) fetchedAt() time.Time {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.current.FetchedAt
+}
+
+func tokenHolder() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+}
+
+func (tm *tokenManager) setToken(token Token) {
+	tm.mutex.Lock()
+	tm.current = token
+	tm.mutex.Unlock()
+
+	tm.readyOnce.Do(func() { close(tm.ready) })
 }
 
 type TokenResp struct {
 	AccessToken string `json:"access_token"`
 	Expires     int    `json:"expires_in"`
+	ErrCode     int    `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
 }
 
-func (tm *tokenManager) fetch() (TokenResp, error) {
+type accessTokenFetcher struct {
+	client *http.Client
+	url    string
+}
+
+func (f *accessTokenFetcher) fetchToken(ctx context.Context) (Token, error) {
+	ctx, span := src.StartClientSpan(ctx, "wechat.api /cgi-bin/token")
+	defer span.End()
+
+	resp, err := f.fetch(ctx)
+	tracer.Debugf("token resp: %#v", resp)
+	if err != nil {
+		span.SetError(err)
+		return Token{}, err
+	}
+	return newToken(resp.AccessToken, resp.Expires), nil
+}
+
+func (f *accessTokenFetcher) fetch(ctx context.Context) (TokenResp, error) {
 	var tokenResp TokenResp
 
-	resp, err := tm.client.Get(tm.url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return tokenResp, fmt.Errorf("fail to create req for access token, %w", err)
+	}
+	resp, err := f.client.Do(req)
 	if err != nil {
 		return tokenResp, fmt.Errorf("fail to send req for access token, %w", err)
 	}
@@ -115,60 +334,108 @@ func (tm *tokenManager) fetch() (TokenResp, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
 		return tokenResp, fmt.Errorf("fail to decode req for access token, %w", err)
 	}
+	if tokenResp.ErrCode != 0 {
+		return tokenResp, fmt.Errorf("wechat rejected token req, errcode=%d, errmsg=%s",
+			tokenResp.ErrCode, tokenResp.ErrMsg)
+	}
 	return tokenResp, nil
 }
 
-func (tm *tokenManager) Token() (string, error) {
-	return tm.token.Load().(string), nil
+// Token returns the current access token, blocking until the first one is fetched.
+// An expired token triggers a refresh instead of being handed out.
+func (tm *tokenManager) Token(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-tm.ctx.Done():
+		return "", errTokenManagerStopped
+	case <-tm.ready:
+	}
+
+	tm.mutex.RLock()
+	token := tm.current
+	tm.mutex.RUnlock()
+
+	if token.valid() {
+		return token.token(), nil
+	}
+
+	token, err := tm.Refresh(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fail to refresh expired token, %w", err)
+	}
+	return token.token(), nil
+}
+
+type TokenStatus struct {
+	Ready               bool      `json:"ready"`
+	Valid               bool      `json:"valid"`
+	Age                 string    `json:"age,omitempty"`
+	FetchedAt           time.Time `json:"fetched_at"`
+	ExpireAt            time.Time `json:"expire_at"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+func (tm *tokenManager) Status() TokenStatus {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	status := TokenStatus{
+		Ready:               tm.current.AccessToken != "",
+		Valid:               tm.current.valid(),
+		FetchedAt:           tm.current.FetchedAt,
+		ExpireAt:            tm.current.ExpireTimestamp,
+		LastAttempt:         tm.lastTry,
+		ConsecutiveFailures: tm.failures,
+	}
+	if !tm.current.FetchedAt.IsZero() {
+		status.Age = time.Since(tm.current.FetchedAt).Round(time.Second).String()
+	}
+	if tm.lastErr != nil {
+		status.LastError = tm.lastErr.Error()
+	}
+	return status
+}
+
+func (tm *tokenManager) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("/status", func(context *gin.Context) {
+		context.JSON(http.StatusOK, tm.Status())
+	})
 }
 
 type Token struct {
 	AccessToken     string    `json:"access_token"`
 	ExpireTimestamp time.Time `json:"timestamp"`
+	FetchedAt       time.Time `json:"fetched_at"`
 }
 
-func (tm *tokenManager) readTokenFile() (Token, error) {
-	var token Token
-	f, err := os.Open(tm.path)
-
-	if err != nil {
-		if os.IsNotExist(err) {
-			tracer.Info("token file not exist")
-			return token, nil
-		} else {
-			return token, fmt.Errorf("fail to open token file, %w", err)
-		}
-	} else {
-		if err := json.NewDecoder(f).Decode(&token); err != nil {
-			return token, fmt.Errorf("fail to decode token file, %w", err)
-		}
+// newToken converts the expires_in seconds wechat returns into an absolute expire time.
+func newToken(value string, expiresIn int) Token {
+	now := time.Now()
+	return Token{
+		AccessToken:     value,
+		ExpireTimestamp: now.Add(time.Duration(expiresIn) * time.Second),
+		FetchedAt:       now,
 	}
-	return token, err
 }
 
 func (t *Token) valid() bool {
-	return time.Now().Before(t.ExpireTimestamp)
+	return t.AccessToken != "" && time.Now().Before(t.ExpireTimestamp)
 }
 
+// nextRefreshInterval refreshes at half of the remaining lifetime,
+// so there is always time left to retry before the token expires.
+// Near the expiry it waits a few seconds, randomized so the replicas do not come together.
 func (t *Token) nextRefreshInterval() time.Duration {
-	interval := t.ExpireTimestamp.Sub(time.Now())
-	if interval > time.Minute {
+	interval := time.Until(t.ExpireTimestamp) / 2
+	if interval > minRefreshAhead {
 		return interval
 	}
-	return time.Millisecond
+	return minRefreshInterval + time.Duration(rand.Int63n(int64(minRefreshInterval)))
 }
 
 func (t *Token) token() string {
 	return t.AccessToken
 }
-
-func (tm *tokenManager) writeTokenFile(token Token) error {
-	f, err := os.OpenFile(tm.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("fail to open token file, %w", err)
-	}
-	if err := json.NewEncoder(f).Encode(&token); err != nil {
-		return fmt.Errorf("fail to encode token file, %w", err)
-	}
-	return nil
-}
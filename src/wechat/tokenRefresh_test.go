@@ -0,0 +1,23 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextRefreshInterval(t *testing.T) {
+	rq := require.New(t)
+
+	token := Token{ExpireTimestamp: time.Now().Add(2 * time.Hour)}
+	rq.InDelta(float64(time.Hour), float64(token.nextRefreshInterval()), float64(time.Second))
+
+	// near or past the expiry, a few seconds rather than a loop
+	for _, left := range []time.Duration{time.Minute, 0, -time.Hour} {
+		token = Token{ExpireTimestamp: time.Now().Add(left)}
+		interval := token.nextRefreshInterval()
+		rq.GreaterOrEqual(interval, minRefreshInterval, left.String())
+		rq.Less(interval, 2*minRefreshInterval, left.String())
+	}
+}
@@ -0,0 +1,215 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/datastore"
+)
+
+const (
+	TokenStoreFile   = src.TokenStoreFile
+	TokenStoreDB     = src.TokenStoreDB
+	TokenStoreRemote = src.TokenStoreRemote
+
+	credentialAccessToken = "access_token"
+	credentialJsapiTicket = "jsapi_ticket"
+
+	tokenLeaseTTL = time.Minute
+)
+
+// TokenStore persists the token so that it survives restarts and can be shared.
+type TokenStore interface {
+	Load(ctx context.Context) (Token, error)
+	Save(ctx context.Context, token Token) error
+}
+
+// TokenLeaser is implemented by stores shared between replicas,
+// only the lease holder refreshes the token, the others read the shared value.
+type TokenLeaser interface {
+	AcquireLease(ctx context.Context, holder string) (bool, error)
+}
+
+// NewTokenStore creates the store of the given credential, access_token or jsapi_ticket.
+func NewTokenStore(cfg src.Config, store datastore.DataStore, credential string) (TokenStore, error) {
+	switch cfg.TokenStore {
+	case "", TokenStoreFile:
+		if credential == credentialJsapiTicket {
+			return NewFileTokenStore(cfg.TicketFilePath), nil
+		}
+		return NewFileTokenStore(cfg.TokenFilePath), nil
+	case TokenStoreDB:
+		return NewDBTokenStore(store, credential+":"+cfg.AppID), nil
+	case TokenStoreRemote:
+		if cfg.TokenServerUrl == "" {
+			return nil, fmt.Errorf("token_server_url is required by remote token store")
+		}
+		if credential == credentialJsapiTicket {
+			return NewRemoteTokenStore(cfg.TokenServerUrl + "/" + credentialJsapiTicket), nil
+		}
+		return NewRemoteTokenStore(cfg.TokenServerUrl), nil
+	}
+	return nil, fmt.Errorf("unknown token store %s", cfg.TokenStore)
+}
+
+/*
+ * file store, the default for a single instance
+ */
+
+type fileTokenStore struct {
+	path string
+}
+
+func NewFileTokenStore(path string) *fileTokenStore {
+	return &fileTokenStore{path: path}
+}
+
+func (fs *fileTokenStore) Load(_ context.Context) (Token, error) {
+	var token Token
+	f, err := os.Open(fs.path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			tracer.Info("token file not exist")
+			return token, nil
+		} else {
+			return token, fmt.Errorf("fail to open token file, %w", err)
+		}
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := json.NewDecoder(f).Decode(&token); err != nil {
+		return token, fmt.Errorf("fail to decode token file, %w", err)
+	}
+	return token, nil
+}
+
+func (fs *fileTokenStore) Save(_ context.Context, token Token) error {
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("fail to open token file, %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := json.NewEncoder(f).Encode(&token); err != nil {
+		return fmt.Errorf("fail to encode token file, %w", err)
+	}
+	return nil
+}
+
+/*
+ * db store, shared by replicas with a lease on the refresh
+ */
+
+type dbTokenStore struct {
+	store datastore.DataStore
+	name  string
+}
+
+func NewDBTokenStore(store datastore.DataStore, name string) *dbTokenStore {
+	return &dbTokenStore{store: store, name: name}
+}
+
+func (ds *dbTokenStore) Load(ctx context.Context) (Token, error) {
+	record, found, err := ds.store.GetToken(ctx, ds.name)
+	if err != nil {
+		return Token{}, fmt.Errorf("fail to load token %s, %w", ds.name, err)
+	}
+	if !found {
+		return Token{}, nil
+	}
+	return Token{
+		AccessToken:     record.Token,
+		ExpireTimestamp: record.ExpireAt,
+		FetchedAt:       record.FetchedAt,
+	}, nil
+}
+
+func (ds *dbTokenStore) Save(ctx context.Context, token Token) error {
+	return ds.store.SaveToken(ctx, datastore.AccessToken{
+		Name:      ds.name,
+		Token:     token.AccessToken,
+		ExpireAt:  token.ExpireTimestamp,
+		FetchedAt: token.FetchedAt,
+	})
+}
+
+func (ds *dbTokenStore) AcquireLease(ctx context.Context, holder string) (bool, error) {
+	return ds.store.AcquireTokenLease(ctx, ds.name, holder, tokenLeaseTTL)
+}
+
+/*
+ * remote store, reads the token from a central token server
+ */
+
+type remoteTokenStore struct {
+	url    string
+	client *http.Client
+}
+
+func NewRemoteTokenStore(url string) *remoteTokenStore {
+	return &remoteTokenStore{
+		url:    url,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+func (rs *remoteTokenStore) Load(ctx context.Context) (Token, error) {
+	var token Token
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rs.url, nil)
+	if err != nil {
+		return token, fmt.Errorf("fail to create req for token server, %w", err)
+	}
+	req.Header.Set("x-alex-auth", src.DefaultApiToken)
+	src.InjectTraceparent(ctx, req.Header)
+
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return token, fmt.Errorf("fail to send req to token server, %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("token server responded with status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return token, fmt.Errorf("fail to decode token server resp, %w", err)
+	}
+	return token, nil
+}
+
+// Save is a no-op, the central server owns the token.
+func (rs *remoteTokenStore) Save(_ context.Context, _ Token) error {
+	return nil
+}
+
+// AcquireLease never grants the lease, only the central server talks to wechat.
+func (rs *remoteTokenStore) AcquireLease(_ context.Context, _ string) (bool, error) {
+	return false, nil
+}
+
+// RegisterTokenServer exposes the current token to other internal services,
+// they point their remote token store at this endpoint.
+func (tm *tokenManager) RegisterTokenServer(group *gin.RouterGroup) {
+	group.GET("", func(context *gin.Context) {
+		ctx := context.Request.Context()
+
+		if _, err := tm.Token(ctx); err != nil {
+			context.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+
+		tm.mutex.RLock()
+		token := tm.current
+		tm.mutex.RUnlock()
+		context.JSON(http.StatusOK, token)
+	})
+}
@@ -0,0 +1,184 @@
+package wechat_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/wechat"
+	"github.com/hanzezhenalex/wechat/src/wechattest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenManager(t *testing.T) {
+	rq := require.New(t)
+
+	fake := wechattest.NewServer("app_id", "app_secret")
+	api := httptest.NewServer(fake)
+	defer api.Close()
+
+	cfg := src.Config{
+		AppID:      "app_id",
+		AppSecret:  "app_secret",
+		ApiBaseUrl: api.URL,
+	}
+	tm := wechat.NewTokenManager(cfg, wechat.NewFileTokenStore(filepath.Join(t.TempDir(), "token.json")))
+	defer tm.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("wait for first token", func(t *testing.T) {
+		token, err := tm.Token(ctx)
+		rq.NoError(err)
+		rq.NotEmpty(token)
+
+		status := tm.Status()
+		rq.True(status.Valid)
+		rq.WithinDuration(time.Now().Add(7200*time.Second), status.ExpireAt, time.Minute)
+	})
+
+	t.Run("concurrent refresh collapses", func(t *testing.T) {
+		issued := fake.TokensIssued()
+		// the first refresh is held upstream till the others join it
+		release := fake.HoldTokens()
+		defer release()
+
+		wg := sync.WaitGroup{}
+		started := sync.WaitGroup{}
+		tokens := make([]string, 10)
+		errs := make([]error, len(tokens))
+		for i := range tokens {
+			wg.Add(1)
+			started.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				started.Done()
+				token, err := tm.Refresh(ctx)
+				tokens[i], errs[i] = token.AccessToken, err
+			}(i)
+		}
+		started.Wait()
+		time.Sleep(100 * time.Millisecond)
+		release()
+		wg.Wait()
+		for _, err := range errs {
+			rq.NoError(err)
+		}
+
+		rq.Equal(1, fake.TokensIssued()-issued)
+		current, err := tm.Token(ctx)
+		rq.NoError(err)
+		rq.Contains(tokens, current)
+	})
+
+	t.Run("stop releases waiters", func(t *testing.T) {
+		broken := wechat.NewTokenManager(src.Config{
+			AppID:      "app_id",
+			AppSecret:  "wrong_secret",
+			ApiBaseUrl: api.URL,
+		}, wechat.NewFileTokenStore(filepath.Join(t.TempDir(), "token.json")))
+
+		errs := make(chan error)
+		go func() {
+			_, err := broken.Token(ctx)
+			errs <- err
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		rq.NotEmpty(broken.Status().LastError)
+
+		broken.Stop()
+		rq.Error(<-errs)
+	})
+}
+
+// sharedStore emulates the db token store, the first holder keeps the lease until it expires.
+type sharedStore struct {
+	mutex  sync.Mutex
+	token  wechat.Token
+	holder string
+}
+
+func (s *sharedStore) expireLease() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.holder = ""
+}
+
+func (s *sharedStore) Load(_ context.Context) (wechat.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token, nil
+}
+
+func (s *sharedStore) Save(_ context.Context, token wechat.Token) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = token
+	return nil
+}
+
+func (s *sharedStore) AcquireLease(_ context.Context, holder string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.holder == "" {
+		s.holder = holder
+	}
+	return s.holder == holder, nil
+}
+
+func TestSharedTokenStore(t *testing.T) {
+	rq := require.New(t)
+
+	fake := wechattest.NewServer("app_id", "app_secret")
+	api := httptest.NewServer(fake)
+	defer api.Close()
+
+	cfg := src.Config{
+		AppID:      "app_id",
+		AppSecret:  "app_secret",
+		ApiBaseUrl: api.URL,
+	}
+	store := &sharedStore{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	leader := wechat.NewTokenManager(cfg, store)
+	defer leader.Stop()
+	leaderToken, err := leader.Token(ctx)
+	rq.NoError(err)
+
+	follower := wechat.NewTokenManager(cfg, store)
+	defer follower.Stop()
+	followerToken, err := follower.Token(ctx)
+	rq.NoError(err)
+
+	_, err = follower.Refresh(ctx)
+	rq.NoError(err)
+
+	rq.Equal(leaderToken, followerToken)
+	rq.Equal(1, fake.TokensIssued())
+
+	t.Run("lease expired", func(t *testing.T) {
+		// the leader refreshes as the lease is its own again
+		store.expireLease()
+		refreshed, err := leader.Refresh(ctx)
+		rq.NoError(err)
+		rq.NotEqual(leaderToken, refreshed.AccessToken)
+		rq.Equal(2, fake.TokensIssued())
+
+		// the follower takes the lease expired, and uses the token refreshed by the leader
+		store.expireLease()
+		token, err := follower.Refresh(ctx)
+		rq.NoError(err)
+		rq.Equal(refreshed.AccessToken, token.AccessToken)
+		rq.Equal(2, fake.TokensIssued())
+	})
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/hanzezhenalex/wechat/src"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hanzezhenalex/wechat/src/datastore"
+	"github.com/hanzezhenalex/wechat/src/metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,31 +23,103 @@ type item struct {
 	wg *sync.WaitGroup
 }
 
+// umsLoadRetry is how often the users are fetched again till they are all cached.
+var umsLoadRetry = 10 * time.Second
+
 type UserMngr struct {
 	// cache through
-	cache sync.Map // wechat_id -> User
-	store datastore.DataStore
+	cache  sync.Map // wechat_id -> User
+	loaded int32    // set once all users are cached, atomic
+	store  datastore.DataStore
 
 	// once a time for each user req, blocking others
 	updating map[string]*item
 	mutex    sync.Mutex
+
+	// leader_id -> wechat_ids of the members, a user never changes the leader
+	teams      map[string]map[string]struct{}
+	teamsMutex sync.RWMutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
+var cachedUsers = metrics.NewGaugeFunc("wechat_ums_cached_users", "Users in the cache of UserMngr.")
+
+// NewUMS caches all users. If the datastore fails, the users are fetched again in the
+// background and are not Loaded till then.
 func NewUMS(store datastore.DataStore) (*UserMngr, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	usm := &UserMngr{
 		store:    store,
 		updating: make(map[string]*item),
+		teams:    make(map[string]map[string]struct{}),
+		cancel:   cancel,
+		done:     make(chan struct{}),
 	}
-	users, err := store.GetAllUsers(context.Background())
+	cachedUsers.Set(func() (float64, bool) {
+		n := 0
+		usm.cache.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		return float64(n), true
+	})
+
+	if err := usm.load(ctx); err != nil {
+		umsTracer(ctx).Errorf("fail to cache users, retry in %s, %s", umsLoadRetry, err.Error())
+		go usm.retryLoad(ctx)
+		return usm, nil
+	}
+	close(usm.done)
+	return usm, nil
+}
+
+func (ums *UserMngr) load(ctx context.Context) error {
+	users, err := ums.store.GetAllUsers(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fail to get all users from datastore, %w", err)
+		return fmt.Errorf("fail to get all users from datastore, %w", err)
 	}
 
-	// cache all users
+	// cache all users, the ones created or updated meanwhile are newer
 	for _, user := range users {
-		usm.cache.Store(user.WechatID, user)
+		if _, loaded := ums.cache.LoadOrStore(user.WechatID, user); !loaded {
+			ums.addMember(user)
+		}
 	}
-	return usm, nil
+	atomic.StoreInt32(&ums.loaded, 1)
+	return nil
+}
+
+func (ums *UserMngr) retryLoad(ctx context.Context) {
+	defer close(ums.done)
+	ticker := time.NewTicker(umsLoadRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ums.load(ctx); err != nil {
+			umsTracer(ctx).Errorf("fail to cache users, %s", err.Error())
+			continue
+		}
+		umsTracer(ctx).Info("users cached")
+		return
+	}
+}
+
+// Loaded reports whether the users in the datastore are all cached.
+func (ums *UserMngr) Loaded() bool {
+	return atomic.LoadInt32(&ums.loaded) == 1
+}
+
+// Stop gives up caching the users in the background, if still trying.
+func (ums *UserMngr) Stop() {
+	ums.cancel()
+	<-ums.done
 }
 
 func (ums *UserMngr) CreateNewUser(ctx context.Context, user datastore.UserInfo) error {
@@ -79,10 +153,26 @@ func (ums *UserMngr) CreateNewUser(ctx context.Context, user datastore.UserInfo)
 	}
 
 	ums.cache.Store(key, user)
+	ums.addMember(user)
 
 	return nil
 }
 
+func (ums *UserMngr) addMember(user datastore.UserInfo) {
+	if user.LeaderID == "" {
+		return
+	}
+	ums.teamsMutex.Lock()
+	defer ums.teamsMutex.Unlock()
+
+	members, ok := ums.teams[user.LeaderID]
+	if !ok {
+		members = make(map[string]struct{})
+		ums.teams[user.LeaderID] = members
+	}
+	members[user.WechatID] = struct{}{}
+}
+
 func (ums *UserMngr) GetUserById(_ context.Context, id string) (datastore.UserInfo, bool) {
 	val, loaded := ums.cache.Load(id)
 	if !loaded {
@@ -91,19 +181,78 @@ func (ums *UserMngr) GetUserById(_ context.Context, id string) (datastore.UserIn
 	return val.(datastore.UserInfo), true
 }
 
+// SetNotify opts the user in or out of template message notifications.
+func (ums *UserMngr) SetNotify(ctx context.Context, id string, mute bool) (datastore.UserInfo, error) {
+	user, ok := ums.GetUserById(ctx, id)
+	if !ok {
+		return user, fmt.Errorf("user %s not found", id)
+	}
+	if err := ums.store.UpdateUserNotify(ctx, id, mute); err != nil {
+		return user, fmt.Errorf("fail to update notify of user %s in datastore, %w", id, err)
+	}
+
+	user.MuteNotify = mute
+	ums.cache.Store(id, user)
+	return user, nil
+}
+
+// SetFollower updates what wechat knows about the user.
+func (ums *UserMngr) SetFollower(ctx context.Context, id string, nickname string, subscribed bool) (datastore.UserInfo, error) {
+	user, ok := ums.GetUserById(ctx, id)
+	if !ok {
+		return user, fmt.Errorf("user %s not found", id)
+	}
+	if err := ums.store.UpdateUserFollower(ctx, id, nickname, subscribed); err != nil {
+		return user, fmt.Errorf("fail to update follower of user %s in datastore, %w", id, err)
+	}
+
+	user.Nickname = nickname
+	user.Subscribed = subscribed
+	ums.cache.Store(id, user)
+	return user, nil
+}
+
+// Users returns all the cached users.
+func (ums *UserMngr) Users(_ context.Context) []datastore.UserInfo {
+	var users []datastore.UserInfo
+	ums.cache.Range(func(_, val interface{}) bool {
+		users = append(users, val.(datastore.UserInfo))
+		return true
+	})
+	return users
+}
+
+// Members returns the wechat ids of the users led by leader.
+func (ums *UserMngr) Members(_ context.Context, leader string) []string {
+	ums.teamsMutex.RLock()
+	defer ums.teamsMutex.RUnlock()
+
+	members := make([]string, 0, len(ums.teams[leader]))
+	for member := range ums.teams[leader] {
+		members = append(members, member)
+	}
+	return members
+}
+
+// IsLeader tells whether any user is led by id.
+func (ums *UserMngr) IsLeader(_ context.Context, id string) bool {
+	ums.teamsMutex.RLock()
+	defer ums.teamsMutex.RUnlock()
+	return len(ums.teams[id]) > 0
+}
+
+type NotifyReq struct {
+	WechatID string `json:"wechat_id"`
+	Mute     bool   `json:"mute"`
+}
+
 func (ums *UserMngr) RegisterEndpoints(group *gin.RouterGroup) {
 	group.POST("/create", func(context *gin.Context) {
 		ctx := context.Request.Context()
 		tracer := umsTracer(ctx)
 
-		auth := context.Request.Header.Get("x-alex-auth")
-		if auth != src.DefaultApiToken {
-			tracer.Warningf("req rejected, invalid auth token")
-			context.Writer.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		var user datastore.UserInfo
+		// a user created by hand is taken as a follower unless told otherwise
+		user := datastore.UserInfo{Subscribed: true}
 		if err := json.NewDecoder(context.Request.Body).Decode(&user); err != nil {
 			tracer.Errorf("fail to decode req body, %s", err.Error())
 			_, _ = context.Writer.Write([]byte(err.Error()))
@@ -119,4 +268,23 @@ func (ums *UserMngr) RegisterEndpoints(group *gin.RouterGroup) {
 		tracer.Infof("new user created, id=%s, name=%s", user.WechatID, user.Name)
 		context.Writer.WriteHeader(http.StatusOK)
 	})
+
+	group.POST("/notify", func(context *gin.Context) {
+		ctx := context.Request.Context()
+		tracer := umsTracer(ctx)
+
+		var req NotifyReq
+		if err := json.NewDecoder(context.Request.Body).Decode(&req); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := ums.SetNotify(ctx, req.WechatID, req.Mute)
+		if err != nil {
+			tracer.Errorf("fail to set notify, %s", err.Error())
+			context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tracer.Infof("notify of user %s set, mute=%t", user.WechatID, user.MuteNotify)
+		context.JSON(http.StatusOK, user)
+	})
 }
@@ -2,6 +2,7 @@ package wechat
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -34,6 +35,18 @@ func TestUMS(t *testing.T) {
 		rq.True(ok)
 	})
 
+	t.Run("leader", func(t *testing.T) {
+		store.EXPECT().CreateNewUser(gomock.Any(), gomock.Any()).Return(nil)
+
+		rq.False(ums.IsLeader(context.Background(), "id1"))
+		rq.NoError(ums.CreateNewUser(context.Background(), datastore.UserInfo{
+			WechatID: "member1",
+			LeaderID: "id1",
+		}))
+		rq.True(ums.IsLeader(context.Background(), "id1"))
+		rq.False(ums.IsLeader(context.Background(), "member1"))
+	})
+
 	t.Run("duplicated creation", func(t *testing.T) {
 		store.EXPECT().CreateNewUser(gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, new datastore.UserInfo) error {
 			rq.Equal("id2", new.WechatID)
@@ -74,3 +87,27 @@ func TestUMS(t *testing.T) {
 		rq.True(ok)
 	})
 }
+
+func TestUMSLoadInBackground(t *testing.T) {
+	rq := require.New(t)
+
+	retry := umsLoadRetry
+	umsLoadRetry = 10 * time.Millisecond
+	defer func() { umsLoadRetry = retry }()
+
+	ctrl := gomock.NewController(t)
+	store := mock.NewMockDataStore(ctrl)
+	gomock.InOrder(
+		store.EXPECT().GetAllUsers(gomock.Any()).Return(nil, errors.New("connection refused")),
+		store.EXPECT().GetAllUsers(gomock.Any()).Return([]datastore.UserInfo{{WechatID: "id1"}}, nil),
+	)
+
+	ums, err := NewUMS(store)
+	rq.NoError(err)
+	defer ums.Stop()
+	rq.False(ums.Loaded())
+
+	rq.Eventually(ums.Loaded, time.Second, 10*time.Millisecond)
+	_, ok := ums.GetUserById(context.Background(), "id1")
+	rq.True(ok)
+}
@@ -0,0 +1,148 @@
+package wechattest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src/wechat"
+)
+
+func newMessage(from, to, msgType string) wechat.Message {
+	return wechat.Message{
+		ToUserName:   to,
+		FromUserName: from,
+		CreateTime:   strconv.FormatInt(time.Now().Unix(), 10),
+		MsgType:      msgType,
+		MsgId:        strconv.FormatInt(rand.Int63(), 10),
+	}
+}
+
+func NewTextMessage(from, to, content string) wechat.Message {
+	msg := newMessage(from, to, "text")
+	msg.Content = content
+	return msg
+}
+
+func NewImageMessage(from, to, picUrl string) wechat.Message {
+	msg := newMessage(from, to, "image")
+	msg.PicUrl = picUrl
+	msg.MediaId = strconv.FormatInt(rand.Int63(), 36)
+	return msg
+}
+
+// NewEventMessage builds an event push, events carry no MsgId.
+func NewEventMessage(from, to, event, eventKey string) wechat.Message {
+	msg := newMessage(from, to, "event")
+	msg.MsgId = ""
+	msg.Event = event
+	msg.EventKey = eventKey
+	return msg
+}
+
+// ReadMessages reads one json encoded message per line, blank lines are skipped.
+func ReadMessages(r io.Reader) ([]wechat.Message, error) {
+	var msgs []wechat.Message
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		raw := scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+		var msg wechat.Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, fmt.Errorf("fail to decode message at line %d, %w", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("fail to read messages, %w", err)
+	}
+	return msgs, nil
+}
+
+type ReplayResult struct {
+	Sent     int
+	Failed   int
+	Duration time.Duration
+	P50      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Replay pushes the messages to the portal at the given rate (messages per second),
+// with at most concurrency requests in flight. A zero rate sends as fast as possible.
+func (p *Portal) Replay(ctx context.Context, msgs []wechat.Message, rate float64, concurrency int) ReplayResult {
+	var (
+		result    ReplayResult
+		mutex     sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var ticker *time.Ticker
+	if rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+	}
+
+	start := time.Now()
+loop:
+	for _, msg := range msgs {
+		if ticker != nil {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-ticker.C:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(msg wechat.Message) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			begin := time.Now()
+			_, _, err := p.Push(ctx, msg)
+			elapsed := time.Since(begin)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			result.Sent++
+			if err != nil {
+				result.Failed++
+			}
+			latencies = append(latencies, elapsed)
+		}(msg)
+	}
+	wg.Wait()
+
+	result.Duration = time.Since(start)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P50 = latencies[len(latencies)*50/100]
+		result.P99 = latencies[len(latencies)*99/100]
+		result.Max = latencies[len(latencies)-1]
+	}
+	return result
+}
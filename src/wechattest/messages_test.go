@@ -0,0 +1,61 @@
+package wechattest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hanzezhenalex/wechat/src"
+	"github.com/hanzezhenalex/wechat/src/wechat"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	rq := require.New(t)
+	gin.SetMode(gin.TestMode)
+
+	var received int32
+	eng := gin.New()
+	cfg := src.Config{Token: "token", Portal: src.PortalConfig{MaxSkewSeconds: 300, NonceCacheSize: 100}}
+	eng.POST("/portal", wechat.IsWechat(cfg), func(c *gin.Context) {
+		var msg wechat.Message
+		// a bad body fails the push, asserted by the result below
+		if err := xml.NewDecoder(c.Request.Body).Decode(&msg); err != nil {
+			c.Writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+		_, _ = c.Writer.WriteString(msg.TextResponse(msg.MsgType))
+	})
+	server := httptest.NewServer(eng)
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	rq.NoError(encoder.Encode(NewTextMessage("user", "official", "hello")))
+	rq.NoError(encoder.Encode(NewImageMessage("user", "official", "https://mmbiz.qpic.cn/a/b/0")))
+	buf.WriteString("\n")
+	rq.NoError(encoder.Encode(NewEventMessage("user", "official", "subscribe", "")))
+
+	msgs, err := ReadMessages(buf)
+	rq.NoError(err)
+	rq.Len(msgs, 3)
+	rq.Equal("event", msgs[2].MsgType)
+	rq.Equal("subscribe", msgs[2].Event)
+
+	portal := NewPortal(server.URL+"/portal", "token")
+	result := portal.Replay(context.Background(), msgs, 0, 2)
+	rq.Equal(3, result.Sent)
+	rq.Equal(0, result.Failed)
+	rq.Equal(int32(3), atomic.LoadInt32(&received))
+
+	result = NewPortal(server.URL+"/portal", "wrong").Replay(context.Background(), msgs[:1], 100, 1)
+	rq.Equal(1, result.Failed)
+}
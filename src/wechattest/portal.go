@@ -0,0 +1,162 @@
+package wechattest
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanzezhenalex/wechat/src/wechat"
+)
+
+// Portal plays the wechat push side, it sends signed requests to /wechat/portal
+// exactly the way wechat.IsWechat expects them.
+type Portal struct {
+	url    string
+	token  string
+	client *http.Client
+	skew   time.Duration
+}
+
+func NewPortal(portalUrl, token string) *Portal {
+	return &Portal{
+		url:    portalUrl,
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// SetClockSkew shifts the timestamp of the requests signed afterwards, e.g. to send a stale one.
+func (p *Portal) SetClockSkew(skew time.Duration) {
+	p.skew = skew
+}
+
+// SignedUrl returns the portal url with timestamp, nonce and signature attached.
+func (p *Portal) SignedUrl(extra url.Values) (string, error) {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return "", fmt.Errorf("fail to parse portal url, %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Add(p.skew).Unix(), 10)
+	nonce := strconv.Itoa(rand.Int())
+
+	query := u.Query()
+	for k, vs := range extra {
+		for _, v := range vs {
+			query.Add(k, v)
+		}
+	}
+	query.Set("timestamp", timestamp)
+	query.Set("nonce", nonce)
+	query.Set("signature", wechat.Signature(p.token, timestamp, nonce))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Verify sends the echostr check wechat does when the portal is configured.
+func (p *Portal) Verify(ctx context.Context, echoStr string) (string, error) {
+	target, err := p.SignedUrl(url.Values{"echostr": []string{echoStr}})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", fmt.Errorf("fail to create request, %w", err)
+	}
+	raw, err := p.do(req)
+	return string(raw), err
+}
+
+// Push sends the message to the portal and returns the raw and decoded reply.
+func (p *Portal) Push(ctx context.Context, msg wechat.Message) (wechat.Message, string, error) {
+	var reply wechat.Message
+
+	target, err := p.SignedUrl(nil)
+	if err != nil {
+		return reply, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(EncodeMessage(msg)))
+	if err != nil {
+		return reply, "", fmt.Errorf("fail to create request, %w", err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+
+	raw, err := p.do(req)
+	if err != nil {
+		return reply, string(raw), err
+	}
+	if len(raw) == 0 {
+		return reply, "", nil
+	}
+	if err := xml.Unmarshal(raw, &reply); err != nil {
+		return reply, string(raw), fmt.Errorf("fail to decode reply, %w", err)
+	}
+	return reply, string(raw), nil
+}
+
+func (p *Portal) do(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fail to send request to portal, %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read portal response, %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return raw, fmt.Errorf("portal responded with status %d", resp.StatusCode)
+	}
+	return raw, nil
+}
+
+// EncodeMessage renders the message the way wechat pushes it.
+func EncodeMessage(msg wechat.Message) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("<xml>")
+	writeCData(buf, "ToUserName", msg.ToUserName)
+	writeCData(buf, "FromUserName", msg.FromUserName)
+	if msg.CreateTime == "" {
+		msg.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	buf.WriteString("<CreateTime>" + msg.CreateTime + "</CreateTime>")
+	writeCData(buf, "MsgType", msg.MsgType)
+	if msg.Content != "" {
+		writeCData(buf, "Content", msg.Content)
+	}
+	if msg.PicUrl != "" {
+		writeCData(buf, "PicUrl", msg.PicUrl)
+	}
+	if msg.MediaId != "" {
+		writeCData(buf, "MediaId", msg.MediaId)
+	}
+	if msg.Event != "" {
+		writeCData(buf, "Event", msg.Event)
+	}
+	if msg.EventKey != "" {
+		writeCData(buf, "EventKey", msg.EventKey)
+	}
+	if msg.Ticket != "" {
+		writeCData(buf, "Ticket", msg.Ticket)
+	}
+	if msg.MsgId != "" {
+		buf.WriteString("<MsgId>" + msg.MsgId + "</MsgId>")
+	}
+	buf.WriteString("</xml>")
+	return buf.Bytes()
+}
+
+func writeCData(buf *bytes.Buffer, tag, value string) {
+	buf.WriteString("<" + tag + "><![CDATA[")
+	buf.WriteString(strings.ReplaceAll(value, "]]>", "]]]]><![CDATA[>"))
+	buf.WriteString("]]></" + tag + ">")
+}
@@ -0,0 +1,656 @@
+package wechattest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTokenTTL = 7200 * time.Second
+
+	errCodeInvalidToken     = 40001
+	errCodeInvalidAppSecret = 40125
+	errCodeTokenExpired     = 42001
+	errCodeInvalidMediaId   = 40007
+	errCodeInvalidArgs      = 44002
+	errCodeInvalidOAuthCode = 40029
+	errCodeMenuNotExist     = 46003
+)
+
+var serverTracer = logrus.WithField("comp", "fake_wechat")
+
+type ErrorResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// CustomMessage is what the server received through message/custom/send.
+type CustomMessage struct {
+	ToUser  string `json:"touser"`
+	MsgType string `json:"msgtype"`
+	Text    struct {
+		Content string `json:"content"`
+	} `json:"text"`
+}
+
+// TemplateMessage is what the server received through message/template/send.
+type TemplateMessage struct {
+	ToUser     string `json:"touser"`
+	TemplateID string `json:"template_id"`
+	Url        string `json:"url,omitempty"`
+	Data       map[string]struct {
+		Value string `json:"value"`
+	} `json:"data"`
+}
+
+// Server emulates the parts of api.weixin.qq.com used by the server.
+// It is a plain http.Handler, wrap it with httptest.NewServer in tests
+// or http.ListenAndServe in the fake binary.
+type Server struct {
+	appID     string
+	appSecret string
+
+	mutex     sync.Mutex
+	tokenTTL  time.Duration
+	tokens    map[string]time.Time // access token -> expire time
+	tokenHold chan struct{}        // the token requests wait on it if set
+	issued    int
+	tickets   int
+	media     map[string][]byte
+	customs   []CustomMessage
+	templates []TemplateMessage
+
+	oauthUser  string            // the user who "opens" the authorize page
+	oauthCodes map[string]string // code -> openid
+
+	failures map[string]*injectedFailure // path -> failure
+	qrcodes  map[string]string           // ticket -> scene
+
+	followers        []string          // in order of following
+	nicknames        map[string]string // openid -> nickname
+	followerPageSize int
+
+	callbackIPs []string
+
+	menu            json.RawMessage
+	conditionalMenu map[int64]json.RawMessage
+	nextMenuID      int64
+
+	mux *http.ServeMux
+}
+
+func NewServer(appID, appSecret string) *Server {
+	s := &Server{
+		appID:            appID,
+		appSecret:        appSecret,
+		tokenTTL:         defaultTokenTTL,
+		tokens:           make(map[string]time.Time),
+		media:            make(map[string][]byte),
+		oauthCodes:       make(map[string]string),
+		conditionalMenu:  make(map[int64]json.RawMessage),
+		failures:         make(map[string]*injectedFailure),
+		qrcodes:          make(map[string]string),
+		nicknames:        make(map[string]string),
+		followerPageSize: 10000,
+		callbackIPs:      []string{"127.0.0.1"},
+		mux:              http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/cgi-bin/token", s.token)
+	s.mux.HandleFunc("/cgi-bin/ticket/getticket", s.authorized(s.getTicket))
+	s.mux.HandleFunc("/cgi-bin/media/get", s.authorized(s.mediaGet))
+	s.mux.HandleFunc("/cgi-bin/message/custom/send", s.authorized(s.customSend))
+	s.mux.HandleFunc("/cgi-bin/message/template/send", s.authorized(s.templateSend))
+	s.mux.HandleFunc("/cgi-bin/user/get", s.authorized(s.userGet))
+	s.mux.HandleFunc("/cgi-bin/user/info/batchget", s.authorized(s.userBatchGet))
+	s.mux.HandleFunc("/cgi-bin/getcallbackip", s.authorized(s.getCallbackIP))
+	s.mux.HandleFunc("/cgi-bin/qrcode/create", s.authorized(s.qrcodeCreate))
+	s.mux.HandleFunc("/cgi-bin/menu/create", s.authorized(s.menuCreate))
+	s.mux.HandleFunc("/cgi-bin/menu/get", s.authorized(s.menuGet))
+	s.mux.HandleFunc("/cgi-bin/menu/delete", s.authorized(s.menuDelete))
+	s.mux.HandleFunc("/cgi-bin/menu/addconditional", s.authorized(s.menuAddConditional))
+	s.mux.HandleFunc("/cgi-bin/menu/delconditional", s.authorized(s.menuDelConditional))
+	s.mux.HandleFunc("/connect/oauth2/authorize", s.oauthAuthorize)
+	s.mux.HandleFunc("/sns/oauth2/access_token", s.oauthAccessToken)
+	s.mux.HandleFunc("/sns/userinfo", s.oauthUserInfo)
+	return s
+}
+
+type injectedFailure struct {
+	remaining int
+	errCode   int
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serverTracer.Debugf("[REQ] %s | %s", r.Method, r.URL.Path)
+
+	s.mutex.Lock()
+	failure, ok := s.failures[r.URL.Path]
+	if ok {
+		failure.remaining--
+		if failure.remaining <= 0 {
+			delete(s.failures, r.URL.Path)
+		}
+	}
+	s.mutex.Unlock()
+	if ok {
+		writeError(w, failure.errCode, "injected failure")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// FailNext makes the next n calls to path fail with errCode, e.g. -1 for system busy.
+func (s *Server) FailNext(path string, n int, errCode int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[path] = &injectedFailure{remaining: n, errCode: errCode}
+}
+
+// SetTokenTTL changes the lifetime of access tokens issued from now on.
+func (s *Server) SetTokenTTL(ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokenTTL = ttl
+}
+
+// ExpireTokens invalidates every access token issued so far.
+func (s *Server) ExpireTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for token := range s.tokens {
+		s.tokens[token] = time.Time{}
+	}
+}
+
+// HoldTokens makes the token requests from now on wait till release is called,
+// e.g. so that concurrent refreshes arrive while one is in flight.
+func (s *Server) HoldTokens() (release func()) {
+	hold := make(chan struct{})
+	s.mutex.Lock()
+	s.tokenHold = hold
+	s.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			s.tokenHold = nil
+			s.mutex.Unlock()
+			close(hold)
+		})
+	}
+}
+
+// TokensIssued returns how many access tokens have been handed out.
+func (s *Server) TokensIssued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.issued
+}
+
+func (s *Server) AddMedia(mediaId string, content []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.media[mediaId] = content
+}
+
+// SetOAuthUser sets the user who approves the authorization on /connect/oauth2/authorize.
+func (s *Server) SetOAuthUser(openID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.oauthUser = openID
+}
+
+func (s *Server) CustomMessages() []CustomMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]CustomMessage(nil), s.customs...)
+}
+
+func (s *Server) TemplateMessages() []TemplateMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]TemplateMessage(nil), s.templates...)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("grant_type") != "client_credential" {
+		writeError(w, errCodeInvalidArgs, "invalid grant_type")
+		return
+	}
+	if query.Get("appid") != s.appID || query.Get("secret") != s.appSecret {
+		writeError(w, errCodeInvalidAppSecret, "invalid appsecret")
+		return
+	}
+
+	s.mutex.Lock()
+	hold := s.tokenHold
+	s.mutex.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	s.mutex.Lock()
+	s.issued++
+	token := fmt.Sprintf("fake_token_%d_%d", s.issued, time.Now().UnixNano())
+	ttl := s.tokenTTL
+	s.tokens[token] = time.Now().Add(ttl)
+	s.mutex.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   int(ttl / time.Second),
+	})
+}
+
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+
+		s.mutex.Lock()
+		expire, ok := s.tokens[token]
+		s.mutex.Unlock()
+
+		switch {
+		case !ok:
+			writeError(w, errCodeInvalidToken, "invalid credential, access_token is invalid or not latest")
+		case time.Now().After(expire):
+			writeError(w, errCodeTokenExpired, "access_token expired")
+		default:
+			next(w, r)
+		}
+	}
+}
+
+func (s *Server) getTicket(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("type") != "jsapi" {
+		writeError(w, errCodeInvalidArgs, "invalid ticket type")
+		return
+	}
+
+	s.mutex.Lock()
+	s.tickets++
+	ticket := fmt.Sprintf("fake_ticket_%d", s.tickets)
+	ttl := s.tokenTTL
+	s.mutex.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"errcode":    0,
+		"errmsg":     "ok",
+		"ticket":     ticket,
+		"expires_in": int(ttl / time.Second),
+	})
+}
+
+func (s *Server) mediaGet(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	content, ok := s.media[r.URL.Query().Get("media_id")]
+	s.mutex.Unlock()
+
+	if !ok {
+		writeError(w, errCodeInvalidMediaId, "invalid media_id")
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	_, _ = w.Write(content)
+}
+
+func (s *Server) customSend(w http.ResponseWriter, r *http.Request) {
+	var msg CustomMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.ToUser == "" {
+		writeError(w, errCodeInvalidArgs, "invalid custom message")
+		return
+	}
+
+	s.mutex.Lock()
+	s.customs = append(s.customs, msg)
+	s.mutex.Unlock()
+
+	writeError(w, 0, "ok")
+}
+
+func (s *Server) templateSend(w http.ResponseWriter, r *http.Request) {
+	var msg TemplateMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.ToUser == "" || msg.TemplateID == "" {
+		writeError(w, errCodeInvalidArgs, "invalid template message")
+		return
+	}
+
+	s.mutex.Lock()
+	s.templates = append(s.templates, msg)
+	msgId := len(s.templates)
+	s.mutex.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"errcode": 0,
+		"errmsg":  "ok",
+		"msgid":   msgId,
+	})
+}
+
+// Follow makes openID a follower of the account.
+func (s *Server) Follow(openID, nickname string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.nicknames[openID]; !ok {
+		s.followers = append(s.followers, openID)
+	}
+	s.nicknames[openID] = nickname
+}
+
+func (s *Server) Unfollow(openID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.nicknames, openID)
+	for i, follower := range s.followers {
+		if follower == openID {
+			s.followers = append(s.followers[:i], s.followers[i+1:]...)
+			break
+		}
+	}
+}
+
+// SetFollowerPageSize changes how many followers user/get returns a page, 10000 on wechat.
+func (s *Server) SetFollowerPageSize(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.followerPageSize = n
+}
+
+// SetCallbackIPs replaces what getcallbackip returns, 127.0.0.1 by default.
+func (s *Server) SetCallbackIPs(ips ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.callbackIPs = append([]string(nil), ips...)
+}
+
+func (s *Server) getCallbackIP(w http.ResponseWriter, _ *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	writeJSON(w, map[string]interface{}{"ip_list": s.callbackIPs})
+}
+
+func (s *Server) userGet(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := 0
+	if next := r.URL.Query().Get("next_openid"); next != "" {
+		start = len(s.followers)
+		for i, follower := range s.followers {
+			if follower == next {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := start + s.followerPageSize
+	if end > len(s.followers) {
+		end = len(s.followers)
+	}
+	page := append([]string(nil), s.followers[start:end]...)
+
+	next := ""
+	if len(page) > 0 {
+		next = page[len(page)-1]
+	}
+	writeJSON(w, map[string]interface{}{
+		"total":       len(s.followers),
+		"count":       len(page),
+		"data":        map[string]interface{}{"openid": page},
+		"next_openid": next,
+	})
+}
+
+func (s *Server) userBatchGet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserList []struct {
+			OpenID string `json:"openid"`
+		} `json:"user_list"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.UserList) == 0 || len(req.UserList) > 100 {
+		writeError(w, errCodeInvalidArgs, "invalid user_list")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var infos []map[string]interface{}
+	for _, user := range req.UserList {
+		nickname, ok := s.nicknames[user.OpenID]
+		if !ok {
+			infos = append(infos, map[string]interface{}{"subscribe": 0, "openid": user.OpenID})
+			continue
+		}
+		infos = append(infos, map[string]interface{}{"subscribe": 1, "openid": user.OpenID, "nickname": nickname})
+	}
+	writeJSON(w, map[string]interface{}{"user_info_list": infos})
+}
+
+// QRCodeScene returns the scene of the qrcode created with the ticket.
+func (s *Server) QRCodeScene(ticket string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scene, ok := s.qrcodes[ticket]
+	return scene, ok
+}
+
+func (s *Server) qrcodeCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ExpireSeconds int    `json:"expire_seconds"`
+		ActionName    string `json:"action_name"`
+		ActionInfo    struct {
+			Scene struct {
+				SceneStr string `json:"scene_str"`
+			} `json:"scene"`
+		} `json:"action_info"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errCodeInvalidArgs, "invalid qrcode request")
+		return
+	}
+	scene := req.ActionInfo.Scene.SceneStr
+	switch {
+	case scene == "" || len(scene) > 64:
+		writeError(w, errCodeInvalidArgs, "invalid scene_str")
+		return
+	case req.ActionName == "QR_STR_SCENE" && (req.ExpireSeconds <= 0 || req.ExpireSeconds > 2592000):
+		writeError(w, errCodeInvalidArgs, "invalid expire_seconds")
+		return
+	case req.ActionName != "QR_STR_SCENE" && req.ActionName != "QR_LIMIT_STR_SCENE":
+		writeError(w, errCodeInvalidArgs, "unsupported action_name")
+		return
+	}
+
+	s.mutex.Lock()
+	ticket := fmt.Sprintf("qrcode_ticket_%d", len(s.qrcodes)+1)
+	s.qrcodes[ticket] = scene
+	s.mutex.Unlock()
+
+	resp := map[string]interface{}{
+		"ticket": ticket,
+		"url":    "http://weixin.qq.com/q/" + ticket,
+	}
+	if req.ActionName == "QR_STR_SCENE" {
+		resp["expire_seconds"] = req.ExpireSeconds
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) menuCreate(w http.ResponseWriter, r *http.Request) {
+	var menu struct {
+		Button []json.RawMessage `json:"button"`
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(raw, &menu)
+	}
+	if err != nil || len(menu.Button) == 0 {
+		writeError(w, errCodeInvalidArgs, "invalid menu")
+		return
+	}
+
+	s.mutex.Lock()
+	s.menu = raw
+	s.mutex.Unlock()
+	writeError(w, 0, "ok")
+}
+
+func (s *Server) menuGet(w http.ResponseWriter, _ *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.menu == nil {
+		writeError(w, errCodeMenuNotExist, "menu no exist")
+		return
+	}
+	var ids []int64
+	for id := range s.conditionalMenu {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var conditional []json.RawMessage
+	for _, id := range ids {
+		conditional = append(conditional, s.conditionalMenu[id])
+	}
+	writeJSON(w, map[string]interface{}{
+		"menu":            s.menu,
+		"conditionalmenu": conditional,
+	})
+}
+
+// menuDelete deletes the default menu together with every conditional menu, like wechat does.
+func (s *Server) menuDelete(w http.ResponseWriter, _ *http.Request) {
+	s.mutex.Lock()
+	s.menu = nil
+	s.conditionalMenu = make(map[int64]json.RawMessage)
+	s.mutex.Unlock()
+	writeError(w, 0, "ok")
+}
+
+func (s *Server) menuAddConditional(w http.ResponseWriter, r *http.Request) {
+	var menu map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&menu); err != nil || menu["matchrule"] == nil {
+		writeError(w, errCodeInvalidArgs, "invalid conditional menu")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.menu == nil {
+		writeError(w, errCodeMenuNotExist, "menu no exist")
+		return
+	}
+	s.nextMenuID++
+	menu["menuid"] = s.nextMenuID
+	raw, _ := json.Marshal(menu)
+	s.conditionalMenu[s.nextMenuID] = raw
+	writeJSON(w, map[string]interface{}{"menuid": strconv.FormatInt(s.nextMenuID, 10)})
+}
+
+func (s *Server) menuDelConditional(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MenuID int64 `json:"menuid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errCodeInvalidArgs, "invalid menuid")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.conditionalMenu[req.MenuID]; !ok {
+		writeError(w, errCodeMenuNotExist, "menu no exist")
+		return
+	}
+	delete(s.conditionalMenu, req.MenuID)
+	writeError(w, 0, "ok")
+}
+
+// oauthAuthorize approves at once and sends the browser back with a code, like a user tapping "allow".
+func (s *Server) oauthAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("appid") != s.appID {
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	code := fmt.Sprintf("fake_code_%d", time.Now().UnixNano())
+	s.oauthCodes[code] = s.oauthUser + " " + query.Get("scope")
+	s.mutex.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) oauthAccessToken(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("appid") != s.appID || query.Get("secret") != s.appSecret {
+		writeError(w, errCodeInvalidAppSecret, "invalid appsecret")
+		return
+	}
+
+	s.mutex.Lock()
+	grant, ok := s.oauthCodes[query.Get("code")]
+	delete(s.oauthCodes, query.Get("code")) // a code can only be used once
+	s.mutex.Unlock()
+
+	if !ok {
+		writeError(w, errCodeInvalidOAuthCode, "invalid code")
+		return
+	}
+	parts := strings.SplitN(grant, " ", 2)
+	writeJSON(w, map[string]interface{}{
+		"access_token":  "fake_oauth_token_" + parts[0],
+		"expires_in":    7200,
+		"refresh_token": "fake_refresh_token_" + parts[0],
+		"openid":        parts[0],
+		"scope":         parts[1],
+	})
+}
+
+func (s *Server) oauthUserInfo(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("access_token") != "fake_oauth_token_"+query.Get("openid") {
+		writeError(w, errCodeInvalidToken, "invalid credential, access_token is invalid or not latest")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"openid":   query.Get("openid"),
+		"nickname": "nick_" + query.Get("openid"),
+	})
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, ErrorResp{ErrCode: code, ErrMsg: msg})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; encoding=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		serverTracer.Errorf("fail to write response, %s", err.Error())
+	}
+}